@@ -24,6 +24,52 @@ type Config struct {
 
 	SignupCredits          int
 	DefaultModelCreditCost int
+
+	// CreditEstimateOutputTokens is the completion size assumed when
+	// reserving credits for token-priced models and the request does not set
+	// its own output limit.
+	CreditEstimateOutputTokens int
+
+	// RelayRetryMaxAttempts is the total number of upstream attempts per
+	// relay request, including the first one. 1 disables failover.
+	RelayRetryMaxAttempts int
+	// RelayRetryStatusCodes lists upstream statuses that trigger a retry on
+	// the next eligible channel. Transport errors always do.
+	RelayRetryStatusCodes []int
+	// RelayRetryBackoffMs is the delay before the first retry; it doubles on
+	// each following attempt up to RelayRetryMaxBackoffMs.
+	RelayRetryBackoffMs    int
+	RelayRetryMaxBackoffMs int
+
+	// CircuitFailureThreshold is the number of consecutive upstream failures
+	// that opens a channel's circuit breaker; 0 disables the breaker.
+	// CircuitCooldownSeconds is how long an open channel is skipped before a
+	// single half-open probe is let through.
+	CircuitFailureThreshold int
+	CircuitCooldownSeconds  int
+
+	// CountTokensPerMinute caps free token-counting requests per user and
+	// minute, in place of the quota rules; 0 disables the limit.
+	CountTokensPerMinute int
+
+	// PayloadCaptureTTLHours is how long captured request/response bodies
+	// are kept; PayloadCaptureMaxBytes caps each stored body after redaction.
+	PayloadCaptureTTLHours int
+	PayloadCaptureMaxBytes int
+
+	// MaxConcurrentRequests caps in-flight relay requests per user, indexed
+	// by level: the first entry applies to level 1, and the last one to every
+	// level beyond the list. 0 or an empty list means no limit. A per-user
+	// override takes precedence. ConcurrencyLeaseSeconds is how long a slot
+	// survives without being renewed, so slots held by a crashed instance
+	// free themselves.
+	MaxConcurrentRequests   []int
+	ConcurrencyLeaseSeconds int
+
+	// ChannelQueueTimeoutMs is how long a request waits for a channel when
+	// every channel serving its model is at its RPM/TPM limit; 0 fails at
+	// once.
+	ChannelQueueTimeoutMs int
 }
 
 func Load() (*Config, error) {
@@ -41,6 +87,26 @@ func Load() (*Config, error) {
 		JWTSecret:              os.Getenv("APP_JWT_SECRET"),
 		SignupCredits:          getEnvInt("APP_SIGNUP_CREDITS", 100),
 		DefaultModelCreditCost: getEnvInt("APP_DEFAULT_MODEL_CREDIT_COST", 1),
+
+		CreditEstimateOutputTokens: getEnvInt("APP_CREDIT_ESTIMATE_OUTPUT_TOKENS", 1024),
+
+		RelayRetryMaxAttempts:  getEnvInt("APP_RELAY_RETRY_MAX_ATTEMPTS", 3),
+		RelayRetryStatusCodes:  getEnvIntList("APP_RELAY_RETRY_STATUS_CODES", []int{429, 500, 502, 503, 504}),
+		RelayRetryBackoffMs:    getEnvInt("APP_RELAY_RETRY_BACKOFF_MS", 200),
+		RelayRetryMaxBackoffMs: getEnvInt("APP_RELAY_RETRY_MAX_BACKOFF_MS", 2000),
+
+		CircuitFailureThreshold: getEnvInt("APP_CIRCUIT_FAILURE_THRESHOLD", 5),
+		CircuitCooldownSeconds:  getEnvInt("APP_CIRCUIT_COOLDOWN_SECONDS", 30),
+
+		CountTokensPerMinute: getEnvInt("APP_COUNT_TOKENS_PER_MINUTE", 60),
+
+		PayloadCaptureTTLHours: getEnvInt("APP_PAYLOAD_CAPTURE_TTL_HOURS", 72),
+		PayloadCaptureMaxBytes: getEnvInt("APP_PAYLOAD_CAPTURE_MAX_BYTES", 64*1024),
+
+		MaxConcurrentRequests:   getEnvIntList("APP_MAX_CONCURRENT_REQUESTS", []int{}),
+		ConcurrencyLeaseSeconds: getEnvInt("APP_CONCURRENCY_LEASE_SECONDS", 60),
+
+		ChannelQueueTimeoutMs: getEnvInt("APP_CHANNEL_QUEUE_TIMEOUT_MS", 2000),
 	}
 
 	// Validate required environment variables
@@ -60,6 +126,39 @@ func Load() (*Config, error) {
 	if cfg.DefaultModelCreditCost < 0 {
 		cfg.DefaultModelCreditCost = 0
 	}
+	if cfg.CreditEstimateOutputTokens < 0 {
+		cfg.CreditEstimateOutputTokens = 0
+	}
+	if cfg.RelayRetryMaxAttempts < 1 {
+		cfg.RelayRetryMaxAttempts = 1
+	}
+	if cfg.RelayRetryBackoffMs < 0 {
+		cfg.RelayRetryBackoffMs = 0
+	}
+	if cfg.RelayRetryMaxBackoffMs < cfg.RelayRetryBackoffMs {
+		cfg.RelayRetryMaxBackoffMs = cfg.RelayRetryBackoffMs
+	}
+	if cfg.CircuitFailureThreshold < 0 {
+		cfg.CircuitFailureThreshold = 0
+	}
+	if cfg.CircuitCooldownSeconds <= 0 {
+		cfg.CircuitCooldownSeconds = 30
+	}
+	if cfg.CountTokensPerMinute < 0 {
+		cfg.CountTokensPerMinute = 0
+	}
+	if cfg.PayloadCaptureTTLHours <= 0 {
+		cfg.PayloadCaptureTTLHours = 72
+	}
+	if cfg.PayloadCaptureMaxBytes <= 0 {
+		cfg.PayloadCaptureMaxBytes = 64 * 1024
+	}
+	if cfg.ConcurrencyLeaseSeconds <= 0 {
+		cfg.ConcurrencyLeaseSeconds = 60
+	}
+	if cfg.ChannelQueueTimeoutMs < 0 {
+		cfg.ChannelQueueTimeoutMs = 0
+	}
 
 	return cfg, nil
 }
@@ -82,3 +181,20 @@ func getEnvInt(key string, def int) int {
 	}
 	return def
 }
+
+// getEnvIntList parses a comma-separated list of integers. Invalid entries are
+// skipped; an unset variable yields def. An explicitly empty value yields an
+// empty list.
+func getEnvIntList(key string, def []int) []int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	out := []int{}
+	for _, part := range strings.Split(v, ",") {
+		if i, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			out = append(out, i)
+		}
+	}
+	return out
+}
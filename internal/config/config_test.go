@@ -62,6 +62,7 @@ func TestLoadConfigAppliesDefaults(t *testing.T) {
 	unsetEnv(t, "APP_HTTP_LISTEN")
 	unsetEnv(t, "APP_SIGNUP_CREDITS")
 	unsetEnv(t, "APP_DEFAULT_MODEL_CREDIT_COST")
+	unsetEnv(t, "APP_COUNT_TOKENS_PER_MINUTE")
 
 	cfg, err := Load()
 	if err != nil {
@@ -83,6 +84,18 @@ func TestLoadConfigAppliesDefaults(t *testing.T) {
 	if cfg.DefaultModelCreditCost != 1 {
 		t.Fatalf("expected default model cost, got %d", cfg.DefaultModelCreditCost)
 	}
+	if cfg.CountTokensPerMinute != 60 {
+		t.Fatalf("expected default count_tokens limit, got %d", cfg.CountTokensPerMinute)
+	}
+	if cfg.PayloadCaptureTTLHours != 72 || cfg.PayloadCaptureMaxBytes != 64*1024 {
+		t.Fatalf("expected default payload capture settings, got %d/%d", cfg.PayloadCaptureTTLHours, cfg.PayloadCaptureMaxBytes)
+	}
+	if len(cfg.MaxConcurrentRequests) != 0 || cfg.ConcurrencyLeaseSeconds != 60 {
+		t.Fatalf("expected no concurrency limit by default, got %v/%d", cfg.MaxConcurrentRequests, cfg.ConcurrencyLeaseSeconds)
+	}
+	if cfg.ChannelQueueTimeoutMs != 2000 {
+		t.Fatalf("expected default channel queue timeout, got %d", cfg.ChannelQueueTimeoutMs)
+	}
 }
 
 func TestLoadConfigParsesInts(t *testing.T) {
@@ -104,3 +117,27 @@ func TestLoadConfigParsesInts(t *testing.T) {
 		t.Fatalf("expected model cost 5, got %d", cfg.DefaultModelCreditCost)
 	}
 }
+
+func TestLoadConfigParsesRetryPolicy(t *testing.T) {
+	t.Setenv("APP_PG_DSN", "dsn")
+	t.Setenv("APP_REDIS_ADDR", "localhost:6379")
+	t.Setenv("APP_JWT_SECRET", "secret")
+	t.Setenv("APP_RELAY_RETRY_MAX_ATTEMPTS", "0")
+	t.Setenv("APP_RELAY_RETRY_STATUS_CODES", "429, 503,bad")
+	unsetEnv(t, "APP_RELAY_RETRY_BACKOFF_MS")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.RelayRetryMaxAttempts != 1 {
+		t.Fatalf("expected attempts clamped to 1, got %d", cfg.RelayRetryMaxAttempts)
+	}
+	if len(cfg.RelayRetryStatusCodes) != 2 || cfg.RelayRetryStatusCodes[0] != 429 || cfg.RelayRetryStatusCodes[1] != 503 {
+		t.Fatalf("unexpected retry status codes: %v", cfg.RelayRetryStatusCodes)
+	}
+	if cfg.RelayRetryBackoffMs != 200 {
+		t.Fatalf("expected default backoff, got %d", cfg.RelayRetryBackoffMs)
+	}
+}
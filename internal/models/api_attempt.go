@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// APIAttempt records one upstream attempt made while serving a relay request.
+// A request that failed over between channels has several attempts, all
+// linked to the single APILog row of that request. ChannelKeyID is the
+// channel key the attempt used, or 0 for the channel's own key.
+type APIAttempt struct {
+	ID           uint      `gorm:"primaryKey"`
+	APILogID     uint      `gorm:"column:api_log_id;not null;index"`
+	ChannelID    uint      `gorm:"not null;index"`
+	ChannelKeyID uint      `gorm:"not null;default:0;index"`
+	Attempt      int       `gorm:"not null"`
+	StatusCode   int       `gorm:"not null"`
+	ErrorMessage string    `gorm:"type:text"`
+	LatencyMs    int64     `gorm:"not null;default:0"`
+	CreatedAt    time.Time `gorm:"not null"`
+}
+
+func (APIAttempt) TableName() string {
+	return "api_attempts"
+}
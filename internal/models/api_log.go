@@ -3,17 +3,35 @@ package models
 import "time"
 
 // APILog records a single API call made through the relay.
-// Status is a simple "success" / "fail" flag, while StatusCode stores the
-// upstream HTTP status code returned by new-api.
 type APILog struct {
-	ID           uint      `gorm:"primaryKey"`
-	UserID       uint      `gorm:"not null;index"`
-	Model        string    `gorm:"size:128;not null"`
-	Status       string    `gorm:"size:32;not null"`
-	StatusCode   int       `gorm:"not null"`
-	ErrorMessage string    `gorm:"type:text"`
-	IPAddress    string    `gorm:"size:64"`
-	CreatedAt    time.Time `gorm:"not null;index"`
+	ID uint `gorm:"primaryKey"`
+	// RequestID is returned to the client in X-Request-ID and shared with the
+	// request's credit transactions.
+	RequestID string `gorm:"size:64;not null;default:'';index"`
+	UserID    uint   `gorm:"not null;index"`
+	Model     string `gorm:"size:128;not null"`
+	// Endpoint names the relay endpoint, so side calls such as token counting
+	// can be told apart from generations.
+	Endpoint string `gorm:"size:64;not null;default:'';index"`
+	// Status is "success" or "fail", or "cancelled" / "timeout" when the
+	// client hung up or an upstream timeout cut the request short.
+	Status string `gorm:"size:32;not null"`
+	// StatusCode is the upstream HTTP status code.
+	StatusCode   int    `gorm:"not null"`
+	ErrorMessage string `gorm:"type:text"`
+	IPAddress    string `gorm:"size:64"`
+	// Token counts come from the usage block of the upstream response.
+	PromptTokens     int `gorm:"not null;default:0"`
+	CompletionTokens int `gorm:"not null;default:0"`
+	CachedTokens     int `gorm:"not null;default:0"`
+	// ChannelID is the channel that produced the final response, after
+	// Attempts upstream attempts (see APIAttempt).
+	ChannelID uint `gorm:"index"`
+	Attempts  int  `gorm:"not null;default:0"`
+	// CacheHit marks requests answered from the response cache without an
+	// upstream call.
+	CacheHit  bool      `gorm:"not null;default:false"`
+	CreatedAt time.Time `gorm:"not null;index"`
 }
 
 func (APILog) TableName() string {
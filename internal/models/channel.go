@@ -7,17 +7,66 @@ const (
 	ChannelStatusDis = "disabled"
 )
 
-// Channel represents an upstream channel configuration for new-api.
-// All channels are logically the same type (new-api); fields Type/Priority
-// have been removed and each channel is distinguished only by base_url,
-// api_key, supported models, and status.
+// Channel key rotations: how a channel with several keys spreads requests.
+const (
+	ChannelKeyRotationRoundRobin = ""
+	ChannelKeyRotationLeastUsed  = "least_used"
+)
+
+// Channel formats: the protocol the upstream speaks.
+const (
+	ChannelFormatAuto      = ""
+	ChannelFormatAnthropic = "anthropic"
+	ChannelFormatGemini    = "gemini"
+	ChannelFormatOpenAI    = "openai"
+)
+
+// Channel represents an upstream channel configuration for new-api or a
+// native provider API.
 type Channel struct {
-	ID        uint      `gorm:"primaryKey"`
-	Name      string    `gorm:"size:64;not null"`
-	BaseURL   string    `gorm:"column:base_url;not null"`
-	APIKey    string    `gorm:"column:api_key;not null"`
-	Models    string    `gorm:"type:jsonb;not null"`
-	Status    string    `gorm:"size:16;not null;default:'enabled'"`
-	CreatedAt time.Time `gorm:"not null"`
-	UpdatedAt time.Time `gorm:"not null"`
+	ID      uint   `gorm:"primaryKey"`
+	Name    string `gorm:"size:64;not null"`
+	BaseURL string `gorm:"column:base_url;not null"`
+	// APIKey is used unless the channel has ChannelKey rows; then requests
+	// rotate between the active ones as KeyRotation says.
+	APIKey string `gorm:"column:api_key;not null"`
+	Models string `gorm:"type:jsonb;not null"`
+	// ModelMapping maps public model names in Models to the names upstream
+	// expects, e.g. {"gpt-4o": "gpt-4o-2024-08-06"}; unmapped models are
+	// forwarded unchanged.
+	ModelMapping string `gorm:"type:jsonb;not null;default:'{}'"`
+	Status       string `gorm:"size:16;not null;default:'enabled'"`
+	// Weight spreads traffic among the channels of the highest Priority that
+	// serve a model.
+	Weight   int `gorm:"not null;default:1"`
+	Priority int `gorm:"not null;default:0"`
+	// MinLevel restricts the channel to users of at least that level.
+	MinLevel int `gorm:"not null;default:0"`
+	// Format is the protocol upstream speaks. "" is a new-api gateway taking
+	// every endpoint; "anthropic" and "gemini" also serve translated OpenAI
+	// chat completions, and "openai" also serves translated Anthropic
+	// messages.
+	Format string `gorm:"size:32;not null;default:''"`
+	// Headers are extra headers sent upstream. They override client headers
+	// but never the channel key.
+	Headers string `gorm:"type:jsonb;not null;default:'{}'"`
+	// The timeouts bound upstream calls in seconds; 0 keeps the relay
+	// defaults.
+	ConnectTimeoutSeconds int `gorm:"not null;default:0"`
+	HeaderTimeoutSeconds  int `gorm:"not null;default:0"`
+	IdleTimeoutSeconds    int `gorm:"not null;default:0"`
+	// RPMLimit and TPMLimit cap requests and tokens per minute, matching the
+	// upstream key's limits; 0 means no limit.
+	RPMLimit    int    `gorm:"column:rpm_limit;not null;default:0"`
+	TPMLimit    int    `gorm:"column:tpm_limit;not null;default:0"`
+	KeyRotation string `gorm:"size:16;not null;default:''"`
+	// ProxyURL is an outbound http, https or socks5 proxy.
+	ProxyURL string `gorm:"column:proxy_url;size:512;not null;default:''"`
+	// CACert is a PEM bundle of extra CAs to trust for private upstreams.
+	CACert              string    `gorm:"column:ca_cert;type:text;not null;default:''"`
+	TLSServerName       string    `gorm:"column:tls_server_name;size:255;not null;default:''"`
+	DisableHTTP2        bool      `gorm:"column:disable_http2;not null"`
+	MaxIdleConnsPerHost int       `gorm:"not null;default:0"`
+	CreatedAt           time.Time `gorm:"not null"`
+	UpdatedAt           time.Time `gorm:"not null"`
 }
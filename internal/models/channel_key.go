@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Channel key statuses. Exhausted keys were retired automatically after
+// upstream rejected them; disabled keys were switched off by an admin.
+const (
+	ChannelKeyStatusActive    = "active"
+	ChannelKeyStatusExhausted = "exhausted"
+	ChannelKeyStatusDisabled  = "disabled"
+)
+
+// ChannelKey is one of several upstream API keys of a channel. A channel with
+// keys rotates between its active ones instead of using Channel.APIKey.
+//
+// RequestCount and LastUsedAt track how much each key is used; LastError is
+// the upstream answer that retired an exhausted key.
+type ChannelKey struct {
+	ID           uint   `gorm:"primaryKey"`
+	ChannelID    uint   `gorm:"not null;index"`
+	APIKey       string `gorm:"column:api_key;not null"`
+	Status       string `gorm:"size:16;not null;default:'active'"`
+	RequestCount int64  `gorm:"not null;default:0"`
+	LastUsedAt   *time.Time
+	LastError    string `gorm:"type:text"`
+	ExhaustedAt  *time.Time
+	CreatedAt    time.Time `gorm:"not null"`
+	UpdatedAt    time.Time `gorm:"not null"`
+}
@@ -3,14 +3,19 @@ package models
 import "time"
 
 // CreditTransaction keeps audit logs for every credit balance change.
+// Transactions made for a relay request (reserve, settlement and refund)
+// carry its RequestID.
 type CreditTransaction struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    uint      `gorm:"not null"`
-	Delta     int       `gorm:"not null"`
-	Reason    string    `gorm:"size:64;not null"`
-	Status    string    `gorm:"size:16;not null"`
-	ModelName string    `gorm:"size:128"`
-	RequestID string    `gorm:"size:64"`
-	CreatedAt time.Time `gorm:"not null"`
-	UpdatedAt time.Time `gorm:"not null"`
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null"`
+	Delta     int    `gorm:"not null"`
+	Reason    string `gorm:"size:64;not null"`
+	Status    string `gorm:"size:16;not null"`
+	ModelName string `gorm:"size:128"`
+	RequestID string `gorm:"size:64;index"`
+	// Uncollected is the part of a settled charge the user's balance could
+	// not cover.
+	Uncollected int       `gorm:"not null;default:0"`
+	CreatedAt   time.Time `gorm:"not null"`
+	UpdatedAt   time.Time `gorm:"not null"`
 }
@@ -3,10 +3,26 @@ package models
 import "time"
 
 // ModelCreditRule defines per-model credit cost configuration.
+//
+// CreditCost is a flat charge per request. The *PricePerMillion fields add a
+// token-based charge on top, in credits per one million tokens; they are
+// settled from the usage reported by upstream once the response finishes.
+// A zero CachedPricePerMillion bills cached prompt tokens at the input price.
+// PricePerImage and PricePerAudioSecond price image generations and audio
+// transcriptions in their own units, settled the same way.
+//
+// Endpoint optionally scopes the rule to one relay endpoint; an empty Endpoint
+// applies to every endpoint.
 type ModelCreditRule struct {
-	ID           uint      `gorm:"primaryKey"`
-	ModelPattern string    `gorm:"size:128;not null"`
-	CreditCost   int       `gorm:"not null"`
-	CreatedAt    time.Time `gorm:"not null"`
-	UpdatedAt    time.Time `gorm:"not null"`
+	ID                    uint      `gorm:"primaryKey"`
+	ModelPattern          string    `gorm:"size:128;not null"`
+	Endpoint              string    `gorm:"size:64;not null;default:''"`
+	CreditCost            int       `gorm:"not null"`
+	InputPricePerMillion  float64   `gorm:"not null;default:0"`
+	OutputPricePerMillion float64   `gorm:"not null;default:0"`
+	CachedPricePerMillion float64   `gorm:"not null;default:0"`
+	PricePerImage         float64   `gorm:"not null;default:0"`
+	PricePerAudioSecond   float64   `gorm:"not null;default:0"`
+	CreatedAt             time.Time `gorm:"not null"`
+	UpdatedAt             time.Time `gorm:"not null"`
 }
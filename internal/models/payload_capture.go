@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// PayloadCaptureRule turns on payload capture for matching relay requests.
+//
+// UserID limits the rule to one user and ModelPattern to models with that
+// prefix; zero and empty match everyone. SampleRate is the fraction of
+// matching requests captured, in (0, 1]. Disabled rules are kept but ignored.
+type PayloadCaptureRule struct {
+	ID           uint      `gorm:"primaryKey"`
+	UserID       uint      `gorm:"not null;default:0"`
+	ModelPattern string    `gorm:"size:128;not null;default:''"`
+	SampleRate   float64   `gorm:"not null"`
+	Enabled      bool      `gorm:"not null"`
+	CreatedAt    time.Time `gorm:"not null"`
+	UpdatedAt    time.Time `gorm:"not null"`
+}
+
+// PayloadCapture stores the request and response bodies of one captured relay
+// call, linked to its APILog row. Bodies are redacted and truncated before
+// they are stored; Truncated reports whether either was cut. Rows are deleted
+// once ExpiresAt has passed.
+type PayloadCapture struct {
+	ID             uint      `gorm:"primaryKey"`
+	APILogID       uint      `gorm:"column:api_log_id;not null;uniqueIndex"`
+	UserID         uint      `gorm:"not null;index"`
+	Model          string    `gorm:"size:128;not null"`
+	RequestBody    string    `gorm:"type:text"`
+	ResponseBody   string    `gorm:"type:text"`
+	ResponseStatus int       `gorm:"not null;default:0"`
+	ContentType    string    `gorm:"size:128"`
+	Truncated      bool      `gorm:"not null;default:false"`
+	CreatedAt      time.Time `gorm:"not null"`
+	ExpiresAt      time.Time `gorm:"not null;index"`
+}
+
+func (PayloadCapture) TableName() string {
+	return "payload_captures"
+}
@@ -3,10 +3,14 @@ package models
 import "time"
 
 // QuotaRule defines per-level, per-model-pattern request limits.
+//
+// Endpoint optionally scopes the rule to one relay endpoint (for example
+// "streamGenerateContent"); an empty Endpoint applies to every endpoint.
 type QuotaRule struct {
 	ID            uint      `gorm:"primaryKey"`
 	Level         int       `gorm:"not null"`
 	ModelPattern  string    `gorm:"size:64;not null"`
+	Endpoint      string    `gorm:"size:64;not null;default:''"`
 	MaxRequests   int       `gorm:"not null"`
 	WindowSeconds int       `gorm:"not null"`
 	CreatedAt     time.Time `gorm:"not null"`
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// ResponseCacheRule opts requests for matching models into the response
+// cache. ModelPattern is a prefix and Endpoint optionally scopes the rule to
+// one relay endpoint, matched like quota and credit rules.
+//
+// TTLSeconds is how long a cached response is served. HitCreditPercent is the
+// share of the normal price charged for a cache hit (0 makes hits free).
+// Streaming requests and requests that sample (temperature above zero or
+// unset) are only cached when AllowStream and AllowSampling are set.
+//
+// Cached responses are shared by every user sending the same request; PerUser
+// keeps hits to the user whose request filled the entry.
+type ResponseCacheRule struct {
+	ID               uint      `gorm:"primaryKey"`
+	ModelPattern     string    `gorm:"size:128;not null;default:''"`
+	Endpoint         string    `gorm:"size:64;not null;default:''"`
+	TTLSeconds       int       `gorm:"not null"`
+	HitCreditPercent int       `gorm:"not null;default:0"`
+	AllowStream      bool      `gorm:"not null"`
+	AllowSampling    bool      `gorm:"not null"`
+	PerUser          bool      `gorm:"not null;default:false"`
+	Enabled          bool      `gorm:"not null"`
+	CreatedAt        time.Time `gorm:"not null"`
+	UpdatedAt        time.Time `gorm:"not null"`
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// maxErrorMessageSize caps how much of an unstructured upstream error body is
+// quoted back to the client.
+const maxErrorMessageSize = 512
+
+// ErrorBody renders an error in the shape clients of format expect:
+// OpenAI's {"error":{"message","type","code"}}, Anthropic's
+// {"type":"error","error":{"type","message"}} or a Gemini google.rpc.Status.
+// FormatAuto renders the OpenAI shape. code is a stable machine-readable
+// reason and may be empty. It returns the HTTP status to send, which differs
+// from status only where a format has no counterpart for it.
+func ErrorBody(format Format, status int, code, message string) (int, []byte) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	var body any
+	switch format {
+	case FormatAnthropic:
+		body = map[string]any{
+			"type":  "error",
+			"error": map[string]any{"type": anthropicErrorType(status), "message": message},
+		}
+	case FormatGemini:
+		status = geminiHTTPStatus(status)
+		body = map[string]any{
+			"error": map[string]any{"code": status, "message": message, "status": geminiRPCStatus(status)},
+		}
+	default:
+		var c any
+		if code != "" {
+			c = code
+		}
+		body = map[string]any{
+			"error": map[string]any{"message": message, "type": openAIErrorType(status), "code": c},
+		}
+	}
+	out, _ := json.Marshal(body)
+	return status, out
+}
+
+// openAIErrorType maps an HTTP status to the error type OpenAI reports with it.
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusPaymentRequired:
+		return "insufficient_quota"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= 500:
+		return "server_error"
+	}
+	return "invalid_request_error"
+}
+
+// anthropicErrorType maps an HTTP status to Anthropic's error type.
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusPaymentRequired:
+		return "billing_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusGatewayTimeout:
+		return "timeout_error"
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded_error"
+	case status >= 500:
+		return "api_error"
+	}
+	return "invalid_request_error"
+}
+
+// geminiHTTPStatus adjusts statuses google.rpc has no code for. Running out of
+// credits is reported the way Gemini reports an exhausted quota.
+func geminiHTTPStatus(status int) int {
+	if status == http.StatusPaymentRequired {
+		return http.StatusTooManyRequests
+	}
+	return status
+}
+
+// geminiRPCStatus maps an HTTP status to its canonical google.rpc code name.
+func geminiRPCStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case status == http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case status == http.StatusNotFound:
+		return "NOT_FOUND"
+	case status == http.StatusConflict:
+		return "ABORTED"
+	case status == http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case status == 499:
+		return "CANCELLED"
+	case status == http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case status == http.StatusServiceUnavailable || status == http.StatusBadGateway:
+		return "UNAVAILABLE"
+	case status == http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	case status >= 500:
+		return "INTERNAL"
+	}
+	return "INVALID_ARGUMENT"
+}
+
+// UpstreamErrorMessage extracts the human-readable message from an upstream
+// error body in any of the supported shapes, falling back to the start of
+// the raw body.
+func UpstreamErrorMessage(body []byte) string {
+	var parsed struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		var nested struct {
+			Message string `json:"message"`
+		}
+		var flat string
+		switch {
+		case json.Unmarshal(parsed.Error, &nested) == nil && nested.Message != "":
+			return nested.Message
+		case json.Unmarshal(parsed.Error, &flat) == nil && flat != "":
+			return flat
+		case parsed.Message != "":
+			return parsed.Message
+		}
+	}
+	msg := strings.TrimSpace(string(bytes.ToValidUTF8(body, nil)))
+	if len(msg) > maxErrorMessageSize {
+		msg = strings.ToValidUTF8(msg[:maxErrorMessageSize], "")
+	}
+	return msg
+}
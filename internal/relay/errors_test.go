@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestErrorBodyShapes(t *testing.T) {
+	status, body := ErrorBody(FormatOpenAI, http.StatusTooManyRequests, "quota_exceeded", "slow down")
+	var openai struct {
+		Error struct {
+			Message string  `json:"message"`
+			Type    string  `json:"type"`
+			Code    *string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &openai); err != nil || status != http.StatusTooManyRequests ||
+		openai.Error.Type != "rate_limit_error" || openai.Error.Code == nil || *openai.Error.Code != "quota_exceeded" {
+		t.Fatalf("unexpected openai error %d %s", status, body)
+	}
+
+	status, body = ErrorBody(FormatAnthropic, http.StatusPaymentRequired, "credit_insufficient", "no credits")
+	var anthropic struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &anthropic); err != nil || status != http.StatusPaymentRequired ||
+		anthropic.Type != "error" || anthropic.Error.Type != "billing_error" || anthropic.Error.Message != "no credits" {
+		t.Fatalf("unexpected anthropic error %d %s", status, body)
+	}
+
+	status, body = ErrorBody(FormatGemini, http.StatusPaymentRequired, "credit_insufficient", "no credits")
+	var gemini struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &gemini); err != nil || status != http.StatusTooManyRequests ||
+		gemini.Error.Code != http.StatusTooManyRequests || gemini.Error.Status != "RESOURCE_EXHAUSTED" {
+		t.Fatalf("unexpected gemini error %d %s", status, body)
+	}
+}
+
+func TestUpstreamErrorMessage(t *testing.T) {
+	cases := map[string]string{
+		`{"error":{"message":"bad key","type":"invalid_request_error"}}`:         "bad key",
+		`{"type":"error","error":{"type":"api_error","message":"overloaded"}}`:   "overloaded",
+		`{"error":{"code":400,"message":"bad arg","status":"INVALID_ARGUMENT"}}`: "bad arg",
+		`{"error":"quota_exceeded"}`:                                             "quota_exceeded",
+		" upstream down \n":                                                      "upstream down",
+	}
+	for body, want := range cases {
+		if got := UpstreamErrorMessage([]byte(body)); got != want {
+			t.Fatalf("%s: expected %q, got %q", body, want, got)
+		}
+	}
+}
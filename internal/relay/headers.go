@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// hopByHopHeaders describe a single connection and are never forwarded by a
+// proxy (RFC 9110, section 7.6.1).
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// droppedRequestHeaders never reach upstream: client credentials and
+// cookies, information about the client's own network path, and headers the
+// transport manages itself. Accept-Encoding is left to the transport so
+// bodies arrive decoded and usage can be read from them.
+var droppedRequestHeaders = map[string]bool{
+	"Authorization":     true,
+	"X-Api-Key":         true,
+	"X-Goog-Api-Key":    true,
+	"Cookie":            true,
+	"Host":              true,
+	"Content-Length":    true,
+	"Accept-Encoding":   true,
+	"Forwarded":         true,
+	"X-Forwarded-For":   true,
+	"X-Forwarded-Host":  true,
+	"X-Forwarded-Proto": true,
+	"X-Real-Ip":         true,
+	"Origin":            true,
+	"Referer":           true,
+}
+
+// allowedResponseHeaders are the upstream response headers passed on to the
+// client; everything else, such as cookies, rate limit state and gateway
+// internals, stays with the relay.
+var allowedResponseHeaders = map[string]bool{
+	"Content-Type":        true,
+	"Content-Length":      true,
+	"Content-Encoding":    true,
+	"Content-Disposition": true,
+	"Content-Language":    true,
+	"Cache-Control":       true,
+	"Retry-After":         true,
+}
+
+// credentialQueryParams carry API keys in the query string, as Gemini allows.
+var credentialQueryParams = []string{"key"}
+
+// ValidUpstreamHeader reports whether name may be configured as an extra
+// upstream header. Hop-by-hop headers and headers the transport sets itself
+// are refused.
+func ValidUpstreamHeader(name string) bool {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return false
+	}
+	canonical := http.CanonicalHeaderKey(name)
+	return !hopByHopHeaders[canonical] && canonical != "Host" && canonical != "Content-Length"
+}
+
+// forwardRequestHeader reports whether a client request header is passed on
+// to an upstream speaking format. Anthropic's version and beta headers only
+// mean something to upstreams that understand the Messages API.
+func forwardRequestHeader(name string, format Format) bool {
+	if hopByHopHeaders[name] || droppedRequestHeaders[name] {
+		return false
+	}
+	if strings.HasPrefix(name, "Anthropic-") {
+		return format == FormatAuto || format == FormatAnthropic
+	}
+	return true
+}
+
+// upstreamHeaders builds the headers of an upstream request from the client
+// headers and the channel settings in up. Channel headers override client
+// ones; the channel key is set last so nothing can replace it.
+func upstreamHeaders(client http.Header, up Upstream) http.Header {
+	out := http.Header{}
+	for k, vals := range client {
+		if !forwardRequestHeader(http.CanonicalHeaderKey(k), up.Format) {
+			continue
+		}
+		for _, v := range vals {
+			out.Add(k, v)
+		}
+	}
+	// Headers named in Connection are hop-by-hop for this connection only.
+	for _, v := range client.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			out.Del(strings.TrimSpace(name))
+		}
+	}
+	for k, v := range up.Headers {
+		if ValidUpstreamHeader(k) {
+			out.Set(k, v)
+		}
+	}
+
+	if up.APIKey != "" {
+		switch up.Format {
+		case FormatAnthropic:
+			out.Set("x-api-key", up.APIKey)
+		case FormatGemini:
+			out.Set("x-goog-api-key", up.APIKey)
+		default:
+			out.Set("Authorization", "Bearer "+up.APIKey)
+		}
+	}
+	if up.Format == FormatAnthropic && out.Get("anthropic-version") == "" {
+		out.Set("anthropic-version", defaultAnthropicVersion)
+	}
+	return out
+}
+
+// copyResponseHeaders copies the allowed upstream response headers to dst.
+func copyResponseHeaders(dst, src http.Header) {
+	for k, vals := range src {
+		if !allowedResponseHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for _, v := range vals {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// StripQueryCredentials removes API keys from a raw query string so a
+// client's own key is never forwarded upstream. The other parameters are kept
+// as they were sent, including ones that do not parse.
+func StripQueryCredentials(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	segments := strings.Split(rawQuery, "&")
+	kept := segments[:0]
+	for _, seg := range segments {
+		name, _, _ := strings.Cut(seg, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !slices.Contains(credentialQueryParams, name) {
+			kept = append(kept, seg)
+		}
+	}
+	return strings.Join(kept, "&")
+}
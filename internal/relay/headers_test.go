@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamHeadersPolicy(t *testing.T) {
+	client := http.Header{}
+	client.Set("Authorization", "Bearer user-key")
+	client.Set("X-Api-Key", "user-key")
+	client.Set("X-Goog-Api-Key", "user-key")
+	client.Set("Cookie", "session=1")
+	client.Set("Connection", "keep-alive, X-Trace")
+	client.Set("X-Trace", "abc")
+	client.Set("Transfer-Encoding", "chunked")
+	client.Set("X-Forwarded-For", "203.0.113.7")
+	client.Set("Content-Type", "application/json")
+	client.Set("Anthropic-Version", "2023-06-01")
+	client.Set("Anthropic-Beta", "tools-2024-04-04")
+	client.Set("User-Agent", "sdk/1.0")
+
+	got := upstreamHeaders(client, Upstream{APIKey: "channel-key", Format: FormatAnthropic, Headers: map[string]string{"anthropic-beta": "channel-beta"}})
+	for _, name := range []string{"Authorization", "Cookie", "Connection", "X-Trace", "Transfer-Encoding", "X-Forwarded-For", "X-Goog-Api-Key"} {
+		if got.Get(name) != "" {
+			t.Fatalf("%s must not be forwarded, got %v", name, got)
+		}
+	}
+	if got.Get("X-Api-Key") != "channel-key" {
+		t.Fatalf("expected the channel key, got %q", got.Get("X-Api-Key"))
+	}
+	if got.Get("Anthropic-Version") != "2023-06-01" || got.Get("Anthropic-Beta") != "channel-beta" {
+		t.Fatalf("unexpected anthropic headers %v", got)
+	}
+	if got.Get("Content-Type") != "application/json" || got.Get("User-Agent") != "sdk/1.0" {
+		t.Fatalf("ordinary headers must be forwarded, got %v", got)
+	}
+
+	got = upstreamHeaders(client, Upstream{APIKey: "channel-key", Format: FormatOpenAI, Headers: map[string]string{"Authorization": "Bearer other"}})
+	if got.Get("Anthropic-Version") != "" || got.Get("Anthropic-Beta") != "" {
+		t.Fatalf("anthropic headers must not reach an OpenAI upstream, got %v", got)
+	}
+	if got.Get("Authorization") != "Bearer channel-key" || got.Get("X-Api-Key") != "" {
+		t.Fatalf("channel headers must not replace the key, got %v", got)
+	}
+}
+
+func TestCopyResponseHeadersAllowlist(t *testing.T) {
+	src := http.Header{}
+	src.Set("Content-Type", "application/json")
+	src.Set("Retry-After", "3")
+	src.Set("Set-Cookie", "upstream=1")
+	src.Set("X-Ratelimit-Remaining-Requests", "10")
+	src.Set("X-New-Api-Version", "v0.6")
+	dst := http.Header{}
+
+	copyResponseHeaders(dst, src)
+	if dst.Get("Content-Type") != "application/json" || dst.Get("Retry-After") != "3" {
+		t.Fatalf("allowed headers missing: %v", dst)
+	}
+	if len(dst) != 2 {
+		t.Fatalf("unexpected headers passed on: %v", dst)
+	}
+}
+
+func TestStripQueryCredentials(t *testing.T) {
+	cases := map[string]string{
+		"":                    "",
+		"alt=sse":             "alt=sse",
+		"key=secret":          "",
+		"alt=sse&key=abc":     "alt=sse",
+		"key=a&key=b&x=%20":   "x=%20",
+		"alt=sse&k%65y=abc":   "alt=sse",
+		"alt=sse&key=a&q=%zz": "alt=sse&q=%zz",
+		"key=a;b&alt=sse":     "alt=sse",
+	}
+	for in, want := range cases {
+		if got := StripQueryCredentials(in); got != want {
+			t.Fatalf("StripQueryCredentials(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestValidUpstreamHeader(t *testing.T) {
+	for name, want := range map[string]bool{
+		"anthropic-beta": true,
+		"HTTP-Referer":   true,
+		"connection":     false,
+		"Host":           false,
+		"bad header":     false,
+		"":               false,
+	} {
+		if got := ValidUpstreamHeader(name); got != want {
+			t.Fatalf("ValidUpstreamHeader(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
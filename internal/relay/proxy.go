@@ -2,67 +2,351 @@ package relay
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 )
 
+const (
+	// DefaultStreamHeartbeat is how often a keep-alive comment is sent on an
+	// otherwise silent event stream.
+	DefaultStreamHeartbeat = 15 * time.Second
+	// DefaultStreamIdleTimeout is how long an event stream may stay silent
+	// upstream before it is aborted.
+	DefaultStreamIdleTimeout = 5 * time.Minute
+
+	// maxUsageBodySize caps how much of a buffered response we keep around to
+	// look for a usage block.
+	maxUsageBodySize = 8 << 20
+	// maxTranslatedBodySize caps a non-stream response that has to be read
+	// whole to be translated.
+	maxTranslatedBodySize = 32 << 20
+)
+
+// ProxyResult summarises a relayed upstream response.
+type ProxyResult struct {
+	// StatusCode is the upstream status; non-zero means the response headers
+	// have already been written to the client.
+	StatusCode int
+	// Stream is true when the upstream answered with an SSE stream.
+	Stream bool
+	// Usage is the token usage reported by upstream, if any.
+	Usage Usage
+	// ResponseID is the id of the Responses API object the request created
+	// or returned, if any.
+	ResponseID string
+	// ErrorMessage is the message of a non-2xx upstream answer, when one
+	// could be read from its body.
+	ErrorMessage string
+}
+
+// Format is the wire protocol an upstream channel speaks natively. It decides
+// how the channel key is presented.
+type Format string
+
+const (
+	// FormatAuto is a new-api style gateway that accepts every protocol with
+	// a Bearer key.
+	FormatAuto Format = ""
+	// FormatAnthropic is the Anthropic Messages API (x-api-key).
+	FormatAnthropic Format = "anthropic"
+	// FormatGemini is the Gemini API (x-goog-api-key).
+	FormatGemini Format = "gemini"
+	// FormatOpenAI is an OpenAI-compatible API without the other protocols
+	// (Bearer key).
+	FormatOpenAI Format = "openai"
+)
+
+// defaultAnthropicVersion is sent to native Anthropic upstreams when the
+// client did not ask for a version itself.
+const defaultAnthropicVersion = "2023-06-01"
+
+// Upstream describes one request to send upstream.
+type Upstream struct {
+	Method string
+	URL    string
+	APIKey string
+	Body   []byte
+	// Format decides how APIKey is sent and which protocol headers are
+	// forwarded.
+	Format Format
+	// Headers are extra headers the channel sends upstream.
+	Headers map[string]string
+	// Timeouts bounds the request; see Timeouts for the defaults.
+	Timeouts Timeouts
+	// Transport selects the channel's proxy, TLS and connection pool
+	// settings; the zero value uses the shared transport.
+	Transport TransportConfig
+	// ChannelID identifies the channel whose transport is cached for Transport.
+	ChannelID uint
+}
+
 // ProxyClient is a thin HTTP client wrapper used to forward requests to new-api.
+// HTTP serves channels without transport settings; a client per channel with
+// settings is built on demand and kept for reuse until they change.
 type ProxyClient struct {
 	HTTP *http.Client
+
+	transports sync.Map // channel ID -> *channelClient
+
+	// StreamHeartbeat controls keep-alive comments on SSE responses; zero
+	// disables them.
+	StreamHeartbeat time.Duration
+	// StreamIdleTimeout aborts SSE responses when upstream sends nothing for
+	// this long; zero disables the check.
+	StreamIdleTimeout time.Duration
 }
 
 func NewProxyClient() *ProxyClient {
-	return &ProxyClient{HTTP: &http.Client{}}
+	return &ProxyClient{
+		HTTP:              &http.Client{Transport: newTransport()},
+		StreamHeartbeat:   DefaultStreamHeartbeat,
+		StreamIdleTimeout: DefaultStreamIdleTimeout,
+	}
 }
 
 // ProxyRequest forwards the given body to the target URL with the provided
 // method and headers. It copies the upstream response back to w without
-// inspecting or modifying it.
+// inspecting or modifying it. Server-sent event responses are relayed event by
+// event and flushed as they arrive, and reading stops as soon as the client
+// goes away.
+//
+// Token usage is read from the relayed payload on the way through, both for
+// buffered JSON bodies and for stream events.
 //
 // It returns the upstream HTTP status code (if the request was sent
-// successfully) and any error encountered while performing the request or
-// copying the response body.
-func (c *ProxyClient) ProxyRequest(w http.ResponseWriter, origReq *http.Request, method, url, apiKey string, body []byte) (int, error) {
+// successfully) along with the observed usage, and any error encountered while
+// performing the request or copying the response body.
+func (c *ProxyClient) ProxyRequest(w http.ResponseWriter, origReq *http.Request, method, url, apiKey string, body []byte) (ProxyResult, error) {
+	resp, err := c.Send(origReq, method, url, apiKey, body)
+	if err != nil {
+		return ProxyResult{}, err
+	}
+	return c.Relay(w, origReq, resp)
+}
+
+// Send performs the upstream request without touching the client response, so
+// callers can inspect the status and decide whether to relay it or retry
+// elsewhere. Client headers pass through the policy of upstreamHeaders. The
+// caller owns the returned response body.
+func (c *ProxyClient) Send(origReq *http.Request, method, url, apiKey string, body []byte) (*http.Response, error) {
+	return c.SendUpstream(origReq, Upstream{Method: method, URL: url, APIKey: apiKey, Body: body})
+}
+
+// SendUpstream is Send for a fully described upstream request.
+//
+// The upstream request lives in the context of origReq, so it is aborted as
+// soon as the client goes away, and is further bounded by up.Timeouts. Errors
+// caused by those timeouts satisfy IsTimeout.
+func (c *ProxyClient) SendUpstream(origReq *http.Request, up Upstream) (*http.Response, error) {
 	var bodyReader io.Reader
-	if body != nil {
-		bodyReader = bytes.NewReader(body)
+	if up.Body != nil {
+		bodyReader = bytes.NewReader(up.Body)
 	}
 
-	upReq, err := http.NewRequest(method, url, bodyReader)
+	httpClient, err := c.httpClientFor(up.ChannelID, up.Transport)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	// Copy relevant headers from original request.
-	for k, vals := range origReq.Header {
-		// Skip original Authorization; we will set channel-specific key below.
-		if strings.EqualFold(k, "Authorization") {
-			continue
-		}
-		for _, v := range vals {
-			upReq.Header.Add(k, v)
-		}
+	ctx, cancel := context.WithCancelCause(origReq.Context())
+	reqCtx := ctx
+	if up.Timeouts.Connect > 0 {
+		reqCtx = context.WithValue(ctx, connectTimeoutKey{}, up.Timeouts.Connect)
 	}
-	if apiKey != "" {
-		upReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upReq, err := http.NewRequestWithContext(reqCtx, up.Method, up.URL, bodyReader)
+	if err != nil {
+		cancel(nil)
+		return nil, err
 	}
 
-	resp, err := c.HTTP.Do(upReq)
+	upReq.Header = upstreamHeaders(origReq.Header, up)
+
+	var headerTimer *time.Timer
+	if up.Timeouts.Header > 0 {
+		headerTimer = time.AfterFunc(up.Timeouts.Header, func() { cancel(ErrHeaderTimeout) })
+	}
+	resp, err := httpClient.Do(upReq)
+	if headerTimer != nil && !headerTimer.Stop() && err == nil {
+		// The timer fired just as the headers arrived; the body is already
+		// cancelled, so report the timeout.
+		_ = resp.Body.Close()
+		resp, err = nil, ErrHeaderTimeout
+	}
 	if err != nil {
-		return 0, err
+		if cause := context.Cause(ctx); errors.Is(cause, ErrHeaderTimeout) {
+			err = cause
+		}
+		cancel(nil)
+		return nil, err
 	}
+	resp.Body = newUpstreamBody(resp.Body, ctx, cancel, up.Timeouts.Idle)
+	return resp, nil
+}
+
+// Relay writes an upstream response obtained from Send back to w and closes
+// its body. See ProxyRequest for how streams and usage are handled.
+func (c *ProxyClient) Relay(w http.ResponseWriter, origReq *http.Request, resp *http.Response) (ProxyResult, error) {
+	return c.RelayTranslated(w, origReq, resp, nil, false)
+}
+
+// RelayTranslated is Relay for an upstream that spoke another protocol than
+// the client: successful responses and stream events are passed through tr
+// on the way out, and error responses are re-rendered in the client's error
+// shape with the upstream message kept. Usage is read from
+// the upstream payload before translation. A nil tr relays unchanged.
+// hideUsage drops the usage-only chunk the relay asked an OpenAI stream for
+// on the client's behalf; its usage is still recorded.
+func (c *ProxyClient) RelayTranslated(w http.ResponseWriter, origReq *http.Request, resp *http.Response, tr Translator, hideUsage bool) (ProxyResult, error) {
+	var result ProxyResult
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	// Copy status and headers.
-	for k, vals := range resp.Header {
-		for _, v := range vals {
-			w.Header().Add(k, v)
-		}
+	stream := IsEventStream(resp.Header.Get("Content-Type"))
+	result.StatusCode = resp.StatusCode
+	result.Stream = stream
+	if tr != nil && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		return c.relayTranslatedError(w, resp, tr)
+	}
+	if tr != nil && !stream {
+		return c.relayTranslatedBody(w, resp, tr)
 	}
+
+	// Copy status and the headers the client may see.
+	copyResponseHeaders(w.Header(), resp.Header)
+	if stream {
+		// Events are re-framed and flushed individually, so any upstream
+		// length no longer applies; also ask reverse proxies not to buffer.
+		w.Header().Del("Content-Length")
+		w.Header().Set("X-Accel-Buffering", "no")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var err error
+	if stream {
+		tracker := &usageTracker{}
+		err = c.streamEvents(origReq.Context(), w, resp.Body, tracker, tr, hideUsage)
+		result.Usage = tracker.usage
+		result.ResponseID = tracker.responseID
+		return result, err
+	}
+
+	var captured bytes.Buffer
+	_, err = io.Copy(w, io.TeeReader(resp.Body, &limitedBuffer{buf: &captured, limit: maxUsageBodySize}))
+	if u, ok := ParseUsage(captured.Bytes()); ok {
+		result.Usage = u
+	}
+	result.ResponseID = ParseResponseID(captured.Bytes())
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		result.ErrorMessage = UpstreamErrorMessage(captured.Bytes())
+	}
+	return result, err
+}
+
+// relayTranslatedBody reads a complete upstream body, translates it and
+// writes the result with a matching length.
+func (c *ProxyClient) relayTranslatedBody(w http.ResponseWriter, resp *http.Response, tr Translator) (ProxyResult, error) {
+	result := ProxyResult{StatusCode: resp.StatusCode}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxTranslatedBodySize))
+	if err != nil {
+		return result, err
+	}
+	if u, ok := ParseUsage(raw); ok {
+		result.Usage = u
+	}
+	out, err := tr.Response(raw)
+	if err != nil {
+		status, body := tr.Error(http.StatusBadGateway, "failed to translate upstream response")
+		result.StatusCode = status
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+		return result, err
+	}
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
-	return resp.StatusCode, err
+	_, err = w.Write(out)
+	return result, err
+}
+
+// relayTranslatedError re-renders an upstream error response in the client's
+// error shape. Result.StatusCode keeps the upstream status so failures are
+// attributed to the channel as they happened.
+func (c *ProxyClient) relayTranslatedError(w http.ResponseWriter, resp *http.Response, tr Translator) (ProxyResult, error) {
+	result := ProxyResult{StatusCode: resp.StatusCode}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxUsageBodySize))
+	if err != nil {
+		return result, err
+	}
+	result.ErrorMessage = UpstreamErrorMessage(raw)
+	status, out := tr.Error(resp.StatusCode, result.ErrorMessage)
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+	return result, err
+}
+
+// Discard drains and closes an upstream response that will not be relayed,
+// so the underlying connection can be reused.
+func Discard(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	_ = resp.Body.Close()
+}
+
+// PeekBody reads up to limit bytes from the start of resp's body and puts
+// them back, so the body can still be relayed in full. A body returned by
+// SendUpstream keeps its type, and with it its timeouts.
+func PeekBody(resp *http.Response, limit int64) []byte {
+	if resp == nil || resp.Body == nil {
+		return nil
+	}
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if b, ok := resp.Body.(*upstreamBody); ok {
+		b.ReadCloser = prependBody(head, b.ReadCloser)
+	} else {
+		resp.Body = prependBody(head, resp.Body)
+	}
+	return head
+}
+
+// prependBody returns body with head put back in front of it.
+func prependBody(head []byte, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), body), body}
+}
+
+// limitedBuffer keeps at most limit bytes and silently drops the rest, so it
+// can sit behind an io.TeeReader without ever failing the copy.
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
 }
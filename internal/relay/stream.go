@@ -0,0 +1,228 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+// ErrStreamIdleTimeout is returned when an upstream event stream stays silent
+// for longer than the configured idle timeout.
+var ErrStreamIdleTimeout = errors.New("upstream stream idle timeout")
+
+// sseHeartbeat is an SSE comment line. Clients ignore comments, but writing
+// one keeps intermediaries from closing an otherwise idle connection.
+var sseHeartbeat = []byte(": keep-alive\n\n")
+
+// maxSSELineSize bounds a single SSE line so a misbehaving upstream cannot make
+// us buffer unbounded data before the next flush.
+const maxSSELineSize = 4 << 20
+
+// maxSSEEventSize bounds a whole SSE event, which may be made of many lines.
+const maxSSEEventSize = 16 << 20
+
+// IsEventStream reports whether the given Content-Type header denotes a
+// server-sent event stream.
+func IsEventStream(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/event-stream"
+}
+
+// sseReadResult carries one complete SSE event (including its terminating
+// blank line) or the error that ended the upstream stream.
+type sseReadResult struct {
+	event []byte
+	err   error
+}
+
+// readSSEEvents splits the upstream body into SSE events and sends them on
+// out. It stops on the first read error or when done is closed.
+func readSSEEvents(body io.Reader, out chan<- sseReadResult, done <-chan struct{}) {
+	defer close(out)
+
+	reader := bufio.NewReaderSize(body, 64<<10)
+	var event bytes.Buffer
+	send := func(res sseReadResult) bool {
+		select {
+		case out <- res:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	// lineLen is the length of the current line so far; a line longer than
+	// the buffer arrives in several fragments.
+	lineLen := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		lineLen += len(line)
+		event.Write(line)
+		if lineLen > maxSSELineSize {
+			send(sseReadResult{err: errors.New("sse line too long")})
+			return
+		}
+		if event.Len() > maxSSEEventSize {
+			send(sseReadResult{err: errors.New("sse event too long")})
+			return
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// Keep accumulating an overly long line until we see its end.
+			continue
+		}
+
+		if err != nil {
+			if event.Len() > 0 {
+				if !send(sseReadResult{event: bytes.Clone(event.Bytes())}) {
+					return
+				}
+			}
+			if !errors.Is(err, io.EOF) {
+				send(sseReadResult{err: err})
+			}
+			return
+		}
+
+		// A blank line terminates the event; flush it downstream as a unit. The
+		// last fragment of a long line may look blank but is not.
+		blank := lineLen == len(line) && isBlankLine(line)
+		lineLen = 0
+		if blank {
+			if !send(sseReadResult{event: bytes.Clone(event.Bytes())}) {
+				return
+			}
+			event.Reset()
+		}
+	}
+}
+
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// streamEvents relays an upstream SSE body to w, flushing after every event.
+//
+// While waiting for upstream data it writes heartbeat comments every
+// c.StreamHeartbeat, and gives up with ErrStreamIdleTimeout once nothing has
+// arrived for c.StreamIdleTimeout, unless the body enforces a per-channel
+// idle timeout itself. If ctx is cancelled (client disconnected)
+// the upstream body is closed so we stop reading, and ctx.Err() is returned.
+// Every relayed event is also handed to usage so token counts can be read
+// from the stream. When tr is set, each upstream event is translated before it
+// is written, and the translator's closing events follow a clean end of the
+// upstream stream. hideUsage keeps an untranslated stream's usage-only chunk
+// from the client once its usage has been read.
+func (c *ProxyClient) streamEvents(ctx context.Context, w http.ResponseWriter, body io.ReadCloser, usage *usageTracker, tr Translator, hideUsage bool) error {
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	// Push headers out immediately so clients see the stream has started.
+	flush()
+
+	done := make(chan struct{})
+	defer close(done)
+	events := make(chan sseReadResult)
+	go readSSEEvents(body, events, done)
+
+	var heartbeat <-chan time.Time
+	if c.StreamHeartbeat > 0 {
+		ticker := time.NewTicker(c.StreamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	idleTimeout := c.StreamIdleTimeout
+	if b, ok := body.(*upstreamBody); ok && b.idle > 0 {
+		// The channel's own idle timeout is enforced on the body itself.
+		idleTimeout = 0
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	resetIdle := func() {
+		if idleTimer == nil {
+			return
+		}
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+		idleTimer.Reset(idleTimeout)
+	}
+
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = body.Close()
+			return ctx.Err()
+
+		case <-idle:
+			_ = body.Close()
+			return ErrStreamIdleTimeout
+
+		case now := <-heartbeat:
+			if now.Sub(lastWrite) < c.StreamHeartbeat {
+				continue
+			}
+			if _, err := w.Write(sseHeartbeat); err != nil {
+				_ = body.Close()
+				return err
+			}
+			flush()
+			lastWrite = now
+
+		case res, ok := <-events:
+			if !ok {
+				if tr != nil {
+					if _, err := w.Write(tr.StreamEnd()); err != nil {
+						return err
+					}
+					flush()
+				}
+				return nil
+			}
+			if res.err != nil {
+				return res.err
+			}
+			resetIdle()
+			usage.observeEvent(res.event)
+			out := res.event
+			if tr == nil && hideUsage && isUsageChunk(res.event) {
+				continue
+			}
+			if tr != nil {
+				out = tr.StreamEvent(res.event)
+				if len(out) == 0 {
+					continue
+				}
+			}
+			if _, err := w.Write(out); err != nil {
+				_ = body.Close()
+				return err
+			}
+			flush()
+			lastWrite = time.Now()
+		}
+	}
+}
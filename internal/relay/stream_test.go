@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsEventStream(t *testing.T) {
+	cases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"text/event-stream", true},
+		{"text/event-stream; charset=utf-8", true},
+		{"application/json", false},
+		{"", false},
+	}
+
+	for _, tc := range cases {
+		if got := IsEventStream(tc.contentType); got != tc.expected {
+			t.Fatalf("content type %q: expected %v, got %v", tc.contentType, tc.expected, got)
+		}
+	}
+}
+
+// flushRecorder counts flushes so we can check events are not buffered.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func TestStreamEventsFlushesEachEvent(t *testing.T) {
+	body := "data: {\"a\":1}\n\ndata: {\"a\":2}\n\ndata: [DONE]\n\n"
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	client := NewProxyClient()
+
+	err := client.streamEvents(context.Background(), rec, io.NopCloser(strings.NewReader(body)), nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Body.String() != body {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+	// One initial flush for headers plus one per event.
+	if rec.flushes != 4 {
+		t.Fatalf("expected 4 flushes, got %d", rec.flushes)
+	}
+}
+
+func TestStreamEventsHidesUsageChunk(t *testing.T) {
+	content := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	usage := "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":1}}\n\n"
+	body := content + usage + "data: [DONE]\n\n"
+	for _, hide := range []bool{false, true} {
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		tracker := &usageTracker{}
+		err := NewProxyClient().streamEvents(context.Background(), rec, io.NopCloser(strings.NewReader(body)), tracker, nil, hide)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := body
+		if hide {
+			want = content + "data: [DONE]\n\n"
+		}
+		if rec.Body.String() != want {
+			t.Fatalf("hide %v: unexpected body %q", hide, rec.Body.String())
+		}
+		if tracker.usage.PromptTokens != 3 || tracker.usage.CompletionTokens != 1 {
+			t.Fatalf("hide %v: usage not recorded, got %+v", hide, tracker.usage)
+		}
+	}
+}
+
+func TestReadSSEEventsBufferSizedLine(t *testing.T) {
+	// A data line exactly as long as the read buffer ends in a lone "\n"
+	// fragment, which must not be taken for the blank line ending the event.
+	long := "data: " + strings.Repeat("x", 64<<10-len("data: "))
+	body := long + "\n\ndata: [DONE]\n\n"
+	out := make(chan sseReadResult)
+	go readSSEEvents(strings.NewReader(body), out, make(chan struct{}))
+
+	var events []string
+	for res := range out {
+		if res.err != nil {
+			t.Fatalf("unexpected error: %v", res.err)
+		}
+		events = append(events, string(res.event))
+	}
+	if len(events) != 2 || events[0] != long+"\n\n" || events[1] != "data: [DONE]\n\n" {
+		t.Fatalf("unexpected events: %d, first %d bytes", len(events), len(events[0]))
+	}
+}
+
+func TestReadSSEEventsLimitsLinesNotEvents(t *testing.T) {
+	read := func(body string) ([]string, error) {
+		out := make(chan sseReadResult)
+		go readSSEEvents(strings.NewReader(body), out, make(chan struct{}))
+		var events []string
+		for res := range out {
+			if res.err != nil {
+				return events, res.err
+			}
+			events = append(events, string(res.event))
+		}
+		return events, nil
+	}
+
+	// Several lines that together exceed the line limit form a valid event.
+	line := "data: " + strings.Repeat("x", 1<<20) + "\n"
+	event := strings.Repeat(line, maxSSELineSize/len(line)+1) + "\n"
+	if events, err := read(event); err != nil || len(events) != 1 {
+		t.Fatalf("expected one multi-line event, got %d events, err %v", len(events), err)
+	}
+
+	long := "data: " + strings.Repeat("x", maxSSELineSize) + "\n\n"
+	if _, err := read(long); err == nil || !strings.Contains(err.Error(), "line too long") {
+		t.Fatalf("expected a line too long error, got %v", err)
+	}
+}
+
+func TestStreamEventsIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	client := &ProxyClient{StreamIdleTimeout: 20 * time.Millisecond}
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	err := client.streamEvents(context.Background(), rec, pr, nil, nil, false)
+	if !errors.Is(err, ErrStreamIdleTimeout) {
+		t.Fatalf("expected idle timeout, got %v", err)
+	}
+}
+
+func TestStreamEventsStopsOnClientCancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &ProxyClient{}
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	go func() {
+		_, _ = pw.Write([]byte("data: hello\n\n"))
+		cancel()
+	}()
+
+	err := client.streamEvents(ctx, rec, pr, nil, nil, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancellation, got %v", err)
+	}
+}
+
+func TestProxyRequestRelaysEventStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("event: ping\ndata: {}\n\n"))
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	res, err := NewProxyClient().ProxyRequest(rec, req, http.MethodPost, upstream.URL, "key", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || !res.Stream {
+		t.Fatalf("expected streamed 200, got %+v", res)
+	}
+	if got := rec.Header().Get("X-Accel-Buffering"); got != "no" {
+		t.Fatalf("expected X-Accel-Buffering header, got %q", got)
+	}
+	if rec.Body.String() != "event: ping\ndata: {}\n\n" {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+}
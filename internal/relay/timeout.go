@@ -0,0 +1,110 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultConnectTimeout bounds connection setup for channels that do not set
+// their own connect timeout.
+const DefaultConnectTimeout = 10 * time.Second
+
+var (
+	// ErrHeaderTimeout is returned when upstream accepted the request but
+	// sent no response headers within the header timeout.
+	ErrHeaderTimeout = errors.New("upstream response header timeout")
+	// ErrReadIdleTimeout is returned when the upstream body stays silent
+	// for longer than the per-channel idle timeout.
+	ErrReadIdleTimeout = errors.New("upstream read idle timeout")
+)
+
+// Timeouts bounds one upstream request. A zero field keeps the client
+// default: DefaultConnectTimeout for Connect, no limit for Header, and the
+// client's StreamIdleTimeout for event streams.
+type Timeouts struct {
+	// Connect bounds dialing the upstream.
+	Connect time.Duration
+	// Header bounds the wait for response headers once the request is sent.
+	Header time.Duration
+	// Idle bounds the silence between two reads of the response body,
+	// buffered or streamed.
+	Idle time.Duration
+}
+
+// IsTimeout reports whether err was caused by an upstream timeout rather than
+// by the client or a plain failure.
+func IsTimeout(err error) bool {
+	if errors.Is(err, ErrHeaderTimeout) || errors.Is(err, ErrReadIdleTimeout) ||
+		errors.Is(err, ErrStreamIdleTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type connectTimeoutKey struct{}
+
+// newTransport returns a transport whose dialer takes its timeout from the
+// request context, so one connection pool serves channels with different
+// connect timeouts.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		timeout, _ := ctx.Value(connectTimeoutKey{}).(time.Duration)
+		if timeout <= 0 {
+			timeout = DefaultConnectTimeout
+		}
+		dialer := net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return transport
+}
+
+// upstreamBody ties an upstream response body to the request context: closing
+// it releases the context, and with an idle timeout set, a read that waits
+// longer than that aborts the request with ErrReadIdleTimeout.
+type upstreamBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   time.Duration
+	timer  *time.Timer
+	once   sync.Once
+}
+
+func newUpstreamBody(body io.ReadCloser, ctx context.Context, cancel context.CancelCauseFunc, idle time.Duration) *upstreamBody {
+	b := &upstreamBody{ReadCloser: body, ctx: ctx, cancel: cancel, idle: idle}
+	if idle > 0 {
+		b.timer = time.AfterFunc(idle, func() { cancel(ErrReadIdleTimeout) })
+	}
+	return b
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		if cause := context.Cause(b.ctx); cause != nil && cause != context.Canceled {
+			err = cause
+		}
+	}
+	if b.timer != nil && err == nil {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		b.cancel(nil)
+	})
+	return err
+}
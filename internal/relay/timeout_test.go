@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendUpstreamHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	client := NewProxyClient()
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	_, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL, Timeouts: Timeouts{Header: 20 * time.Millisecond}})
+	if !errors.Is(err, ErrHeaderTimeout) || !IsTimeout(err) {
+		t.Fatalf("expected header timeout, got %v", err)
+	}
+}
+
+func TestSendUpstreamReadIdleTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"partial":`)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	client := NewProxyClient()
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	resp, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL, Timeouts: Timeouts{Idle: 20 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	_, err = client.Relay(httptest.NewRecorder(), origReq, resp)
+	if !errors.Is(err, ErrReadIdleTimeout) || !IsTimeout(err) {
+		t.Fatalf("expected read idle timeout, got %v", err)
+	}
+}
+
+func TestSendUpstreamFollowsClientCancellation(t *testing.T) {
+	upstreamGone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: {}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(upstreamGone)
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+	client := NewProxyClient()
+	resp, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = client.Relay(&flushRecorder{ResponseRecorder: httptest.NewRecorder()}, origReq, resp)
+	if !errors.Is(err, context.Canceled) || IsTimeout(err) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	select {
+	case <-upstreamGone:
+	case <-time.After(time.Second):
+		t.Fatalf("upstream request was not cancelled")
+	}
+}
+
+func TestPeekBodyKeepsUpstreamBody(t *testing.T) {
+	body := `{"error":{"message":"quota"}}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	client := NewProxyClient()
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	resp, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL, Timeouts: Timeouts{Idle: time.Second}})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if head := PeekBody(resp, 8); string(head) != body[:8] {
+		t.Fatalf("unexpected peek %q", head)
+	}
+	if _, ok := resp.Body.(*upstreamBody); !ok {
+		t.Fatalf("peek replaced the upstream body with %T", resp.Body)
+	}
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != body {
+		t.Fatalf("body not restored, got %q", rest)
+	}
+}
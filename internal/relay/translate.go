@@ -0,0 +1,369 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInvalidRequest wraps request bodies that cannot be translated to the
+// upstream protocol; callers report them as client errors.
+var ErrInvalidRequest = errors.New("invalid request body")
+
+// Translator converts a successful upstream response back to the protocol the
+// client spoke. One Translator serves exactly one response.
+type Translator interface {
+	// Response converts a complete, non-stream response body.
+	Response(body []byte) ([]byte, error)
+	// StreamEvent converts one upstream SSE event. It may return nil when the
+	// event has no counterpart for the client.
+	StreamEvent(event []byte) []byte
+	// StreamEnd returns the events that close the client stream once upstream
+	// has finished.
+	StreamEnd() []byte
+	// Error renders an upstream or translation error in the client's error
+	// shape, returning the status to send with it.
+	Error(status int, message string) (int, []byte)
+}
+
+// openAIChatRequest is the subset of an OpenAI chat completions request the
+// translators understand.
+type openAIChatRequest struct {
+	Messages            []openAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens"`
+	Temperature         *float64        `json:"temperature"`
+	TopP                *float64        `json:"top_p"`
+	N                   *int            `json:"n"`
+	Stop                json.RawMessage `json:"stop"`
+	Stream              bool            `json:"stream"`
+	Tools               []openAITool    `json:"tools"`
+	ToolChoice          json.RawMessage `json:"tool_choice"`
+	ParallelToolCalls   *bool           `json:"parallel_tool_calls"`
+	ResponseFormat      *struct {
+		Type string `json:"type"`
+	} `json:"response_format"`
+	User string `json:"user"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls"`
+	ToolCallID string           `json:"tool_call_id"`
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+func parseOpenAIChat(body []byte) (*openAIChatRequest, error) {
+	var req openAIChatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("%w: messages is required", ErrInvalidRequest)
+	}
+	return &req, nil
+}
+
+// maxTokens returns the requested output limit, preferring the newer
+// max_completion_tokens.
+func (r *openAIChatRequest) maxTokens() int {
+	if r.MaxCompletionTokens != nil {
+		return *r.MaxCompletionTokens
+	}
+	if r.MaxTokens != nil {
+		return *r.MaxTokens
+	}
+	return 0
+}
+
+// stopSequences accepts "stop" as either a string or a list.
+func (r *openAIChatRequest) stopSequences() []string {
+	if len(r.Stop) == 0 {
+		return nil
+	}
+	var one string
+	if err := json.Unmarshal(r.Stop, &one); err == nil {
+		if one == "" {
+			return nil
+		}
+		return []string{one}
+	}
+	var many []string
+	_ = json.Unmarshal(r.Stop, &many)
+	return many
+}
+
+// toolChoice decodes tool_choice into a mode ("auto", "none", "required") and,
+// for a forced function, its name.
+func (r *openAIChatRequest) toolChoice() (mode, name string) {
+	if len(r.ToolChoice) == 0 {
+		return "", ""
+	}
+	if err := json.Unmarshal(r.ToolChoice, &mode); err == nil {
+		return mode, ""
+	}
+	var forced struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(r.ToolChoice, &forced); err == nil && forced.Function.Name != "" {
+		return "function", forced.Function.Name
+	}
+	return "", ""
+}
+
+// contentParts normalises message content, which may be null, a string or a
+// list of typed parts.
+func (m *openAIMessage) contentParts() ([]openAIContentPart, error) {
+	if len(m.Content) == 0 || string(m.Content) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(m.Content, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []openAIContentPart{{Type: "text", Text: text}}, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return nil, fmt.Errorf("%w: invalid content of %s message", ErrInvalidRequest, m.Role)
+	}
+	return parts, nil
+}
+
+// contentText joins the text parts of a message.
+func (m *openAIMessage) contentText() (string, error) {
+	parts, err := m.contentParts()
+	if err != nil {
+		return "", err
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" && p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// toolArguments returns the arguments of a tool call as a JSON object.
+func toolArguments(call openAIToolCall) (json.RawMessage, error) {
+	args := strings.TrimSpace(call.Function.Arguments)
+	if args == "" {
+		return json.RawMessage("{}"), nil
+	}
+	if !json.Valid([]byte(args)) {
+		return nil, fmt.Errorf("%w: invalid arguments for tool call %s", ErrInvalidRequest, call.ID)
+	}
+	return json.RawMessage(args), nil
+}
+
+// parseDataURL splits a base64 data URL into its media type and payload.
+func parseDataURL(url string) (mediaType, data string, ok bool) {
+	rest, found := strings.CutPrefix(url, "data:")
+	if !found {
+		return "", "", false
+	}
+	meta, data, found := strings.Cut(rest, ",")
+	if !found {
+		return "", "", false
+	}
+	mediaType, found = strings.CutSuffix(meta, ";base64")
+	if !found || mediaType == "" {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
+
+// openAIChatCompletion is a non-stream OpenAI chat completion.
+type openAIChatCompletion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []openAIChatChoice `json:"choices"`
+	Usage   *openAIUsage       `json:"usage,omitempty"`
+}
+
+type openAIChatChoice struct {
+	Index        int               `json:"index"`
+	Message      openAIChatMessage `json:"message"`
+	FinishReason string            `json:"finish_reason"`
+}
+
+type openAIChatMessage struct {
+	Role      string           `json:"role"`
+	Content   *string          `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+func newOpenAIUsage(u Usage) *openAIUsage {
+	out := &openAIUsage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens(),
+	}
+	out.PromptTokensDetails.CachedTokens = u.CachedTokens
+	return out
+}
+
+// openAIChunk is one event of a streamed OpenAI chat completion.
+type openAIChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []openAIChunkChoice `json:"choices"`
+	Usage   *openAIUsage        `json:"usage,omitempty"`
+}
+
+type openAIChunkChoice struct {
+	Index        int              `json:"index"`
+	Delta        openAIChunkDelta `json:"delta"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+type openAIChunkDelta struct {
+	Role      string                `json:"role,omitempty"`
+	Content   *string               `json:"content,omitempty"`
+	ToolCalls []openAIToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+type openAIToolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// chatStream holds what every translated chat stream needs to frame its
+// chunks.
+type chatStream struct {
+	id      string
+	model   string
+	created int64
+	usage   Usage
+	// includeUsage sends the trailing usage chunk, for clients that asked
+	// for stream_options.include_usage.
+	includeUsage bool
+	// failed is set once an upstream error event ended the stream.
+	failed bool
+}
+
+func newChatStream(model string, includeUsage bool) chatStream {
+	return chatStream{id: "chatcmpl-" + randomID(), model: model, created: time.Now().Unix(), includeUsage: includeUsage}
+}
+
+// chunk frames a single-choice delta as an SSE event.
+func (s *chatStream) chunk(delta openAIChunkDelta, finishReason string) []byte {
+	choice := openAIChunkChoice{Delta: delta}
+	if finishReason != "" {
+		choice.FinishReason = &finishReason
+	}
+	return s.event(openAIChunk{
+		ID: s.id, Object: "chat.completion.chunk", Created: s.created, Model: s.model,
+		Choices: []openAIChunkChoice{choice},
+	})
+}
+
+// end returns the trailing usage chunk, when the client asked for it with
+// stream_options.include_usage, followed by the [DONE] marker.
+func (s *chatStream) end() []byte {
+	if s.failed {
+		return nil
+	}
+	if !s.includeUsage {
+		return []byte("data: [DONE]\n\n")
+	}
+	usageChunk := s.event(openAIChunk{
+		ID: s.id, Object: "chat.completion.chunk", Created: s.created, Model: s.model,
+		Choices: []openAIChunkChoice{}, Usage: newOpenAIUsage(s.usage),
+	})
+	return append(usageChunk, "data: [DONE]\n\n"...)
+}
+
+// fail renders an upstream error event as an OpenAI error event and ends the
+// stream: later events and the closing chunks are dropped.
+func (s *chatStream) fail(message string) []byte {
+	s.failed = true
+	_, body := ErrorBody(FormatOpenAI, http.StatusBadGateway, "", message)
+	return sseData(body)
+}
+
+// Error renders errors in OpenAI's shape for chat completions clients.
+func (s *chatStream) Error(status int, message string) (int, []byte) {
+	return ErrorBody(FormatOpenAI, status, "", message)
+}
+
+func (s *chatStream) event(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return sseData(data)
+}
+
+func sseData(data []byte) []byte {
+	out := make([]byte, 0, len(data)+8)
+	out = append(out, "data: "...)
+	out = append(out, data...)
+	return append(out, "\n\n"...)
+}
+
+// stringPtr returns a pointer to s.
+func stringPtr(s string) *string {
+	return &s
+}
+
+// randomID returns 24 random hex characters for ids the upstream did not
+// provide.
+func randomID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
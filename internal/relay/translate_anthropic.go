@@ -0,0 +1,361 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultAnthropicMaxTokens is used when an OpenAI request leaves the output
+// limit open; Anthropic requires one.
+const defaultAnthropicMaxTokens = 4096
+
+type anthropicRequest struct {
+	Model         string               `json:"model"`
+	System        string               `json:"system,omitempty"`
+	Messages      []anthropicMessage   `json:"messages"`
+	MaxTokens     int                  `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Tools         []anthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *anthropicToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *anthropicMetadata   `json:"metadata,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Source    *anthropicSource `json:"source,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   string           `json:"content,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type anthropicMetadata struct {
+	UserID string `json:"user_id"`
+}
+
+// OpenAIChatToAnthropic converts an OpenAI chat completions request into an
+// Anthropic Messages request for model. System and developer messages become
+// the system prompt, tool calls and results become tool_use and tool_result
+// blocks, and consecutive turns of the same role are merged as Anthropic
+// requires. It also reports whether the client asked for a stream.
+func OpenAIChatToAnthropic(body []byte, model string) ([]byte, bool, error) {
+	in, err := parseOpenAIChat(body)
+	if err != nil {
+		return nil, false, err
+	}
+	if in.N != nil && *in.N > 1 {
+		return nil, false, fmt.Errorf("%w: n > 1 is not supported by this model", ErrInvalidRequest)
+	}
+	out := anthropicRequest{
+		Model:         model,
+		MaxTokens:     in.maxTokens(),
+		Temperature:   in.Temperature,
+		TopP:          in.TopP,
+		StopSequences: in.stopSequences(),
+		Stream:        in.Stream,
+	}
+	if out.MaxTokens <= 0 {
+		out.MaxTokens = defaultAnthropicMaxTokens
+	}
+	if in.User != "" {
+		out.Metadata = &anthropicMetadata{UserID: in.User}
+	}
+
+	var system []string
+	for i := range in.Messages {
+		msg := &in.Messages[i]
+		switch msg.Role {
+		case "system", "developer":
+			text, err := msg.contentText()
+			if err != nil {
+				return nil, false, err
+			}
+			if text != "" {
+				system = append(system, text)
+			}
+		case "user":
+			blocks, err := anthropicContentBlocks(msg)
+			if err != nil {
+				return nil, false, err
+			}
+			out.Messages = appendAnthropicTurn(out.Messages, "user", blocks)
+		case "assistant":
+			blocks, err := anthropicContentBlocks(msg)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, call := range msg.ToolCalls {
+				args, err := toolArguments(call)
+				if err != nil {
+					return nil, false, err
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: args})
+			}
+			out.Messages = appendAnthropicTurn(out.Messages, "assistant", blocks)
+		case "tool":
+			text, err := msg.contentText()
+			if err != nil {
+				return nil, false, err
+			}
+			block := anthropicBlock{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: text}
+			out.Messages = appendAnthropicTurn(out.Messages, "user", []anthropicBlock{block})
+		default:
+			return nil, false, fmt.Errorf("%w: unsupported message role %q", ErrInvalidRequest, msg.Role)
+		}
+	}
+	out.System = strings.Join(system, "\n\n")
+
+	for _, t := range in.Tools {
+		if t.Type != "" && t.Type != "function" {
+			continue
+		}
+		schema := t.Function.Parameters
+		if len(schema) == 0 || string(schema) == "null" {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		out.Tools = append(out.Tools, anthropicTool{Name: t.Function.Name, Description: t.Function.Description, InputSchema: schema})
+	}
+	if len(out.Tools) > 0 {
+		mode, name := in.toolChoice()
+		switch mode {
+		case "none":
+			out.ToolChoice = &anthropicToolChoice{Type: "none"}
+		case "required":
+			out.ToolChoice = &anthropicToolChoice{Type: "any"}
+		case "function":
+			out.ToolChoice = &anthropicToolChoice{Type: "tool", Name: name}
+		case "auto":
+			out.ToolChoice = &anthropicToolChoice{Type: "auto"}
+		}
+		if in.ParallelToolCalls != nil && !*in.ParallelToolCalls {
+			if out.ToolChoice == nil {
+				out.ToolChoice = &anthropicToolChoice{Type: "auto"}
+			}
+			if out.ToolChoice.Type != "none" {
+				out.ToolChoice.DisableParallelToolUse = true
+			}
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, in.Stream, nil
+}
+
+// anthropicContentBlocks converts the text and image parts of a message.
+func anthropicContentBlocks(msg *openAIMessage) ([]anthropicBlock, error) {
+	parts, err := msg.contentParts()
+	if err != nil {
+		return nil, err
+	}
+	var blocks []anthropicBlock
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			if p.Text != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: p.Text})
+			}
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return nil, fmt.Errorf("%w: image_url part without url", ErrInvalidRequest)
+			}
+			source := &anthropicSource{Type: "url", URL: p.ImageURL.URL}
+			if mediaType, data, ok := parseDataURL(p.ImageURL.URL); ok {
+				source = &anthropicSource{Type: "base64", MediaType: mediaType, Data: data}
+			}
+			blocks = append(blocks, anthropicBlock{Type: "image", Source: source})
+		default:
+			return nil, fmt.Errorf("%w: unsupported content part %q", ErrInvalidRequest, p.Type)
+		}
+	}
+	return blocks, nil
+}
+
+// appendAnthropicTurn adds blocks as a turn of role, merging them into the
+// previous turn when it has the same role.
+func appendAnthropicTurn(turns []anthropicMessage, role string, blocks []anthropicBlock) []anthropicMessage {
+	if len(blocks) == 0 {
+		return turns
+	}
+	if n := len(turns); n > 0 && turns[n-1].Role == role {
+		turns[n-1].Content = append(turns[n-1].Content, blocks...)
+		return turns
+	}
+	return append(turns, anthropicMessage{Role: role, Content: blocks})
+}
+
+type anthropicResponse struct {
+	ID      string `json:"id"`
+	Content []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      *providerUsage `json:"usage"`
+}
+
+// anthropicFinishReason maps an Anthropic stop_reason to OpenAI's
+// finish_reason.
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// anthropicChatTranslator turns Anthropic Messages responses into OpenAI chat
+// completions.
+type anthropicChatTranslator struct {
+	chatStream
+	// toolIndex maps content block indexes of tool_use blocks to their
+	// position in the OpenAI tool_calls list.
+	toolIndex map[int]int
+}
+
+// NewAnthropicChatTranslator returns a Translator from Anthropic Messages
+// responses to OpenAI chat completions reporting model. includeUsage ends
+// streams with a usage chunk, as stream_options.include_usage asks.
+func NewAnthropicChatTranslator(model string, includeUsage bool) Translator {
+	return &anthropicChatTranslator{chatStream: newChatStream(model, includeUsage), toolIndex: map[int]int{}}
+}
+
+func (t *anthropicChatTranslator) Response(body []byte) ([]byte, error) {
+	var in anthropicResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	msg := openAIChatMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, block := range in.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			call := openAIToolCall{ID: block.ID, Type: "function"}
+			call.Function.Name = block.Name
+			call.Function.Arguments = string(block.Input)
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		}
+	}
+	if text.Len() > 0 || len(msg.ToolCalls) == 0 {
+		msg.Content = stringPtr(text.String())
+	}
+	out := openAIChatCompletion{
+		ID:      "chatcmpl-" + strings.TrimPrefix(in.ID, "msg_"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   t.model,
+		Choices: []openAIChatChoice{{Message: msg, FinishReason: anthropicFinishReason(in.StopReason)}},
+		Usage:   newOpenAIUsage(in.Usage.normalise()),
+	}
+	return json.Marshal(out)
+}
+
+func (t *anthropicChatTranslator) StreamEvent(event []byte) []byte {
+	data := sseEventData(event)
+	if len(data) == 0 {
+		return nil
+	}
+	var ev struct {
+		Type         string `json:"type"`
+		Index        int    `json:"index"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+		Error json.RawMessage `json:"error"`
+	}
+	if t.failed || json.Unmarshal(data, &ev) != nil {
+		return nil
+	}
+	if u, ok := ParseUsage(data); ok {
+		t.usage.merge(u)
+	}
+
+	switch ev.Type {
+	case "message_start":
+		return t.chunk(openAIChunkDelta{Role: "assistant", Content: stringPtr("")}, "")
+	case "content_block_start":
+		if ev.ContentBlock.Type != "tool_use" {
+			return nil
+		}
+		idx := len(t.toolIndex)
+		t.toolIndex[ev.Index] = idx
+		call := openAIToolCallDelta{Index: idx, ID: ev.ContentBlock.ID, Type: "function"}
+		call.Function.Name = ev.ContentBlock.Name
+		return t.chunk(openAIChunkDelta{ToolCalls: []openAIToolCallDelta{call}}, "")
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			return t.chunk(openAIChunkDelta{Content: stringPtr(ev.Delta.Text)}, "")
+		case "input_json_delta":
+			idx, ok := t.toolIndex[ev.Index]
+			if !ok {
+				return nil
+			}
+			call := openAIToolCallDelta{Index: idx}
+			call.Function.Arguments = ev.Delta.PartialJSON
+			return t.chunk(openAIChunkDelta{ToolCalls: []openAIToolCallDelta{call}}, "")
+		}
+	case "message_delta":
+		if ev.Delta.StopReason != "" {
+			return t.chunk(openAIChunkDelta{}, anthropicFinishReason(ev.Delta.StopReason))
+		}
+	case "error":
+		return t.fail(UpstreamErrorMessage(data))
+	}
+	return nil
+}
+
+func (t *anthropicChatTranslator) StreamEnd() []byte {
+	return t.end()
+}
@@ -0,0 +1,446 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type geminiRequest struct {
+	Contents          []geminiContent         `json:"contents"`
+	SystemInstruction *geminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *geminiGenerationConfig `json:"generationConfig,omitempty"`
+	Tools             []geminiTool            `json:"tools,omitempty"`
+	ToolConfig        *geminiToolConfig       `json:"toolConfig,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *geminiBlob             `json:"inlineData,omitempty"`
+	FileData         *geminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type geminiFunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type geminiFunctionResponse struct {
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
+type geminiGenerationConfig struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"topP,omitempty"`
+	MaxOutputTokens  int      `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	CandidateCount   int      `json:"candidateCount,omitempty"`
+	ResponseMimeType string   `json:"responseMimeType,omitempty"`
+}
+
+type geminiTool struct {
+	FunctionDeclarations []geminiFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type geminiFunctionDeclaration struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type geminiToolConfig struct {
+	FunctionCallingConfig struct {
+		Mode                 string   `json:"mode"`
+		AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+	} `json:"functionCallingConfig"`
+}
+
+// OpenAIChatToGemini converts an OpenAI chat completions request into a Gemini
+// generateContent request. System and developer messages become the system
+// instruction, tool calls and results become functionCall and
+// functionResponse parts, and images become inline or file data. It also
+// reports whether the client asked for a stream, which Gemini selects by
+// method rather than in the body.
+func OpenAIChatToGemini(body []byte) ([]byte, bool, error) {
+	in, err := parseOpenAIChat(body)
+	if err != nil {
+		return nil, false, err
+	}
+	var out geminiRequest
+
+	// functionResponse parts are matched by name, which OpenAI only carries
+	// on the assistant's tool call.
+	toolNames := map[string]string{}
+	var system []geminiPart
+	for i := range in.Messages {
+		msg := &in.Messages[i]
+		switch msg.Role {
+		case "system", "developer":
+			text, err := msg.contentText()
+			if err != nil {
+				return nil, false, err
+			}
+			if text != "" {
+				system = append(system, geminiPart{Text: text})
+			}
+		case "user":
+			parts, err := geminiContentParts(msg)
+			if err != nil {
+				return nil, false, err
+			}
+			out.Contents = appendGeminiTurn(out.Contents, "user", parts)
+		case "assistant":
+			parts, err := geminiContentParts(msg)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, call := range msg.ToolCalls {
+				args, err := toolArguments(call)
+				if err != nil {
+					return nil, false, err
+				}
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, geminiPart{FunctionCall: &geminiFunctionCall{Name: call.Function.Name, Args: args}})
+			}
+			out.Contents = appendGeminiTurn(out.Contents, "model", parts)
+		case "tool":
+			text, err := msg.contentText()
+			if err != nil {
+				return nil, false, err
+			}
+			name, ok := toolNames[msg.ToolCallID]
+			if !ok {
+				return nil, false, fmt.Errorf("%w: tool message for unknown tool call %q", ErrInvalidRequest, msg.ToolCallID)
+			}
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{Name: name, Response: geminiToolResponse(text)}}
+			out.Contents = appendGeminiTurn(out.Contents, "user", []geminiPart{part})
+		default:
+			return nil, false, fmt.Errorf("%w: unsupported message role %q", ErrInvalidRequest, msg.Role)
+		}
+	}
+	if len(system) > 0 {
+		out.SystemInstruction = &geminiContent{Parts: system}
+	}
+
+	cfg := geminiGenerationConfig{
+		Temperature:     in.Temperature,
+		TopP:            in.TopP,
+		MaxOutputTokens: in.maxTokens(),
+		StopSequences:   in.stopSequences(),
+	}
+	if in.N != nil && *in.N > 1 {
+		cfg.CandidateCount = *in.N
+	}
+	if in.ResponseFormat != nil && (in.ResponseFormat.Type == "json_object" || in.ResponseFormat.Type == "json_schema") {
+		cfg.ResponseMimeType = "application/json"
+	}
+	if cfg.Temperature != nil || cfg.TopP != nil || cfg.MaxOutputTokens > 0 || len(cfg.StopSequences) > 0 ||
+		cfg.CandidateCount > 0 || cfg.ResponseMimeType != "" {
+		out.GenerationConfig = &cfg
+	}
+
+	var decls []geminiFunctionDeclaration
+	for _, t := range in.Tools {
+		if t.Type != "" && t.Type != "function" {
+			continue
+		}
+		decls = append(decls, geminiFunctionDeclaration{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			Parameters:  sanitizeGeminiSchema(t.Function.Parameters),
+		})
+	}
+	if len(decls) > 0 {
+		out.Tools = []geminiTool{{FunctionDeclarations: decls}}
+		mode, name := in.toolChoice()
+		var tc geminiToolConfig
+		switch mode {
+		case "none":
+			tc.FunctionCallingConfig.Mode = "NONE"
+		case "required":
+			tc.FunctionCallingConfig.Mode = "ANY"
+		case "function":
+			tc.FunctionCallingConfig.Mode = "ANY"
+			tc.FunctionCallingConfig.AllowedFunctionNames = []string{name}
+		case "auto":
+			tc.FunctionCallingConfig.Mode = "AUTO"
+		}
+		if tc.FunctionCallingConfig.Mode != "" {
+			out.ToolConfig = &tc
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, in.Stream, nil
+}
+
+// geminiContentParts converts the text and image parts of a message. Data
+// URLs are sent inline; other URLs are passed as file references.
+func geminiContentParts(msg *openAIMessage) ([]geminiPart, error) {
+	parts, err := msg.contentParts()
+	if err != nil {
+		return nil, err
+	}
+	var out []geminiPart
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			if p.Text != "" {
+				out = append(out, geminiPart{Text: p.Text})
+			}
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return nil, fmt.Errorf("%w: image_url part without url", ErrInvalidRequest)
+			}
+			if mediaType, data, ok := parseDataURL(p.ImageURL.URL); ok {
+				out = append(out, geminiPart{InlineData: &geminiBlob{MimeType: mediaType, Data: data}})
+			} else {
+				out = append(out, geminiPart{FileData: &geminiFileData{FileURI: p.ImageURL.URL}})
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported content part %q", ErrInvalidRequest, p.Type)
+		}
+	}
+	return out, nil
+}
+
+// appendGeminiTurn adds parts as a turn of role, merging them into the
+// previous turn when it has the same role.
+func appendGeminiTurn(turns []geminiContent, role string, parts []geminiPart) []geminiContent {
+	if len(parts) == 0 {
+		return turns
+	}
+	if n := len(turns); n > 0 && turns[n-1].Role == role {
+		turns[n-1].Parts = append(turns[n-1].Parts, parts...)
+		return turns
+	}
+	return append(turns, geminiContent{Role: role, Parts: parts})
+}
+
+// geminiToolResponse wraps a tool result as the object Gemini expects. JSON
+// object results are passed as they are.
+func geminiToolResponse(text string) json.RawMessage {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+		return json.RawMessage(trimmed)
+	}
+	wrapped, _ := json.Marshal(map[string]string{"content": text})
+	return wrapped
+}
+
+// geminiUnsupportedSchemaKeys are JSON Schema keywords Gemini rejects in
+// function parameters.
+var geminiUnsupportedSchemaKeys = []string{"$schema", "$id", "additionalProperties", "strict"}
+
+// sanitizeGeminiSchema drops the schema keywords Gemini does not accept, at
+// any depth.
+func sanitizeGeminiSchema(schema json.RawMessage) json.RawMessage {
+	if len(schema) == 0 || string(schema) == "null" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(schema, &v); err != nil {
+		return schema
+	}
+	out, err := json.Marshal(stripSchemaKeys(v))
+	if err != nil {
+		return schema
+	}
+	return out
+}
+
+func stripSchemaKeys(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, k := range geminiUnsupportedSchemaKeys {
+			delete(val, k)
+		}
+		for k, child := range val {
+			val[k] = stripSchemaKeys(child)
+		}
+		return val
+	case []interface{}:
+		for i, child := range val {
+			val[i] = stripSchemaKeys(child)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+type geminiResponse struct {
+	ResponseID string `json:"responseId"`
+	Candidates []struct {
+		Index        int           `json:"index"`
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	Error json.RawMessage `json:"error"`
+}
+
+// geminiFinishReason maps a Gemini finishReason to OpenAI's finish_reason.
+func geminiFinishReason(reason string, toolCalls bool) string {
+	switch reason {
+	case "":
+		return ""
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if toolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// geminiCandidateMessage splits candidate parts into text and tool calls.
+// Thought summaries are not part of the answer and are left out.
+func geminiCandidateMessage(content geminiContent) (string, []openAIToolCall) {
+	var text strings.Builder
+	var calls []openAIToolCall
+	for _, p := range content.Parts {
+		switch {
+		case p.Thought:
+		case p.FunctionCall != nil:
+			call := openAIToolCall{ID: "call_" + randomID(), Type: "function"}
+			call.Function.Name = p.FunctionCall.Name
+			call.Function.Arguments = string(p.FunctionCall.Args)
+			if call.Function.Arguments == "" {
+				call.Function.Arguments = "{}"
+			}
+			calls = append(calls, call)
+		default:
+			text.WriteString(p.Text)
+		}
+	}
+	return text.String(), calls
+}
+
+// geminiChatTranslator turns Gemini generateContent responses into OpenAI
+// chat completions. Gemini has no tool call ids, so fresh ones are made up.
+type geminiChatTranslator struct {
+	chatStream
+	started   map[int]bool
+	toolCalls map[int]int
+}
+
+// NewGeminiChatTranslator returns a Translator from Gemini generateContent
+// responses to OpenAI chat completions reporting model. includeUsage ends
+// streams with a usage chunk, as stream_options.include_usage asks.
+func NewGeminiChatTranslator(model string, includeUsage bool) Translator {
+	return &geminiChatTranslator{chatStream: newChatStream(model, includeUsage), started: map[int]bool{}, toolCalls: map[int]int{}}
+}
+
+func (t *geminiChatTranslator) Response(body []byte) ([]byte, error) {
+	var in geminiResponse
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	out := openAIChatCompletion{
+		ID:      t.id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   t.model,
+		Choices: []openAIChatChoice{},
+	}
+	if in.ResponseID != "" {
+		out.ID = "chatcmpl-" + in.ResponseID
+	}
+	for _, cand := range in.Candidates {
+		text, calls := geminiCandidateMessage(cand.Content)
+		msg := openAIChatMessage{Role: "assistant", ToolCalls: calls}
+		if text != "" || len(calls) == 0 {
+			msg.Content = stringPtr(text)
+		}
+		finish := geminiFinishReason(cand.FinishReason, len(calls) > 0)
+		if finish == "" {
+			finish = "stop"
+		}
+		out.Choices = append(out.Choices, openAIChatChoice{Index: cand.Index, Message: msg, FinishReason: finish})
+	}
+	if u, ok := ParseUsage(body); ok {
+		out.Usage = newOpenAIUsage(u)
+	} else {
+		out.Usage = newOpenAIUsage(Usage{})
+	}
+	return json.Marshal(out)
+}
+
+func (t *geminiChatTranslator) StreamEvent(event []byte) []byte {
+	data := sseEventData(event)
+	if len(data) == 0 {
+		return nil
+	}
+	var in geminiResponse
+	if t.failed || json.Unmarshal(data, &in) != nil {
+		return nil
+	}
+	if len(in.Error) > 0 {
+		return t.fail(UpstreamErrorMessage(data))
+	}
+	if u, ok := ParseUsage(data); ok {
+		t.usage.merge(u)
+	}
+
+	var out []byte
+	for _, cand := range in.Candidates {
+		delta := openAIChunkDelta{}
+		if !t.started[cand.Index] {
+			t.started[cand.Index] = true
+			delta.Role = "assistant"
+		}
+		text, calls := geminiCandidateMessage(cand.Content)
+		if text != "" || delta.Role != "" {
+			delta.Content = stringPtr(text)
+		}
+		for _, call := range calls {
+			d := openAIToolCallDelta{Index: t.toolCalls[cand.Index], ID: call.ID, Type: "function"}
+			d.Function.Name = call.Function.Name
+			d.Function.Arguments = call.Function.Arguments
+			delta.ToolCalls = append(delta.ToolCalls, d)
+			t.toolCalls[cand.Index]++
+		}
+		finish := geminiFinishReason(cand.FinishReason, t.toolCalls[cand.Index] > 0)
+		if delta.Content == nil && delta.ToolCalls == nil && finish == "" {
+			continue
+		}
+		chunk := openAIChunk{
+			ID: t.id, Object: "chat.completion.chunk", Created: t.created, Model: t.model,
+			Choices: []openAIChunkChoice{{Index: cand.Index, Delta: delta}},
+		}
+		if finish != "" {
+			chunk.Choices[0].FinishReason = &finish
+		}
+		out = append(out, t.event(chunk)...)
+	}
+	return out
+}
+
+func (t *geminiChatTranslator) StreamEnd() []byte {
+	return t.end()
+}
@@ -0,0 +1,549 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// anthropicInRequest is the subset of an Anthropic Messages request the
+// translators understand. System and message content may be plain strings or
+// lists of blocks.
+type anthropicInRequest struct {
+	System   json.RawMessage `json:"system"`
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+	MaxTokens     int      `json:"max_tokens"`
+	Temperature   *float64 `json:"temperature"`
+	TopP          *float64 `json:"top_p"`
+	StopSequences []string `json:"stop_sequences"`
+	Stream        bool     `json:"stream"`
+	Tools         []struct {
+		Type        string          `json:"type"`
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		InputSchema json.RawMessage `json:"input_schema"`
+	} `json:"tools"`
+	ToolChoice *anthropicToolChoice `json:"tool_choice"`
+	Metadata   *anthropicMetadata   `json:"metadata"`
+}
+
+type anthropicInBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text"`
+	Source    *anthropicSource `json:"source"`
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Input     json.RawMessage  `json:"input"`
+	ToolUseID string           `json:"tool_use_id"`
+	Content   json.RawMessage  `json:"content"`
+	IsError   bool             `json:"is_error"`
+}
+
+// anthropicBlocks normalises Anthropic content, which may be a string or a
+// list of blocks.
+func anthropicBlocks(raw json.RawMessage) ([]anthropicInBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil, nil
+		}
+		return []anthropicInBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []anthropicInBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, fmt.Errorf("%w: invalid content", ErrInvalidRequest)
+	}
+	return blocks, nil
+}
+
+// anthropicText joins the text blocks of Anthropic content.
+func anthropicText(raw json.RawMessage) (string, error) {
+	blocks, err := anthropicBlocks(raw)
+	if err != nil {
+		return "", err
+	}
+	var texts []string
+	for _, b := range blocks {
+		if b.Type == "text" && b.Text != "" {
+			texts = append(texts, b.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// outOpenAIMessage is an OpenAI chat message as sent upstream.
+type outOpenAIMessage struct {
+	Role       string           `json:"role"`
+	Content    interface{}      `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type outOpenAIPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type outOpenAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	} `json:"function"`
+}
+
+type outOpenAIChatRequest struct {
+	Model         string             `json:"model"`
+	Messages      []outOpenAIMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	Stop          []string           `json:"stop,omitempty"`
+	Stream        bool               `json:"stream,omitempty"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options,omitempty"`
+	Tools             []outOpenAITool `json:"tools,omitempty"`
+	ToolChoice        interface{}     `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	User              string          `json:"user,omitempty"`
+}
+
+// AnthropicToOpenAIChat converts an Anthropic Messages request into an OpenAI
+// chat completions request for model. The system prompt becomes a system
+// message, tool_use blocks become assistant tool calls and tool_result blocks
+// become tool messages. Streams ask for a trailing usage chunk. It also
+// reports whether the client asked for a stream.
+func AnthropicToOpenAIChat(body []byte, model string) ([]byte, bool, error) {
+	var in anthropicInRequest
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if len(in.Messages) == 0 {
+		return nil, false, fmt.Errorf("%w: messages is required", ErrInvalidRequest)
+	}
+	out := outOpenAIChatRequest{
+		Model:       model,
+		MaxTokens:   in.MaxTokens,
+		Temperature: in.Temperature,
+		TopP:        in.TopP,
+		Stop:        in.StopSequences,
+		Stream:      in.Stream,
+	}
+	if in.Stream {
+		out.StreamOptions = &struct {
+			IncludeUsage bool `json:"include_usage"`
+		}{IncludeUsage: true}
+	}
+	if in.Metadata != nil {
+		out.User = in.Metadata.UserID
+	}
+
+	system, err := anthropicText(in.System)
+	if err != nil {
+		return nil, false, err
+	}
+	if system != "" {
+		out.Messages = append(out.Messages, outOpenAIMessage{Role: "system", Content: system})
+	}
+
+	for _, msg := range in.Messages {
+		blocks, err := anthropicBlocks(msg.Content)
+		if err != nil {
+			return nil, false, err
+		}
+		switch msg.Role {
+		case "user":
+			// Tool results answer the previous assistant turn, so they go
+			// first as tool messages; the rest stays a user message.
+			var parts []outOpenAIPart
+			for _, b := range blocks {
+				switch b.Type {
+				case "tool_result":
+					text, err := anthropicText(b.Content)
+					if err != nil {
+						return nil, false, err
+					}
+					if b.IsError {
+						text = "Error: " + text
+					}
+					out.Messages = append(out.Messages, outOpenAIMessage{Role: "tool", Content: text, ToolCallID: b.ToolUseID})
+				default:
+					part, ok, err := openAIPartFromBlock(b)
+					if err != nil {
+						return nil, false, err
+					}
+					if ok {
+						parts = append(parts, part)
+					}
+				}
+			}
+			if len(parts) > 0 {
+				out.Messages = append(out.Messages, outOpenAIMessage{Role: "user", Content: openAIContent(parts)})
+			}
+		case "assistant":
+			m := outOpenAIMessage{Role: "assistant"}
+			var texts []string
+			for _, b := range blocks {
+				switch b.Type {
+				case "text":
+					texts = append(texts, b.Text)
+				case "tool_use":
+					call := openAIToolCall{ID: b.ID, Type: "function"}
+					call.Function.Name = b.Name
+					call.Function.Arguments = "{}"
+					var args bytes.Buffer
+					if err := json.Compact(&args, b.Input); err == nil {
+						call.Function.Arguments = args.String()
+					}
+					m.ToolCalls = append(m.ToolCalls, call)
+				}
+			}
+			if len(texts) > 0 {
+				m.Content = strings.Join(texts, "")
+			}
+			if m.Content == nil && m.ToolCalls == nil {
+				continue
+			}
+			out.Messages = append(out.Messages, m)
+		default:
+			return nil, false, fmt.Errorf("%w: unsupported message role %q", ErrInvalidRequest, msg.Role)
+		}
+	}
+
+	for _, t := range in.Tools {
+		if t.Type != "" && t.Type != "custom" {
+			return nil, false, fmt.Errorf("%w: unsupported tool type %q", ErrInvalidRequest, t.Type)
+		}
+		tool := outOpenAITool{Type: "function"}
+		tool.Function.Name = t.Name
+		tool.Function.Description = t.Description
+		tool.Function.Parameters = t.InputSchema
+		out.Tools = append(out.Tools, tool)
+	}
+	if tc := in.ToolChoice; tc != nil && len(out.Tools) > 0 {
+		switch tc.Type {
+		case "auto":
+			out.ToolChoice = "auto"
+		case "any":
+			out.ToolChoice = "required"
+		case "none":
+			out.ToolChoice = "none"
+		case "tool":
+			out.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]string{"name": tc.Name}}
+		}
+		if tc.DisableParallelToolUse {
+			parallel := false
+			out.ParallelToolCalls = &parallel
+		}
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, in.Stream, nil
+}
+
+// openAIPartFromBlock converts a user text or image block. Other blocks, such
+// as thinking, have no OpenAI counterpart and are dropped.
+func openAIPartFromBlock(b anthropicInBlock) (outOpenAIPart, bool, error) {
+	switch b.Type {
+	case "text":
+		return outOpenAIPart{Type: "text", Text: b.Text}, b.Text != "", nil
+	case "image":
+		if b.Source == nil {
+			return outOpenAIPart{}, false, fmt.Errorf("%w: image block without source", ErrInvalidRequest)
+		}
+		url := b.Source.URL
+		if b.Source.Type == "base64" {
+			url = "data:" + b.Source.MediaType + ";base64," + b.Source.Data
+		}
+		part := outOpenAIPart{Type: "image_url", ImageURL: &struct {
+			URL string `json:"url"`
+		}{URL: url}}
+		return part, true, nil
+	}
+	return outOpenAIPart{}, false, nil
+}
+
+// openAIContent sends text-only content as a plain string, which every
+// OpenAI-compatible upstream accepts.
+func openAIContent(parts []outOpenAIPart) interface{} {
+	var texts []string
+	for _, p := range parts {
+		if p.Type != "text" {
+			return parts
+		}
+		texts = append(texts, p.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// openAIStopReason maps an OpenAI finish_reason to Anthropic's stop_reason.
+func openAIStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens"`
+}
+
+// newAnthropicUsage reports u the Anthropic way, where input_tokens excludes
+// cache reads.
+func newAnthropicUsage(u Usage) anthropicUsage {
+	return anthropicUsage{
+		InputTokens:          u.PromptTokens - u.CachedTokens,
+		OutputTokens:         u.CompletionTokens,
+		CacheReadInputTokens: u.CachedTokens,
+	}
+}
+
+type anthropicOutBlock struct {
+	Type  string          `json:"type"`
+	Text  *string         `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type anthropicOutMessage struct {
+	ID           string              `json:"id"`
+	Type         string              `json:"type"`
+	Role         string              `json:"role"`
+	Model        string              `json:"model"`
+	Content      []anthropicOutBlock `json:"content"`
+	StopReason   *string             `json:"stop_reason"`
+	StopSequence *string             `json:"stop_sequence"`
+	Usage        anthropicUsage      `json:"usage"`
+}
+
+// toolInput returns tool call arguments as a JSON object, falling back to an
+// empty object for arguments the model left malformed.
+func toolInput(arguments string) json.RawMessage {
+	args := strings.TrimSpace(arguments)
+	if args == "" || !json.Valid([]byte(args)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(args)
+}
+
+// openAIMessagesTranslator turns OpenAI chat completions into Anthropic
+// Messages responses.
+type openAIMessagesTranslator struct {
+	id    string
+	model string
+	usage Usage
+
+	started    bool
+	stopReason string
+	// blocks counts content blocks opened so far; open is the index of the
+	// block still open, or -1.
+	blocks int
+	open   int
+	// toolCalls collects streamed tool calls in the order they started.
+	// OpenAI may interleave the arguments of several calls, while an
+	// Anthropic block cannot take deltas once closed, so each call is sent
+	// as one block when the stream ends.
+	toolCalls []*streamedToolCall
+	// toolIndex maps OpenAI tool call indexes to their entry in toolCalls.
+	toolIndex map[int]*streamedToolCall
+}
+
+// streamedToolCall is a tool call assembled from stream deltas.
+type streamedToolCall struct {
+	id        string
+	name      string
+	arguments strings.Builder
+}
+
+// NewOpenAIMessagesTranslator returns a Translator from OpenAI chat
+// completions to Anthropic Messages responses reporting model.
+func NewOpenAIMessagesTranslator(model string) Translator {
+	return &openAIMessagesTranslator{id: "msg_" + randomID(), model: model, open: -1, toolIndex: map[int]*streamedToolCall{}}
+}
+
+func (t *openAIMessagesTranslator) Response(body []byte) ([]byte, error) {
+	var in openAIChatCompletion
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, err
+	}
+	out := anthropicOutMessage{ID: t.id, Type: "message", Role: "assistant", Model: t.model, Content: []anthropicOutBlock{}}
+	stop := "end_turn"
+	if len(in.Choices) > 0 {
+		choice := in.Choices[0]
+		if c := choice.Message.Content; c != nil && *c != "" {
+			out.Content = append(out.Content, anthropicOutBlock{Type: "text", Text: c})
+		}
+		for _, call := range choice.Message.ToolCalls {
+			out.Content = append(out.Content, anthropicOutBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: toolInput(call.Function.Arguments)})
+		}
+		stop = openAIStopReason(choice.FinishReason)
+	}
+	out.StopReason = &stop
+	if u, ok := ParseUsage(body); ok {
+		out.Usage = newAnthropicUsage(u)
+	}
+	return json.Marshal(out)
+}
+
+func (t *openAIMessagesTranslator) StreamEvent(event []byte) []byte {
+	data := sseEventData(event)
+	if len(data) == 0 || string(data) == "[DONE]" {
+		return nil
+	}
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content   *string               `json:"content"`
+				ToolCalls []openAIToolCallDelta `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil
+	}
+	if len(chunk.Error) > 0 {
+		return anthropicEvent("error", map[string]interface{}{"type": "error", "error": anthropicError(chunk.Error)})
+	}
+	if u, ok := ParseUsage(data); ok {
+		t.usage.merge(u)
+	}
+
+	out := t.start()
+	for _, choice := range chunk.Choices {
+		if c := choice.Delta.Content; c != nil && *c != "" {
+			if t.open < 0 {
+				out = append(out, t.openBlock(anthropicOutBlock{Type: "text", Text: stringPtr("")})...)
+			}
+			out = append(out, anthropicEvent("content_block_delta", map[string]interface{}{
+				"type": "content_block_delta", "index": t.open,
+				"delta": map[string]string{"type": "text_delta", "text": *c},
+			})...)
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			tc, ok := t.toolIndex[call.Index]
+			if !ok {
+				tc = &streamedToolCall{id: call.ID}
+				if tc.id == "" {
+					tc.id = "toolu_" + randomID()
+				}
+				t.toolIndex[call.Index] = tc
+				t.toolCalls = append(t.toolCalls, tc)
+			}
+			if tc.name == "" {
+				tc.name = call.Function.Name
+			}
+			tc.arguments.WriteString(call.Function.Arguments)
+		}
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			t.stopReason = openAIStopReason(*choice.FinishReason)
+		}
+	}
+	return out
+}
+
+func (t *openAIMessagesTranslator) StreamEnd() []byte {
+	out := t.start()
+	for _, tc := range t.toolCalls {
+		out = append(out, t.openBlock(anthropicOutBlock{Type: "tool_use", ID: tc.id, Name: tc.name, Input: json.RawMessage("{}")})...)
+		if tc.arguments.Len() > 0 {
+			out = append(out, anthropicEvent("content_block_delta", map[string]interface{}{
+				"type": "content_block_delta", "index": t.open,
+				"delta": map[string]string{"type": "input_json_delta", "partial_json": tc.arguments.String()},
+			})...)
+		}
+	}
+	out = append(out, t.closeBlock()...)
+	stop := t.stopReason
+	if stop == "" {
+		stop = "end_turn"
+	}
+	out = append(out, anthropicEvent("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stop, "stop_sequence": nil},
+		"usage": newAnthropicUsage(t.usage),
+	})...)
+	return append(out, anthropicEvent("message_stop", map[string]string{"type": "message_stop"})...)
+}
+
+func (t *openAIMessagesTranslator) Error(status int, message string) (int, []byte) {
+	return ErrorBody(FormatAnthropic, status, "", message)
+}
+
+// start returns the message_start event the first time it is called.
+func (t *openAIMessagesTranslator) start() []byte {
+	if t.started {
+		return nil
+	}
+	t.started = true
+	msg := anthropicOutMessage{ID: t.id, Type: "message", Role: "assistant", Model: t.model, Content: []anthropicOutBlock{}}
+	return anthropicEvent("message_start", map[string]interface{}{"type": "message_start", "message": msg})
+}
+
+// openBlock closes the open content block and starts block.
+func (t *openAIMessagesTranslator) openBlock(block anthropicOutBlock) []byte {
+	out := t.closeBlock()
+	t.open = t.blocks
+	t.blocks++
+	return append(out, anthropicEvent("content_block_start", map[string]interface{}{
+		"type": "content_block_start", "index": t.open, "content_block": block,
+	})...)
+}
+
+func (t *openAIMessagesTranslator) closeBlock() []byte {
+	if t.open < 0 {
+		return nil
+	}
+	index := t.open
+	t.open = -1
+	return anthropicEvent("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": index})
+}
+
+// anthropicError reshapes an OpenAI error object as an Anthropic one.
+func anthropicError(raw json.RawMessage) map[string]string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil || e.Message == "" {
+		e.Message = string(raw)
+	}
+	return map[string]string{"type": "api_error", "message": e.Message}
+}
+
+// anthropicEvent frames v as a named SSE event, as the Messages API does.
+func anthropicEvent(name string, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	out := make([]byte, 0, len(data)+len(name)+16)
+	out = append(out, "event: "...)
+	out = append(out, name...)
+	out = append(out, '\n')
+	return append(out, sseData(data)...)
+}
@@ -0,0 +1,574 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const chatWithTools = `{
+	"model": "public",
+	"stream": true,
+	"max_tokens": 256,
+	"stop": "END",
+	"messages": [
+		{"role": "system", "content": "be brief"},
+		{"role": "user", "content": [
+			{"type": "text", "text": "what is in this image?"},
+			{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+		]},
+		{"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"cat\"}"}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "a cat"},
+		{"role": "user", "content": "thanks"}
+	],
+	"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"$schema": "x", "type": "object", "additionalProperties": false, "properties": {"q": {"type": "string"}}}}}],
+	"tool_choice": {"type": "function", "function": {"name": "lookup"}}
+}`
+
+func TestOpenAIChatToAnthropic(t *testing.T) {
+	out, stream, err := OpenAIChatToAnthropic([]byte(chatWithTools), "claude-upstream")
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if !stream {
+		t.Fatalf("expected stream to be reported")
+	}
+	var got anthropicRequest
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if got.Model != "claude-upstream" || got.System != "be brief" || got.MaxTokens != 256 || !got.Stream {
+		t.Fatalf("unexpected request header fields: %s", out)
+	}
+	if len(got.StopSequences) != 1 || got.StopSequences[0] != "END" {
+		t.Fatalf("unexpected stop sequences %v", got.StopSequences)
+	}
+	// user, assistant, then the tool result merged with the next user turn.
+	if len(got.Messages) != 3 {
+		t.Fatalf("expected 3 turns, got %s", out)
+	}
+	img := got.Messages[0].Content[1]
+	if img.Type != "image" || img.Source.Type != "base64" || img.Source.MediaType != "image/png" || img.Source.Data != "iVBORw0KGgo=" {
+		t.Fatalf("unexpected image block %+v", img)
+	}
+	use := got.Messages[1].Content[0]
+	if use.Type != "tool_use" || use.ID != "call_1" || use.Name != "lookup" || string(use.Input) != `{"q":"cat"}` {
+		t.Fatalf("unexpected tool_use block %+v", use)
+	}
+	last := got.Messages[2]
+	if last.Role != "user" || len(last.Content) != 2 || last.Content[0].Type != "tool_result" ||
+		last.Content[0].ToolUseID != "call_1" || last.Content[0].Content != "a cat" || last.Content[1].Text != "thanks" {
+		t.Fatalf("unexpected final turn %+v", last)
+	}
+	if got.ToolChoice == nil || got.ToolChoice.Type != "tool" || got.ToolChoice.Name != "lookup" {
+		t.Fatalf("unexpected tool_choice %+v", got.ToolChoice)
+	}
+	if len(got.Tools) != 1 || !strings.Contains(string(got.Tools[0].InputSchema), `"properties"`) {
+		t.Fatalf("unexpected tools %+v", got.Tools)
+	}
+}
+
+func TestOpenAIChatToAnthropicDefaultsMaxTokens(t *testing.T) {
+	out, stream, err := OpenAIChatToAnthropic([]byte(`{"messages":[{"role":"user","content":"hi"}]}`), "claude")
+	if err != nil || stream {
+		t.Fatalf("unexpected result stream=%v err=%v", stream, err)
+	}
+	if !strings.Contains(string(out), `"max_tokens":4096`) {
+		t.Fatalf("expected default max_tokens, got %s", out)
+	}
+}
+
+func TestOpenAIChatRejectsInvalidBody(t *testing.T) {
+	for _, body := range []string{`{`, `{"messages":[]}`, `{"messages":[{"role":"narrator","content":"x"}]}`} {
+		if _, _, err := OpenAIChatToAnthropic([]byte(body), "claude"); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("anthropic %s: expected ErrInvalidRequest, got %v", body, err)
+		}
+		if _, _, err := OpenAIChatToGemini([]byte(body)); !errors.Is(err, ErrInvalidRequest) {
+			t.Fatalf("gemini %s: expected ErrInvalidRequest, got %v", body, err)
+		}
+	}
+}
+
+func TestOpenAIChatToAnthropicRejectsSeveralChoices(t *testing.T) {
+	body := `{"n":2,"messages":[{"role":"user","content":"hi"}]}`
+	if _, _, err := OpenAIChatToAnthropic([]byte(body), "claude"); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest for n=2, got %v", err)
+	}
+}
+
+func TestChatTranslatorsEndStreamOnUpstreamError(t *testing.T) {
+	cases := []struct {
+		name  string
+		tr    Translator
+		event string
+	}{
+		{"anthropic", NewAnthropicChatTranslator("claude", true), `event: error` + "\n" + `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`},
+		{"anthropic bare", NewAnthropicChatTranslator("claude", true), `data: {"type":"error"}`},
+		{"gemini", NewGeminiChatTranslator("gemini", true), `data: {"error":{"code":500,"message":"Internal error","status":"INTERNAL"}}`},
+	}
+	for _, tc := range cases {
+		out := tc.tr.StreamEvent([]byte(tc.event + "\n\n"))
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(sseEventData(out), &body); err != nil || body.Error.Message == "" {
+			t.Fatalf("%s: expected an OpenAI error event, got %q", tc.name, out)
+		}
+		if end := tc.tr.StreamEnd(); len(end) != 0 {
+			t.Fatalf("%s: expected nothing after the error, got %q", tc.name, end)
+		}
+	}
+}
+
+func TestOpenAIChatToGemini(t *testing.T) {
+	out, stream, err := OpenAIChatToGemini([]byte(chatWithTools))
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if !stream {
+		t.Fatalf("expected stream to be reported")
+	}
+	var got geminiRequest
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if got.SystemInstruction == nil || got.SystemInstruction.Parts[0].Text != "be brief" {
+		t.Fatalf("unexpected system instruction in %s", out)
+	}
+	if len(got.Contents) != 3 || got.Contents[1].Role != "model" {
+		t.Fatalf("expected user/model/user turns, got %s", out)
+	}
+	if blob := got.Contents[0].Parts[1].InlineData; blob == nil || blob.MimeType != "image/png" {
+		t.Fatalf("expected inline image, got %s", out)
+	}
+	call := got.Contents[1].Parts[0].FunctionCall
+	if call == nil || call.Name != "lookup" || string(call.Args) != `{"q":"cat"}` {
+		t.Fatalf("unexpected function call in %s", out)
+	}
+	resp := got.Contents[2].Parts[0].FunctionResponse
+	if resp == nil || resp.Name != "lookup" || string(resp.Response) != `{"content":"a cat"}` {
+		t.Fatalf("unexpected function response in %s", out)
+	}
+	if got.GenerationConfig == nil || got.GenerationConfig.MaxOutputTokens != 256 || got.GenerationConfig.StopSequences[0] != "END" {
+		t.Fatalf("unexpected generation config in %s", out)
+	}
+	params := string(got.Tools[0].FunctionDeclarations[0].Parameters)
+	if strings.Contains(params, "$schema") || strings.Contains(params, "additionalProperties") || !strings.Contains(params, `"q"`) {
+		t.Fatalf("unexpected sanitized parameters %s", params)
+	}
+	fc := got.ToolConfig.FunctionCallingConfig
+	if fc.Mode != "ANY" || len(fc.AllowedFunctionNames) != 1 || fc.AllowedFunctionNames[0] != "lookup" {
+		t.Fatalf("unexpected tool config %+v", fc)
+	}
+}
+
+func TestAnthropicChatTranslatorResponse(t *testing.T) {
+	tr := NewAnthropicChatTranslator("claude-public", false)
+	body := `{"id":"msg_01","type":"message","role":"assistant","content":[{"type":"text","text":"Let me check."},{"type":"tool_use","id":"toolu_1","name":"lookup","input":{"q":"cat"}}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":4}}`
+	out, err := tr.Response([]byte(body))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	var got openAIChatCompletion
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	choice := got.Choices[0]
+	if got.Object != "chat.completion" || got.Model != "claude-public" || choice.FinishReason != "tool_calls" {
+		t.Fatalf("unexpected completion %s", out)
+	}
+	if choice.Message.Content == nil || *choice.Message.Content != "Let me check." {
+		t.Fatalf("unexpected content %s", out)
+	}
+	if len(choice.Message.ToolCalls) != 1 || choice.Message.ToolCalls[0].ID != "toolu_1" || choice.Message.ToolCalls[0].Function.Arguments != `{"q":"cat"}` {
+		t.Fatalf("unexpected tool calls %s", out)
+	}
+	if got.Usage.PromptTokens != 14 || got.Usage.CompletionTokens != 5 || got.Usage.PromptTokensDetails.CachedTokens != 4 {
+		t.Fatalf("unexpected usage %+v", got.Usage)
+	}
+}
+
+func TestAnthropicChatTranslatorStream(t *testing.T) {
+	tr := NewAnthropicChatTranslator("claude-public", true)
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_01","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"lookup"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"q\":"}}`,
+		`{"type":"ping"}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":9}}`,
+	}
+	var out strings.Builder
+	for _, ev := range events {
+		out.Write(tr.StreamEvent([]byte("event: x\ndata: " + ev + "\n\n")))
+	}
+	out.Write(tr.StreamEnd())
+
+	chunks := sseChunks(t, out.String())
+	if len(chunks) != 6 {
+		t.Fatalf("expected 6 chunks, got %d: %s", len(chunks), out.String())
+	}
+	if chunks[0].Choices[0].Delta.Role != "assistant" || *chunks[1].Choices[0].Delta.Content != "Hi" {
+		t.Fatalf("unexpected leading chunks %s", out.String())
+	}
+	call := chunks[2].Choices[0].Delta.ToolCalls[0]
+	if call.Index != 0 || call.ID != "toolu_1" || call.Function.Name != "lookup" {
+		t.Fatalf("unexpected tool call start %+v", call)
+	}
+	if chunks[3].Choices[0].Delta.ToolCalls[0].Function.Arguments != `{"q":` {
+		t.Fatalf("unexpected tool call arguments %s", out.String())
+	}
+	if fr := chunks[4].Choices[0].FinishReason; fr == nil || *fr != "tool_calls" {
+		t.Fatalf("unexpected finish chunk %s", out.String())
+	}
+	if u := chunks[5].Usage; u == nil || u.PromptTokens != 12 || u.CompletionTokens != 9 || len(chunks[5].Choices) != 0 {
+		t.Fatalf("unexpected usage chunk %s", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "data: [DONE]\n\n") {
+		t.Fatalf("stream must end with [DONE]")
+	}
+}
+
+func TestGeminiChatTranslatorResponse(t *testing.T) {
+	tr := NewGeminiChatTranslator("gemini-public", false)
+	body := `{"responseId":"r1","candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"thinking","thought":true},{"functionCall":{"name":"lookup","args":{"q":"cat"}}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":3}}`
+	out, err := tr.Response([]byte(body))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	var got openAIChatCompletion
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	choice := got.Choices[0]
+	if got.ID != "chatcmpl-r1" || choice.FinishReason != "tool_calls" || choice.Message.Content != nil {
+		t.Fatalf("unexpected completion %s", out)
+	}
+	call := choice.Message.ToolCalls[0]
+	if !strings.HasPrefix(call.ID, "call_") || call.Function.Name != "lookup" || call.Function.Arguments != `{"q":"cat"}` {
+		t.Fatalf("unexpected tool call %+v", call)
+	}
+	if got.Usage.PromptTokens != 8 || got.Usage.CompletionTokens != 3 {
+		t.Fatalf("unexpected usage %+v", got.Usage)
+	}
+}
+
+func TestGeminiChatTranslatorStream(t *testing.T) {
+	tr := NewGeminiChatTranslator("gemini-public", false)
+	var out strings.Builder
+	out.Write(tr.StreamEvent([]byte(`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]}}]}` + "\n\n")))
+	out.Write(tr.StreamEvent([]byte(`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"lo"}]},"finishReason":"MAX_TOKENS"}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":2}}` + "\n\n")))
+	out.Write(tr.StreamEnd())
+
+	chunks := sseChunks(t, out.String())
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks without the usage chunk, got %s", out.String())
+	}
+	if chunks[0].Choices[0].Delta.Role != "assistant" || *chunks[0].Choices[0].Delta.Content != "Hel" {
+		t.Fatalf("unexpected first chunk %s", out.String())
+	}
+	if chunks[1].Choices[0].Delta.Role != "" || *chunks[1].Choices[0].FinishReason != "length" {
+		t.Fatalf("unexpected second chunk %s", out.String())
+	}
+	if !strings.HasSuffix(out.String(), "data: [DONE]\n\n") {
+		t.Fatalf("stream must end with [DONE]")
+	}
+}
+
+func TestRelayTranslatedRendersErrorsForClient(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = io.WriteString(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	}))
+	defer upstream.Close()
+
+	client := NewProxyClient()
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	resp, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL, APIKey: "k", Format: FormatAnthropic})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	res, err := client.RelayTranslated(rec, origReq, resp, NewAnthropicChatTranslator("claude", false), false)
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests || rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "7" {
+		t.Fatalf("unexpected status %d/%d headers %v", res.StatusCode, rec.Code, rec.Header())
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Message != "slow down" || body.Error.Type != "rate_limit_error" {
+		t.Fatalf("expected an OpenAI-shaped error, got %s", rec.Body.String())
+	}
+}
+
+func TestSendUpstreamPresentsKeyPerFormat(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	client := NewProxyClient()
+	origReq := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	origReq.Header.Set("Authorization", "Bearer user-key")
+	cases := []struct {
+		format Format
+		header string
+		value  string
+	}{
+		{FormatAuto, "Authorization", "Bearer channel-key"},
+		{FormatAnthropic, "X-Api-Key", "channel-key"},
+		{FormatGemini, "X-Goog-Api-Key", "channel-key"},
+	}
+	for _, tc := range cases {
+		resp, err := client.SendUpstream(origReq, Upstream{Method: http.MethodPost, URL: upstream.URL, APIKey: "channel-key", Format: tc.format})
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		Discard(resp)
+		if got.Get(tc.header) != tc.value {
+			t.Fatalf("format %q: expected %s=%s, got %v", tc.format, tc.header, tc.value, got)
+		}
+		if tc.format != FormatAuto && got.Get("Authorization") != "" {
+			t.Fatalf("format %q must not forward Authorization", tc.format)
+		}
+	}
+	if got.Get("X-Goog-Api-Key") == "" || got.Get("Anthropic-Version") != "" {
+		t.Fatalf("anthropic-version must only be set for anthropic channels")
+	}
+}
+
+// sseChunks decodes the data events of a translated chat stream, skipping the
+// final [DONE] marker.
+func sseChunks(t *testing.T, stream string) []openAIChunk {
+	t.Helper()
+	var chunks []openAIChunk
+	for _, event := range strings.Split(stream, "\n\n") {
+		data := string(sseEventData([]byte(event)))
+		if data == "" || data == "[DONE]" {
+			continue
+		}
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestAnthropicToOpenAIChat(t *testing.T) {
+	body := `{
+		"model": "gpt-public",
+		"max_tokens": 512,
+		"stream": true,
+		"system": [{"type": "text", "text": "be brief"}],
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "look"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/jpeg", "data": "AAAA"}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Checking."},
+				{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": {"q": "cat"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "a cat"}]},
+				{"type": "text", "text": "thanks"}
+			]}
+		],
+		"tools": [{"name": "lookup", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any", "disable_parallel_tool_use": true}
+	}`
+	out, stream, err := AnthropicToOpenAIChat([]byte(body), "gpt-upstream")
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if !stream {
+		t.Fatalf("expected stream to be reported")
+	}
+	var got struct {
+		Model         string `json:"model"`
+		MaxTokens     int    `json:"max_tokens"`
+		StreamOptions struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+		Messages []struct {
+			Role       string           `json:"role"`
+			Content    json.RawMessage  `json:"content"`
+			ToolCalls  []openAIToolCall `json:"tool_calls"`
+			ToolCallID string           `json:"tool_call_id"`
+		} `json:"messages"`
+		Tools             []openAITool `json:"tools"`
+		ToolChoice        string       `json:"tool_choice"`
+		ParallelToolCalls *bool        `json:"parallel_tool_calls"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if got.Model != "gpt-upstream" || got.MaxTokens != 512 || !got.StreamOptions.IncludeUsage {
+		t.Fatalf("unexpected request fields %s", out)
+	}
+	roles := []string{}
+	for _, m := range got.Messages {
+		roles = append(roles, m.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant,tool,user" {
+		t.Fatalf("unexpected roles %v in %s", roles, out)
+	}
+	if !strings.Contains(string(got.Messages[1].Content), "data:image/jpeg;base64,AAAA") {
+		t.Fatalf("expected image data URL, got %s", got.Messages[1].Content)
+	}
+	call := got.Messages[2].ToolCalls[0]
+	if call.ID != "toolu_1" || call.Function.Arguments != `{"q":"cat"}` {
+		t.Fatalf("unexpected tool call %+v", call)
+	}
+	if got.Messages[3].ToolCallID != "toolu_1" || string(got.Messages[3].Content) != `"a cat"` {
+		t.Fatalf("unexpected tool message %s", out)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "lookup" || got.ToolChoice != "required" ||
+		got.ParallelToolCalls == nil || *got.ParallelToolCalls {
+		t.Fatalf("unexpected tools %s", out)
+	}
+}
+
+func TestOpenAIMessagesTranslatorResponse(t *testing.T) {
+	tr := NewOpenAIMessagesTranslator("gpt-public")
+	body := `{"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Sure.","tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"q\":\"cat\"}"}}]},"finish_reason":"tool_calls"}],"usage":{"prompt_tokens":20,"completion_tokens":7,"prompt_tokens_details":{"cached_tokens":5}}}`
+	out, err := tr.Response([]byte(body))
+	if err != nil {
+		t.Fatalf("translate: %v", err)
+	}
+	var got anthropicOutMessage
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if got.Type != "message" || got.Model != "gpt-public" || *got.StopReason != "tool_use" || len(got.Content) != 2 {
+		t.Fatalf("unexpected message %s", out)
+	}
+	if got.Content[1].Type != "tool_use" || got.Content[1].ID != "call_1" || string(got.Content[1].Input) != `{"q":"cat"}` {
+		t.Fatalf("unexpected tool_use %s", out)
+	}
+	if got.Usage.InputTokens != 15 || got.Usage.CacheReadInputTokens != 5 || got.Usage.OutputTokens != 7 {
+		t.Fatalf("unexpected usage %+v", got.Usage)
+	}
+}
+
+func TestOpenAIMessagesTranslatorStream(t *testing.T) {
+	tr := NewOpenAIMessagesTranslator("gpt-public")
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Hi"}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":1}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":4}}`,
+		`[DONE]`,
+	}
+	var out strings.Builder
+	for _, c := range chunks {
+		out.Write(tr.StreamEvent([]byte("data: " + c + "\n\n")))
+	}
+	out.Write(tr.StreamEnd())
+
+	var names []string
+	var last map[string]json.RawMessage
+	for _, event := range strings.Split(strings.TrimSpace(out.String()), "\n\n") {
+		name, _, _ := strings.Cut(strings.TrimPrefix(event, "event: "), "\n")
+		names = append(names, name)
+		if name == "message_delta" {
+			if err := json.Unmarshal(sseEventData([]byte(event)), &last); err != nil {
+				t.Fatalf("invalid message_delta: %v", err)
+			}
+		}
+	}
+	want := "message_start,content_block_start,content_block_delta,content_block_stop,content_block_start,content_block_delta,content_block_stop,message_delta,message_stop"
+	if strings.Join(names, ",") != want {
+		t.Fatalf("unexpected events %v", names)
+	}
+	if !strings.Contains(string(last["delta"]), `"stop_reason":"tool_use"`) || !strings.Contains(string(last["usage"]), `"output_tokens":4`) {
+		t.Fatalf("unexpected message_delta %v", last)
+	}
+	if !strings.Contains(out.String(), `"partial_json":"{\"q\":1}"`) || !strings.Contains(out.String(), `"text":"Hi"`) {
+		t.Fatalf("missing deltas in %s", out.String())
+	}
+}
+
+func TestOpenAIMessagesTranslatorStreamInterleavedToolCalls(t *testing.T) {
+	tr := NewOpenAIMessagesTranslator("gpt-public")
+	chunks := []string{
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"first","arguments":"{\"a\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"second","arguments":"{\"b\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"and"}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"1}"}},{"index":1,"function":{"arguments":"2}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+	}
+	var out strings.Builder
+	for _, c := range chunks {
+		out.Write(tr.StreamEvent([]byte("data: " + c + "\n\n")))
+	}
+	out.Write(tr.StreamEnd())
+
+	// Every delta must target the open block, and every block must be
+	// started and stopped exactly once.
+	open := -1
+	stopped := map[int]bool{}
+	inputs := map[string]string{}
+	var tool string
+	for _, event := range strings.Split(strings.TrimSpace(out.String()), "\n\n") {
+		var ev struct {
+			Type         string `json:"type"`
+			Index        int    `json:"index"`
+			ContentBlock struct {
+				Name string `json:"name"`
+			} `json:"content_block"`
+			Delta struct {
+				PartialJSON string `json:"partial_json"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal(sseEventData([]byte(event)), &ev); err != nil {
+			t.Fatalf("invalid event %q: %v", event, err)
+		}
+		switch ev.Type {
+		case "content_block_start":
+			if open >= 0 || stopped[ev.Index] {
+				t.Fatalf("block %d started while %d is open: %s", ev.Index, open, out.String())
+			}
+			open, tool = ev.Index, ev.ContentBlock.Name
+		case "content_block_delta":
+			if ev.Index != open {
+				t.Fatalf("delta for block %d while %d is open: %s", ev.Index, open, out.String())
+			}
+			inputs[tool] += ev.Delta.PartialJSON
+		case "content_block_stop":
+			if ev.Index != open {
+				t.Fatalf("stop for block %d while %d is open", ev.Index, open)
+			}
+			stopped[ev.Index] = true
+			open = -1
+		}
+	}
+	if open != -1 || len(stopped) != 3 {
+		t.Fatalf("expected three closed blocks, got %v (open %d)", stopped, open)
+	}
+	if inputs["first"] != `{"a":1}` || inputs["second"] != `{"b":2}` {
+		t.Fatalf("unexpected tool inputs %v", inputs)
+	}
+}
@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// TransportConfig describes how connections to one channel are made. The zero
+// value uses the client's shared transport.
+type TransportConfig struct {
+	// ProxyURL routes the channel through an http, https or socks5 proxy.
+	// Empty keeps the proxy settings of the environment.
+	ProxyURL string
+	// CACert is a PEM bundle of extra certificate authorities to trust, for
+	// upstreams behind a private CA.
+	CACert string
+	// TLSServerName overrides the name used for SNI and certificate
+	// verification.
+	TLSServerName string
+	// DisableHTTP2 keeps the channel on HTTP/1.1.
+	DisableHTTP2 bool
+	// MaxIdleConnsPerHost sizes the channel's idle connection pool; zero
+	// keeps the Go default of 2.
+	MaxIdleConnsPerHost int
+}
+
+// IsZero reports whether cfg asks for nothing beyond the shared transport.
+func (cfg TransportConfig) IsZero() bool {
+	return cfg == TransportConfig{}
+}
+
+// ValidateTransport checks that cfg can be turned into a transport: a proxy
+// URL with a supported scheme and host, and a CA bundle holding at least one
+// certificate.
+func ValidateTransport(cfg TransportConfig) error {
+	_, err := newChannelTransport(cfg)
+	return err
+}
+
+// newChannelTransport builds the transport for cfg on top of newTransport, so
+// per-request connect timeouts keep working.
+func newChannelTransport(cfg TransportConfig) (*http.Transport, error) {
+	transport := newTransport()
+	if cfg.ProxyURL != "" {
+		proxy, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, errors.New("proxy url must use http, https, socks5 or socks5h")
+		}
+		if proxy.Host == "" {
+			return nil, errors.New("proxy url has no host")
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if cfg.CACert != "" || cfg.TLSServerName != "" {
+		tlsConfig := &tls.Config{ServerName: cfg.TLSServerName}
+		if cfg.CACert != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+				return nil, errors.New("ca cert holds no PEM certificate")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if cfg.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < cfg.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = cfg.MaxIdleConnsPerHost
+		}
+	}
+	return transport, nil
+}
+
+// channelClient is the cached HTTP client of one channel and the config it
+// was built from.
+type channelClient struct {
+	cfg    TransportConfig
+	client *http.Client
+}
+
+// httpClientFor returns the HTTP client for a channel's transport config,
+// building and caching it on first use. A channel whose config changed gets a
+// new client, and the idle connections of the old one are closed.
+func (c *ProxyClient) httpClientFor(channelID uint, cfg TransportConfig) (*http.Client, error) {
+	if cfg.IsZero() {
+		if old, ok := c.transports.LoadAndDelete(channelID); ok {
+			old.(*channelClient).client.CloseIdleConnections()
+		}
+		if c.HTTP == nil {
+			return http.DefaultClient, nil
+		}
+		return c.HTTP, nil
+	}
+	if cached, ok := c.transports.Load(channelID); ok && cached.(*channelClient).cfg == cfg {
+		return cached.(*channelClient).client, nil
+	}
+	transport, err := newChannelTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cc := &channelClient{cfg: cfg, client: &http.Client{Transport: transport}}
+	if old, ok := c.transports.Swap(channelID, cc); ok {
+		old.(*channelClient).client.CloseIdleConnections()
+	}
+	return cc.client, nil
+}
@@ -0,0 +1,273 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Usage is the token accounting reported by an upstream provider, normalised
+// across the OpenAI, Anthropic and Gemini response formats.
+//
+// PromptTokens counts every input token, including the ones served from a
+// prompt cache; CachedTokens is the cached subset of PromptTokens. Images and
+// AudioSeconds cover the non-token units of image generation and audio
+// transcription responses.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	Images           int
+	AudioSeconds     float64
+}
+
+// IsZero reports whether no usage has been observed.
+func (u Usage) IsZero() bool {
+	return u.PromptTokens == 0 && u.CompletionTokens == 0 && u.CachedTokens == 0 &&
+		u.Images == 0 && u.AudioSeconds == 0
+}
+
+// TotalTokens returns prompt plus completion tokens.
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// merge folds a newer observation into u. Providers report cumulative counts
+// in streams (Anthropic message_start/message_delta, Gemini chunks, the final
+// OpenAI chunk), so the latest non-zero value of each field wins.
+func (u *Usage) merge(next Usage) {
+	if next.PromptTokens > 0 {
+		u.PromptTokens = next.PromptTokens
+	}
+	if next.CompletionTokens > 0 {
+		u.CompletionTokens = next.CompletionTokens
+	}
+	if next.CachedTokens > 0 {
+		u.CachedTokens = next.CachedTokens
+	}
+	if next.Images > 0 {
+		u.Images = next.Images
+	}
+	if next.AudioSeconds > 0 {
+		u.AudioSeconds = next.AudioSeconds
+	}
+}
+
+// providerUsage covers both the OpenAI and Anthropic "usage" objects.
+type providerUsage struct {
+	// OpenAI chat/completions.
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+
+	// Anthropic messages.
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+
+	// OpenAI Responses API; input_tokens includes the cached ones.
+	InputTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+
+	// OpenAI audio transcriptions billed by duration.
+	Seconds float64 `json:"seconds"`
+}
+
+func (p *providerUsage) normalise() Usage {
+	if p == nil {
+		return Usage{}
+	}
+	u := Usage{
+		PromptTokens:     p.PromptTokens,
+		CompletionTokens: p.CompletionTokens,
+	}
+	if p.PromptTokensDetails != nil {
+		u.CachedTokens = p.PromptTokensDetails.CachedTokens
+	}
+	if p.InputTokens > 0 || p.CacheReadInputTokens > 0 || p.CacheCreationInputTokens > 0 {
+		// Anthropic reports cache reads/writes separately from input_tokens.
+		u.PromptTokens = p.InputTokens + p.CacheReadInputTokens + p.CacheCreationInputTokens
+		u.CachedTokens = p.CacheReadInputTokens
+	}
+	if p.InputTokensDetails != nil && p.InputTokensDetails.CachedTokens > 0 {
+		u.CachedTokens = p.InputTokensDetails.CachedTokens
+	}
+	if p.OutputTokens > 0 {
+		u.CompletionTokens = p.OutputTokens
+	}
+	u.AudioSeconds = p.Seconds
+	return u
+}
+
+type geminiUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+}
+
+// usageEnvelope lists every place a usage block may appear in a response
+// body or a single stream event.
+type usageEnvelope struct {
+	Usage         *providerUsage `json:"usage"`
+	UsageMetadata *geminiUsage   `json:"usageMetadata"`
+	// Anthropic message_start nests usage under "message".
+	Message *struct {
+		Usage *providerUsage `json:"usage"`
+	} `json:"message"`
+	// Responses API stream events (response.completed and friends) nest the
+	// response object under "response".
+	Response *struct {
+		Usage *providerUsage `json:"usage"`
+	} `json:"response"`
+
+	// OpenAI image generations list one entry per image; verbose
+	// transcriptions report the audio duration.
+	Data     []json.RawMessage `json:"data"`
+	Duration float64           `json:"duration"`
+}
+
+// countImages returns how many entries of an OpenAI list response are
+// generated images rather than, say, embeddings.
+func countImages(data []json.RawMessage) int {
+	n := 0
+	for _, raw := range data {
+		var item struct {
+			URL     *string `json:"url"`
+			B64JSON *string `json:"b64_json"`
+		}
+		if json.Unmarshal(raw, &item) == nil && (item.URL != nil || item.B64JSON != nil) {
+			n++
+		}
+	}
+	return n
+}
+
+// ParseUsage extracts token usage from a JSON response body or a single SSE
+// event payload. Gemini's streamGenerateContent without alt=sse answers with a
+// JSON array of chunks, which is folded the same way as a stream. It returns
+// false when the payload carries no usage.
+func ParseUsage(data []byte) (Usage, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var chunks []json.RawMessage
+		if err := json.Unmarshal(data, &chunks); err != nil {
+			return Usage{}, false
+		}
+		var u Usage
+		for _, chunk := range chunks {
+			if next, ok := ParseUsage(chunk); ok {
+				u.merge(next)
+			}
+		}
+		return u, !u.IsZero()
+	}
+	if len(data) == 0 || data[0] != '{' {
+		return Usage{}, false
+	}
+	var env usageEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Usage{}, false
+	}
+
+	var u Usage
+	if env.Message != nil {
+		u.merge(env.Message.Usage.normalise())
+	}
+	if env.Response != nil {
+		u.merge(env.Response.Usage.normalise())
+	}
+	u.merge(env.Usage.normalise())
+	if g := env.UsageMetadata; g != nil {
+		u.merge(Usage{
+			PromptTokens:     g.PromptTokenCount,
+			CompletionTokens: g.CandidatesTokenCount + g.ThoughtsTokenCount,
+			CachedTokens:     g.CachedContentTokenCount,
+		})
+	}
+	u.merge(Usage{Images: countImages(env.Data), AudioSeconds: env.Duration})
+	return u, !u.IsZero()
+}
+
+// sseEventData returns the concatenated "data:" payload of one SSE event.
+func sseEventData(event []byte) []byte {
+	var data []byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		chunk := bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))
+		if data != nil {
+			data = append(data, '\n')
+		}
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+// ParseResponseID returns the id of an OpenAI Responses API object, either
+// from a response body or from a stream event wrapping the response. It
+// returns "" for anything else.
+func ParseResponseID(data []byte) string {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return ""
+	}
+	var obj struct {
+		ID       string `json:"id"`
+		Object   string `json:"object"`
+		Response *struct {
+			ID string `json:"id"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return ""
+	}
+	if obj.Object == "response" {
+		return obj.ID
+	}
+	if obj.Response != nil {
+		return obj.Response.ID
+	}
+	return ""
+}
+
+// isUsageChunk reports whether event is the usage-only chunk an OpenAI stream
+// ends with under stream_options.include_usage: no choices, only usage.
+func isUsageChunk(event []byte) bool {
+	var chunk struct {
+		Choices *[]json.RawMessage `json:"choices"`
+		Usage   json.RawMessage    `json:"usage"`
+	}
+	if err := json.Unmarshal(sseEventData(event), &chunk); err != nil {
+		return false
+	}
+	return chunk.Choices != nil && len(*chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
+
+// usageTracker accumulates usage across the events of a stream, along with
+// the Responses API object id if the stream carries one.
+type usageTracker struct {
+	usage      Usage
+	responseID string
+}
+
+func (t *usageTracker) observeEvent(event []byte) {
+	if t == nil {
+		return
+	}
+	data := sseEventData(event)
+	if len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+		return
+	}
+	if u, ok := ParseUsage(data); ok {
+		t.usage.merge(u)
+	}
+	if t.responseID == "" {
+		t.responseID = ParseResponseID(data)
+	}
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUsage(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		expected Usage
+		ok       bool
+	}{
+		{
+			name:     "openai",
+			body:     `{"id":"x","usage":{"prompt_tokens":12,"completion_tokens":30,"prompt_tokens_details":{"cached_tokens":4}}}`,
+			expected: Usage{PromptTokens: 12, CompletionTokens: 30, CachedTokens: 4},
+			ok:       true,
+		},
+		{
+			name:     "anthropic",
+			body:     `{"type":"message","usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":100,"cache_creation_input_tokens":20}}`,
+			expected: Usage{PromptTokens: 130, CompletionTokens: 5, CachedTokens: 100},
+			ok:       true,
+		},
+		{
+			name:     "anthropic message_start",
+			body:     `{"type":"message_start","message":{"usage":{"input_tokens":25,"output_tokens":1}}}`,
+			expected: Usage{PromptTokens: 25, CompletionTokens: 1},
+			ok:       true,
+		},
+		{
+			name:     "gemini",
+			body:     `{"candidates":[],"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":16,"thoughtsTokenCount":4,"cachedContentTokenCount":2}}`,
+			expected: Usage{PromptTokens: 8, CompletionTokens: 20, CachedTokens: 2},
+			ok:       true,
+		},
+		{
+			name:     "gemini json array stream",
+			body:     `[{"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":3}},{"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":11}}]`,
+			expected: Usage{PromptTokens: 8, CompletionTokens: 11},
+			ok:       true,
+		},
+		{
+			name:     "openai images",
+			body:     `{"created":1,"data":[{"url":"https://x/1.png"},{"b64_json":"aGk="}]}`,
+			expected: Usage{Images: 2},
+			ok:       true,
+		},
+		{
+			name:     "openai transcription",
+			body:     `{"text":"hi","usage":{"type":"duration","seconds":12.5}}`,
+			expected: Usage{AudioSeconds: 12.5},
+			ok:       true,
+		},
+		{name: "openai embeddings are not images", body: `{"data":[{"object":"embedding","embedding":[0.1]}]}`},
+		{name: "openai chunk without usage", body: `{"choices":[],"usage":null}`},
+		{name: "not json", body: `hello`},
+	}
+
+	for _, tc := range cases {
+		got, ok := ParseUsage([]byte(tc.body))
+		if ok != tc.ok || got != tc.expected {
+			t.Fatalf("%s: expected %+v (%v), got %+v (%v)", tc.name, tc.expected, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestUsageTrackerMergesAnthropicStream(t *testing.T) {
+	tracker := &usageTracker{}
+	events := []string{
+		"event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":40,\"output_tokens\":1}}}\n\n",
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"text\":\"hi\"}}\n\n",
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":57}}\n\n",
+		"data: [DONE]\n\n",
+	}
+	for _, ev := range events {
+		tracker.observeEvent([]byte(ev))
+	}
+
+	expected := Usage{PromptTokens: 40, CompletionTokens: 57}
+	if tracker.usage != expected {
+		t.Fatalf("expected %+v, got %+v", expected, tracker.usage)
+	}
+}
+
+func TestUsageTrackerReadsResponsesStream(t *testing.T) {
+	tracker := &usageTracker{}
+	events := []string{
+		"event: response.created\ndata: {\"type\":\"response.created\",\"response\":{\"id\":\"resp_1\",\"object\":\"response\",\"usage\":null}}\n\n",
+		"event: response.output_text.delta\ndata: {\"type\":\"response.output_text.delta\",\"delta\":\"hi\"}\n\n",
+		"event: response.completed\ndata: {\"type\":\"response.completed\",\"response\":{\"id\":\"resp_1\",\"usage\":{\"input_tokens\":20,\"output_tokens\":9,\"input_tokens_details\":{\"cached_tokens\":8}}}}\n\n",
+	}
+	for _, ev := range events {
+		tracker.observeEvent([]byte(ev))
+	}
+
+	expected := Usage{PromptTokens: 20, CompletionTokens: 9, CachedTokens: 8}
+	if tracker.usage != expected {
+		t.Fatalf("expected %+v, got %+v", expected, tracker.usage)
+	}
+	if tracker.responseID != "resp_1" {
+		t.Fatalf("expected response id, got %q", tracker.responseID)
+	}
+}
+
+func TestParseResponseID(t *testing.T) {
+	cases := map[string]string{
+		`{"id":"resp_2","object":"response","status":"completed"}`: "resp_2",
+		`{"id":"chatcmpl-1","object":"chat.completion"}`:           "",
+		`{"type":"message","id":"msg_1"}`:                          "",
+		`not json`:                                                 "",
+	}
+	for body, expected := range cases {
+		if got := ParseResponseID([]byte(body)); got != expected {
+			t.Fatalf("%s: expected %q, got %q", body, expected, got)
+		}
+	}
+}
+
+func TestProxyRequestCapturesBufferedUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"usage":{"prompt_tokens":3,"completion_tokens":7}}`))
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+
+	res, err := NewProxyClient().ProxyRequest(rec, req, http.MethodPost, upstream.URL, "key", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Usage{PromptTokens: 3, CompletionTokens: 7}
+	if res.Usage != expected {
+		t.Fatalf("expected %+v, got %+v", expected, res.Usage)
+	}
+}
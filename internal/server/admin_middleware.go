@@ -44,9 +44,7 @@ func APIKeyOnlyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		method, _ := c.Get("auth_method")
 		if m, _ := method.(string); m != "api_key" {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-				"error": "this endpoint requires API key, web login token not allowed",
-			})
+			abortRelayError(c, http.StatusForbidden, errCodeAPIKeyRequired, "this endpoint requires API key, web login token not allowed")
 			return
 		}
 		c.Next()
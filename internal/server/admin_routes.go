@@ -7,48 +7,131 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
 	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
 )
 
-// validateModelUniqueness checks that the given models don't conflict with
-// other channels. excludeChannelID is used when updating an existing channel.
-func validateModelUniqueness(app *AppContext, excludeChannelID uint, newModels []string) error {
-	if len(newModels) == 0 {
-		return nil
+// validateChannelPayload checks the channel's models JSON list, model mapping
+// and its load balancing settings. Several channels may list the same model; the relay
+// balances between them by priority and weight.
+func validateChannelPayload(ch *models.Channel) error {
+	var ms []string
+	if err := json.Unmarshal([]byte(ch.Models), &ms); err != nil {
+		return errors.New("invalid models JSON format")
 	}
+	if ch.Weight == 0 {
+		ch.Weight = 1
+	}
+	if ch.Weight < 0 {
+		return errors.New("weight must be positive")
+	}
+	if ch.MinLevel < 0 {
+		return errors.New("min_level must not be negative")
+	}
+	if ch.ConnectTimeoutSeconds < 0 || ch.HeaderTimeoutSeconds < 0 || ch.IdleTimeoutSeconds < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if ch.RPMLimit < 0 || ch.TPMLimit < 0 {
+		return errors.New("rpm_limit and tpm_limit must not be negative")
+	}
+	if ch.MaxIdleConnsPerHost < 0 {
+		return errors.New("max_idle_conns_per_host must not be negative")
+	}
+	ch.ProxyURL = strings.TrimSpace(ch.ProxyURL)
+	ch.TLSServerName = strings.TrimSpace(ch.TLSServerName)
+	if err := relay.ValidateTransport(channelTransport(ch)); err != nil {
+		return err
+	}
+	ch.KeyRotation = strings.TrimSpace(ch.KeyRotation)
+	if ch.KeyRotation != models.ChannelKeyRotationRoundRobin && ch.KeyRotation != models.ChannelKeyRotationLeastUsed {
+		return errors.New("key_rotation must be empty or least_used")
+	}
+	ch.Format = strings.TrimSpace(ch.Format)
+	switch ch.Format {
+	case models.ChannelFormatAuto, models.ChannelFormatAnthropic, models.ChannelFormatGemini, models.ChannelFormatOpenAI:
+	default:
+		return errors.New("format must be empty, anthropic, gemini or openai")
+	}
+	if strings.TrimSpace(ch.ModelMapping) == "" {
+		ch.ModelMapping = "{}"
+	}
+	if _, err := parseModelMapping(ch.ModelMapping); err != nil {
+		return err
+	}
+	if strings.TrimSpace(ch.Headers) == "" {
+		ch.Headers = "{}"
+	}
+	if _, err := parseChannelHeaders(ch.Headers); err != nil {
+		return err
+	}
+	return nil
+}
 
-	var allChannels []models.Channel
-	query := app.DB.DB
-	if excludeChannelID > 0 {
-		query = query.Where("id != ?", excludeChannelID)
+// validateModelCreditRule checks that a rule charges something: either a
+// positive flat credit_cost or at least one positive token or unit price.
+// Rules scoped to an endpoint may be free, e.g. to exempt countTokens.
+func validateModelCreditRule(rule *models.ModelCreditRule) error {
+	if rule.CreditCost < 0 || rule.InputPricePerMillion < 0 ||
+		rule.OutputPricePerMillion < 0 || rule.CachedPricePerMillion < 0 ||
+		rule.PricePerImage < 0 || rule.PricePerAudioSecond < 0 {
+		return errors.New("credit_cost and prices must not be negative")
 	}
-	if err := query.Find(&allChannels).Error; err != nil {
-		return fmt.Errorf("failed to query channels")
+	rule.Endpoint = strings.TrimSpace(rule.Endpoint)
+	if !isRuleEndpoint(rule.Endpoint) {
+		return errors.New("unknown endpoint")
 	}
+	if rule.Endpoint == "" && rule.CreditCost == 0 && rule.InputPricePerMillion == 0 &&
+		rule.OutputPricePerMillion == 0 && rule.CachedPricePerMillion == 0 &&
+		rule.PricePerImage == 0 && rule.PricePerAudioSecond == 0 {
+		return errors.New("credit_cost or a price is required")
+	}
+	return nil
+}
 
-	// Build a map of model -> channel name for conflict detection
-	modelToChannel := make(map[string]string)
-	for _, ch := range allChannels {
-		var existingModels []string
-		if err := json.Unmarshal([]byte(ch.Models), &existingModels); err != nil {
-			continue
-		}
-		for _, m := range existingModels {
-			modelToChannel[m] = ch.Name
-		}
+// validatePayloadCaptureRule checks the sampling rate of a capture rule and
+// normalises its model pattern.
+func validatePayloadCaptureRule(rule *models.PayloadCaptureRule) error {
+	rule.ModelPattern = strings.TrimSpace(rule.ModelPattern)
+	if rule.SampleRate <= 0 || rule.SampleRate > 1 {
+		return errors.New("sample_rate must be in (0, 1]")
 	}
+	return nil
+}
 
-	// Check for conflicts
-	for _, newModel := range newModels {
-		if existingChannel, exists := modelToChannel[newModel]; exists {
-			return fmt.Errorf("model '%s' already exists in channel '%s'", newModel, existingChannel)
-		}
+// channelKeyView renders a channel key for admins, with the key masked.
+func channelKeyView(k models.ChannelKey) gin.H {
+	return gin.H{
+		"id":            k.ID,
+		"channel_id":    k.ChannelID,
+		"api_key":       maskAPIKey(k.APIKey),
+		"status":        k.Status,
+		"request_count": k.RequestCount,
+		"last_used_at":  k.LastUsedAt,
+		"last_error":    k.LastError,
+		"exhausted_at":  k.ExhaustedAt,
+		"created_at":    k.CreatedAt,
 	}
+}
 
+// validateResponseCacheRule checks a response cache rule's TTL, hit price and
+// endpoint.
+func validateResponseCacheRule(rule *models.ResponseCacheRule) error {
+	rule.ModelPattern = strings.TrimSpace(rule.ModelPattern)
+	rule.Endpoint = strings.TrimSpace(rule.Endpoint)
+	if rule.TTLSeconds <= 0 {
+		return errors.New("ttl_seconds must be positive")
+	}
+	if rule.HitCreditPercent < 0 || rule.HitCreditPercent > 100 {
+		return errors.New("hit_credit_percent must be between 0 and 100")
+	}
+	if !isRuleEndpoint(rule.Endpoint) {
+		return errors.New("unknown endpoint")
+	}
 	return nil
 }
 
@@ -102,7 +185,21 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list channels"})
 			return
 		}
-		c.JSON(http.StatusOK, channels)
+
+		// Each channel is returned with its circuit breaker state and recent
+		// error counts alongside the stored configuration.
+		type channelWithHealth struct {
+			models.Channel
+			Health channelHealth `json:"health"`
+		}
+		result := make([]channelWithHealth, len(channels))
+		for i := range channels {
+			result[i] = channelWithHealth{
+				Channel: channels[i],
+				Health:  loadChannelHealth(app, channels[i].ID),
+			}
+		}
+		c.JSON(http.StatusOK, result)
 	})
 
 	admin.POST("/channels", func(c *gin.Context) {
@@ -115,14 +212,7 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			in.Status = models.ChannelStatusEn
 		}
 
-		// Validate model uniqueness: each model can only belong to one channel
-		var newModels []string
-		if err := json.Unmarshal([]byte(in.Models), &newModels); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid models JSON format"})
-			return
-		}
-
-		if err := validateModelUniqueness(app, 0, newModels); err != nil {
+		if err := validateChannelPayload(&in); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
@@ -151,14 +241,7 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			return
 		}
 
-		// Validate model uniqueness when updating
-		var newModels []string
-		if err := json.Unmarshal([]byte(ch.Models), &newModels); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid models JSON format"})
-			return
-		}
-
-		if err := validateModelUniqueness(app, uint(id), newModels); err != nil {
+		if err := validateChannelPayload(&ch); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
@@ -181,13 +264,129 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete channel"})
 			return
 		}
+		if err := app.DB.Where("channel_id = ?", id).Delete(&models.ChannelKey{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete channel keys"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// channel keys: keys are added and removed one at a time and only shown
+	// masked once stored.
+	admin.GET("/channels/:id/keys", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		keys, err := loadChannelKeys(app, uint(id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list channel keys"})
+			return
+		}
+		result := make([]gin.H, len(keys))
+		for i, k := range keys {
+			result[i] = channelKeyView(k)
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	admin.POST("/channels/:id/keys", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var ch models.Channel
+		if err := app.DB.First(&ch, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "channel not found"})
+			return
+		}
+		var input struct {
+			APIKey string `json:"api_key"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		input.APIKey = strings.TrimSpace(input.APIKey)
+		if input.APIKey == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "api_key is required"})
+			return
+		}
+		key := models.ChannelKey{ChannelID: ch.ID, APIKey: input.APIKey, Status: models.ChannelKeyStatusActive}
+		if err := app.DB.Create(&key).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create channel key"})
+			return
+		}
+		c.JSON(http.StatusOK, channelKeyView(key))
+	})
+
+	admin.PUT("/channels/:id/keys/:key_id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+			return
+		}
+		var key models.ChannelKey
+		if err := app.DB.Where("id = ? AND channel_id = ?", keyID, id).First(&key).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "channel key not found"})
+			return
+		}
+		var input struct {
+			Status string `json:"status"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		switch input.Status {
+		case models.ChannelKeyStatusActive:
+			// Re-enabling a key forgets why it was retired.
+			key.LastError = ""
+			key.ExhaustedAt = nil
+		case models.ChannelKeyStatusDisabled:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be 'active' or 'disabled'"})
+			return
+		}
+		key.Status = input.Status
+		if err := app.DB.Save(&key).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update channel key"})
+			return
+		}
+		c.JSON(http.StatusOK, channelKeyView(key))
+	})
+
+	admin.DELETE("/channels/:id/keys/:key_id", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+			return
+		}
+		if err := app.DB.Where("id = ? AND channel_id = ?", keyID, id).Delete(&models.ChannelKey{}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete channel key"})
+			return
+		}
 		c.Status(http.StatusNoContent)
 	})
 
 	// quota rules management
 	admin.GET("/quota_rules", func(c *gin.Context) {
 		var rules []models.QuotaRule
-		if err := app.DB.Order("level ASC, model_pattern ASC").Find(&rules).Error; err != nil {
+		if err := app.DB.Order("level ASC, model_pattern ASC, endpoint ASC").Find(&rules).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list quota rules"})
 			return
 		}
@@ -197,7 +396,7 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 	// model credit rules management
 	admin.GET("/model_credit_rules", func(c *gin.Context) {
 		var rules []models.ModelCreditRule
-		if err := app.DB.Order("model_pattern ASC").Find(&rules).Error; err != nil {
+		if err := app.DB.Order("model_pattern ASC, endpoint ASC").Find(&rules).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list model credit rules"})
 			return
 		}
@@ -211,8 +410,12 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			return
 		}
 		in.ModelPattern = strings.TrimSpace(in.ModelPattern)
-		if in.ModelPattern == "" || in.CreditCost <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "model_pattern and credit_cost are required"})
+		if in.ModelPattern == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "model_pattern is required"})
+			return
+		}
+		if err := validateModelCreditRule(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 		if err := app.DB.Create(&in).Error; err != nil {
@@ -239,8 +442,12 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			return
 		}
 		rule.ModelPattern = strings.TrimSpace(rule.ModelPattern)
-		if rule.ModelPattern == "" || rule.CreditCost <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid model credit rule fields"})
+		if rule.ModelPattern == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "model_pattern is required"})
+			return
+		}
+		if err := validateModelCreditRule(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 		if err := app.DB.Save(&rule).Error; err != nil {
@@ -264,6 +471,74 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 		c.Status(http.StatusNoContent)
 	})
 
+	// response cache rules management
+	admin.GET("/response_cache_rules", func(c *gin.Context) {
+		var rules []models.ResponseCacheRule
+		if err := app.DB.Order("model_pattern ASC, endpoint ASC").Find(&rules).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list response cache rules"})
+			return
+		}
+		c.JSON(http.StatusOK, rules)
+	})
+
+	admin.POST("/response_cache_rules", func(c *gin.Context) {
+		var in models.ResponseCacheRule
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := validateResponseCacheRule(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := app.DB.Create(&in).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create response cache rule"})
+			return
+		}
+		c.JSON(http.StatusOK, in)
+	})
+
+	admin.PUT("/response_cache_rules/:id", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var rule models.ResponseCacheRule
+		if err := app.DB.First(&rule, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "response cache rule not found"})
+			return
+		}
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := validateResponseCacheRule(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := app.DB.Save(&rule).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update response cache rule"})
+			return
+		}
+		c.JSON(http.StatusOK, rule)
+	})
+
+	admin.DELETE("/response_cache_rules/:id", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := app.DB.Delete(&models.ResponseCacheRule{}, id).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete response cache rule"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
 	admin.GET("/check_in/reward_options", func(c *gin.Context) {
 		var options []models.CheckInRewardOption
 		if err := app.DB.Order("sort_order ASC, id ASC").Find(&options).Error; err != nil {
@@ -346,7 +621,8 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		if in.Level <= 0 || in.MaxRequests <= 0 || in.WindowSeconds <= 0 || in.ModelPattern == "" {
+		in.Endpoint = strings.TrimSpace(in.Endpoint)
+		if in.Level <= 0 || in.MaxRequests <= 0 || in.WindowSeconds <= 0 || in.ModelPattern == "" || !isRuleEndpoint(in.Endpoint) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quota rule fields"})
 			return
 		}
@@ -373,7 +649,8 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 			return
 		}
-		if rule.Level <= 0 || rule.MaxRequests <= 0 || rule.WindowSeconds <= 0 || rule.ModelPattern == "" {
+		rule.Endpoint = strings.TrimSpace(rule.Endpoint)
+		if rule.Level <= 0 || rule.MaxRequests <= 0 || rule.WindowSeconds <= 0 || rule.ModelPattern == "" || !isRuleEndpoint(rule.Endpoint) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quota rule fields"})
 			return
 		}
@@ -410,15 +687,16 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 		result := make([]gin.H, len(users))
 		for i, u := range users {
 			result[i] = gin.H{
-				"id":               u.ID,
-				"linuxdo_user_id":  u.LinuxDoUserID,
-				"linuxdo_username": u.LinuxDoUsername,
-				"role":             u.Role,
-				"level":            u.Level,
-				"status":           u.Status,
-				"credits":          u.Credits,
-				"created_at":       u.CreatedAt,
-				"updated_at":       u.UpdatedAt,
+				"id":                      u.ID,
+				"linuxdo_user_id":         u.LinuxDoUserID,
+				"linuxdo_username":        u.LinuxDoUsername,
+				"role":                    u.Role,
+				"level":                   u.Level,
+				"status":                  u.Status,
+				"credits":                 u.Credits,
+				"max_concurrent_requests": u.MaxConcurrentRequests,
+				"created_at":              u.CreatedAt,
+				"updated_at":              u.UpdatedAt,
 			}
 		}
 		c.JSON(http.StatusOK, result)
@@ -440,9 +718,10 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 
 		// Only allow updating specific fields
 		var input struct {
-			Role   *string `json:"role"`
-			Level  *int    `json:"level"`
-			Status *string `json:"status"`
+			Role                  *string `json:"role"`
+			Level                 *int    `json:"level"`
+			Status                *string `json:"status"`
+			MaxConcurrentRequests *int    `json:"max_concurrent_requests"`
 		}
 		if err := c.ShouldBindJSON(&input); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
@@ -476,19 +755,29 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			user.Status = *input.Status
 		}
 
+		// Validate and update the concurrency override (0 = level default)
+		if input.MaxConcurrentRequests != nil {
+			if *input.MaxConcurrentRequests < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "max_concurrent_requests must be >= 0"})
+				return
+			}
+			user.MaxConcurrentRequests = *input.MaxConcurrentRequests
+		}
+
 		if err := app.DB.Save(&user).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"id":               user.ID,
-			"linuxdo_user_id":  user.LinuxDoUserID,
-			"linuxdo_username": user.LinuxDoUsername,
-			"role":             user.Role,
-			"level":            user.Level,
-			"status":           user.Status,
-			"updated_at":       user.UpdatedAt,
+			"id":                      user.ID,
+			"linuxdo_user_id":         user.LinuxDoUserID,
+			"linuxdo_username":        user.LinuxDoUsername,
+			"role":                    user.Role,
+			"level":                   user.Level,
+			"status":                  user.Status,
+			"max_concurrent_requests": user.MaxConcurrentRequests,
+			"updated_at":              user.UpdatedAt,
 		})
 	})
 
@@ -545,8 +834,11 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 			return
 		}
 
+		// Token counting calls are free side requests, not generations.
 		var totalRequests int64
-		if err := app.DB.Model(&models.APILog{}).Count(&totalRequests).Error; err != nil {
+		if err := app.DB.Model(&models.APILog{}).
+			Where("endpoint <> ?", endpointMessagesCountTokens).
+			Count(&totalRequests).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count requests"})
 			return
 		}
@@ -587,6 +879,12 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 				db = db.Where("user_id = ?", uid)
 			}
 		}
+		if endpoint := c.Query("endpoint"); endpoint != "" {
+			db = db.Where("endpoint = ?", endpoint)
+		}
+		if requestID := c.Query("request_id"); requestID != "" {
+			db = db.Where("request_id = ?", requestID)
+		}
 
 		var total int64
 		if err := db.Count(&total).Error; err != nil {
@@ -606,6 +904,140 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 		c.JSON(http.StatusOK, gin.H{"total": total, "items": logs})
 	})
 
+	admin.GET("/api_logs/:id/attempts", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var attempts []models.APIAttempt
+		if err := app.DB.Where("api_log_id = ?", id).Order("attempt ASC").Find(&attempts).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list api attempts"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": attempts})
+	})
+
+	admin.GET("/api_logs/:id/payload", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var capture models.PayloadCapture
+		if err := app.DB.Where("api_log_id = ? AND expires_at > ?", id, time.Now()).First(&capture).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "payload capture not found"})
+			return
+		}
+		c.JSON(http.StatusOK, capture)
+	})
+
+	// payload capture rules and captured payloads
+	admin.GET("/payload_capture_rules", func(c *gin.Context) {
+		var rules []models.PayloadCaptureRule
+		if err := app.DB.Order("id ASC").Find(&rules).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list payload capture rules"})
+			return
+		}
+		c.JSON(http.StatusOK, rules)
+	})
+
+	admin.POST("/payload_capture_rules", func(c *gin.Context) {
+		var in models.PayloadCaptureRule
+		if err := c.ShouldBindJSON(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := validatePayloadCaptureRule(&in); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := app.DB.Create(&in).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create payload capture rule"})
+			return
+		}
+		c.JSON(http.StatusOK, in)
+	})
+
+	admin.PUT("/payload_capture_rules/:id", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var rule models.PayloadCaptureRule
+		if err := app.DB.First(&rule, id).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "payload capture rule not found"})
+			return
+		}
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		if err := validatePayloadCaptureRule(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := app.DB.Save(&rule).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update payload capture rule"})
+			return
+		}
+		c.JSON(http.StatusOK, rule)
+	})
+
+	admin.DELETE("/payload_capture_rules/:id", func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := app.DB.Delete(&models.PayloadCaptureRule{}, id).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete payload capture rule"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	admin.GET("/payload_captures", func(c *gin.Context) {
+		page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if err != nil || page <= 0 {
+			page = 1
+		}
+		pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+		if err != nil || pageSize <= 0 || pageSize > 100 {
+			pageSize = 20
+		}
+
+		purgeExpiredPayloadCaptures(app)
+		db := app.DB.Model(&models.PayloadCapture{}).Where("expires_at > ?", time.Now())
+		if uid, err := strconv.Atoi(c.Query("user_id")); err == nil {
+			db = db.Where("user_id = ?", uid)
+		}
+		if model := c.Query("model"); model != "" {
+			db = db.Where("model = ?", model)
+		}
+
+		var total int64
+		if err := db.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count payload captures"})
+			return
+		}
+		// Bodies can be large; the list only links captures to their logs.
+		var captures []models.PayloadCapture
+		if err := db.Omit("request_body", "response_body").Order("created_at DESC").
+			Offset((page - 1) * pageSize).
+			Limit(pageSize).
+			Find(&captures).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list payload captures"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"total": total, "items": captures})
+	})
+
 	admin.GET("/credit_transactions", func(c *gin.Context) {
 		pageStr := c.DefaultQuery("page", "1")
 		pageSizeStr := c.DefaultQuery("page_size", "20")
@@ -626,6 +1058,12 @@ func RegisterAdminRoutes(r *gin.RouterGroup, app *AppContext) {
 				db = db.Where("user_id = ?", uid)
 			}
 		}
+		if requestID := c.Query("request_id"); requestID != "" {
+			db = db.Where("request_id = ?", requestID)
+		}
+		if c.Query("uncollected") == "true" {
+			db = db.Where("uncollected > 0")
+		}
 
 		var total int64
 		if err := db.Count(&total).Error; err != nil {
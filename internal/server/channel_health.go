@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"linuxdo-relay/internal/logger"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+
+	// channelStatsBucket is the granularity of the rolling per-channel
+	// counters, and channelStatsWindow how many buckets are summed up.
+	channelStatsBucket = time.Minute
+	channelStatsWindow = 5
+)
+
+// channelHealth is the circuit breaker state and recent traffic of one
+// channel, as shown to admins.
+type channelHealth struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RecentRequests      int64      `json:"recent_requests"`
+	RecentErrors        int64      `json:"recent_errors"`
+	ErrorRate           float64    `json:"error_rate"`
+	AvgLatencyMs        int64      `json:"avg_latency_ms"`
+	// MinuteRequests and MinuteTokens are what the current minute has used
+	// of the channel's RPM and TPM limits.
+	MinuteRequests int64 `json:"minute_requests"`
+	MinuteTokens   int64 `json:"minute_tokens"`
+}
+
+func breakerKey(channelID uint) string {
+	return fmt.Sprintf("channel:breaker:%d", channelID)
+}
+
+func breakerProbeKey(channelID uint) string {
+	return fmt.Sprintf("channel:probe:%d", channelID)
+}
+
+func channelStatsKey(channelID uint, bucket int64) string {
+	return fmt.Sprintf("channel:stats:%d:%d", channelID, bucket)
+}
+
+func breakerSettings(app *AppContext) (threshold int64, cooldown time.Duration) {
+	threshold, cooldown = 5, 30*time.Second
+	if app.Config != nil {
+		threshold = int64(app.Config.CircuitFailureThreshold)
+		cooldown = time.Duration(app.Config.CircuitCooldownSeconds) * time.Second
+	}
+	return threshold, cooldown
+}
+
+// isChannelFailure reports whether an upstream outcome counts against the
+// channel's health: transport errors, 5xx and 429. Other 4xx answers are the
+// client's fault and do not trip the breaker.
+func isChannelFailure(statusCode int, err error) bool {
+	return err != nil || statusCode >= 500 || statusCode == 429
+}
+
+// allowChannel reports whether a request may be sent to the channel.
+//
+// Closed breakers always allow. An open breaker rejects until its cooldown has
+// passed; after that exactly one caller wins the half-open probe and is let
+// through, while everybody else keeps skipping the channel until the probe
+// outcome is recorded. Redis errors fail open.
+func allowChannel(app *AppContext, channelID uint) bool {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return true
+	}
+	threshold, cooldown := breakerSettings(app)
+	if threshold <= 0 {
+		return true
+	}
+
+	ctx := context.Background()
+	vals, err := app.Redis.HGetAll(ctx, breakerKey(channelID)).Result()
+	if err != nil {
+		logger.Error("breaker: redis error", "error", err, "channelID", channelID)
+		return true
+	}
+	state := vals["state"]
+	if state == "" || state == breakerClosed {
+		return true
+	}
+
+	openedAt, _ := strconv.ParseInt(vals["opened_at"], 10, 64)
+	if time.Since(time.Unix(openedAt, 0)) < cooldown {
+		return false
+	}
+
+	// Cooldown elapsed: only one request gets to probe. The probe lock expires
+	// after another cooldown in case its outcome is never recorded.
+	won, err := app.Redis.SetNX(ctx, breakerProbeKey(channelID), 1, cooldown).Result()
+	if err != nil {
+		logger.Error("breaker: redis error", "error", err, "channelID", channelID)
+		return true
+	}
+	if !won {
+		return false
+	}
+	_ = app.Redis.HSet(ctx, breakerKey(channelID), "state", breakerHalfOpen).Err()
+	return true
+}
+
+// releaseChannelProbe frees a half-open channel's probe when the probing
+// attempt ended without an outcome, so the next request probes instead of
+// waiting for the lock to expire.
+func releaseChannelProbe(app *AppContext, channelID uint) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return
+	}
+	ctx := context.Background()
+	if state, _ := app.Redis.HGet(ctx, breakerKey(channelID), "state").Result(); state != breakerHalfOpen {
+		return
+	}
+	if err := app.Redis.Del(ctx, breakerProbeKey(channelID)).Err(); err != nil {
+		logger.Error("breaker: redis error", "error", err, "channelID", channelID)
+	}
+}
+
+// recordChannelResult feeds one upstream attempt into the channel's rolling
+// stats and circuit breaker.
+func recordChannelResult(app *AppContext, channelID uint, statusCode int, err error, latency time.Duration) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return
+	}
+	ctx := context.Background()
+	failed := isChannelFailure(statusCode, err)
+
+	bucket := time.Now().Unix() / int64(channelStatsBucket/time.Second)
+	statsKey := channelStatsKey(channelID, bucket)
+	_, redisErr := app.Redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.HIncrBy(ctx, statsKey, "requests", 1)
+		if failed {
+			p.HIncrBy(ctx, statsKey, "errors", 1)
+		}
+		p.HIncrBy(ctx, statsKey, "latency_ms", latency.Milliseconds())
+		p.Expire(ctx, statsKey, channelStatsBucket*(channelStatsWindow+1))
+		return nil
+	})
+	if redisErr != nil {
+		logger.Error("breaker: failed to record stats", "error", redisErr, "channelID", channelID)
+	}
+
+	threshold, _ := breakerSettings(app)
+	if threshold <= 0 {
+		return
+	}
+	key := breakerKey(channelID)
+	if !failed {
+		// Any success closes the breaker, including a half-open probe.
+		_ = app.Redis.HSet(ctx, key, "state", breakerClosed, "failures", 0).Err()
+		_ = app.Redis.Del(ctx, breakerProbeKey(channelID)).Err()
+		return
+	}
+
+	failures, redisErr := app.Redis.HIncrBy(ctx, key, "failures", 1).Result()
+	if redisErr != nil {
+		logger.Error("breaker: redis error", "error", redisErr, "channelID", channelID)
+		return
+	}
+	state, _ := app.Redis.HGet(ctx, key, "state").Result()
+	if state == breakerHalfOpen || (state != breakerOpen && failures >= threshold) {
+		_ = app.Redis.HSet(ctx, key, "state", breakerOpen, "opened_at", time.Now().Unix()).Err()
+		_ = app.Redis.Del(ctx, breakerProbeKey(channelID)).Err()
+		logger.Warn("breaker: channel opened", "channelID", channelID, "failures", failures)
+	}
+}
+
+// loadChannelHealth reads the breaker state and the last few minutes of
+// stats for a channel.
+func loadChannelHealth(app *AppContext, channelID uint) channelHealth {
+	health := channelHealth{State: breakerClosed}
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return health
+	}
+	ctx := context.Background()
+
+	if vals, err := app.Redis.HGetAll(ctx, breakerKey(channelID)).Result(); err == nil {
+		if s := vals["state"]; s != "" {
+			health.State = s
+		}
+		health.ConsecutiveFailures, _ = strconv.ParseInt(vals["failures"], 10, 64)
+		if ts, err := strconv.ParseInt(vals["opened_at"], 10, 64); err == nil && health.State != breakerClosed {
+			openedAt := time.Unix(ts, 0)
+			health.OpenedAt = &openedAt
+		}
+	}
+
+	var latencyMs int64
+	bucket := time.Now().Unix() / int64(channelStatsBucket/time.Second)
+	for i := int64(0); i < channelStatsWindow; i++ {
+		vals, err := app.Redis.HGetAll(ctx, channelStatsKey(channelID, bucket-i)).Result()
+		if err != nil {
+			continue
+		}
+		requests, _ := strconv.ParseInt(vals["requests"], 10, 64)
+		errs, _ := strconv.ParseInt(vals["errors"], 10, 64)
+		latency, _ := strconv.ParseInt(vals["latency_ms"], 10, 64)
+		health.RecentRequests += requests
+		health.RecentErrors += errs
+		latencyMs += latency
+	}
+	health.MinuteRequests, health.MinuteTokens = loadChannelRate(app, channelID)
+	if health.RecentRequests > 0 {
+		health.ErrorRate = float64(health.RecentErrors) / float64(health.RecentRequests)
+		health.AvgLatencyMs = latencyMs / health.RecentRequests
+	}
+	return health
+}
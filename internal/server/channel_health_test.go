@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsChannelFailure(t *testing.T) {
+	cases := []struct {
+		status   int
+		err      error
+		expected bool
+	}{
+		{200, nil, false},
+		{400, nil, false},
+		{404, nil, false},
+		{429, nil, true},
+		{500, nil, true},
+		{503, nil, true},
+		{0, errors.New("connection reset"), true},
+	}
+
+	for _, tc := range cases {
+		if got := isChannelFailure(tc.status, tc.err); got != tc.expected {
+			t.Fatalf("status %d err %v: expected %v, got %v", tc.status, tc.err, tc.expected, got)
+		}
+	}
+}
+
+func TestChannelBreakerWithoutRedisFailsOpen(t *testing.T) {
+	app := &AppContext{}
+	if !allowChannel(app, 1) {
+		t.Fatalf("channels must be allowed when redis is unavailable")
+	}
+	if h := loadChannelHealth(app, 1); h.State != breakerClosed {
+		t.Fatalf("expected closed state without redis, got %s", h.State)
+	}
+}
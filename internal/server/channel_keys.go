@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"linuxdo-relay/internal/logger"
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// maxKeyErrorPeek caps how much of an upstream error body is read to decide
+// whether the key that caused it is exhausted.
+const maxKeyErrorPeek = 16 << 10
+
+// exhaustedKeyMarkers are error codes and messages upstreams use for a key
+// that is invalid or out of quota, compared lowercased.
+var exhaustedKeyMarkers = []string{
+	"invalid_api_key",
+	"api_key_invalid",
+	"insufficient_quota",
+	"insufficient_user_quota",
+	"account_deactivated",
+	"billing_not_active",
+	"credit balance is too low",
+}
+
+func channelKeyCursorKey(channelID uint) string {
+	return fmt.Sprintf("channel:key_rr:%d", channelID)
+}
+
+// loadChannelKeys returns the keys of a channel, in id order.
+func loadChannelKeys(app *AppContext, channelID uint) ([]models.ChannelKey, error) {
+	var keys []models.ChannelKey
+	err := app.DB.Where("channel_id = ?", channelID).Order("id ASC").Find(&keys).Error
+	return keys, err
+}
+
+// activeChannelKeys filters keys down to the active ones.
+func activeChannelKeys(keys []models.ChannelKey) []models.ChannelKey {
+	out := make([]models.ChannelKey, 0, len(keys))
+	for _, k := range keys {
+		if k.Status == models.ChannelKeyStatusActive {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// drainedChannels returns the channels among ids that have keys but none of
+// them active. They cannot send anything until an admin adds or re-enables a
+// key. Channels without keys use their own APIKey and are never drained.
+func drainedChannels(app *AppContext, ids []uint) map[uint]bool {
+	drained := map[uint]bool{}
+	if app == nil || app.DB == nil || len(ids) == 0 {
+		return drained
+	}
+	var keys []models.ChannelKey
+	if err := app.DB.Select("channel_id", "status").Where("channel_id IN ?", ids).Find(&keys).Error; err != nil {
+		logger.Error("channel keys: failed to load", "error", err)
+		return drained
+	}
+	active := map[uint]bool{}
+	for _, k := range keys {
+		active[k.ChannelID] = active[k.ChannelID] || k.Status == models.ChannelKeyStatusActive
+	}
+	for id, ok := range active {
+		if !ok {
+			drained[id] = true
+		}
+	}
+	return drained
+}
+
+// selectChannelKey picks one of the active keys by rotation: the key with the
+// fewest requests for least_used, otherwise the key at cursor, wrapping
+// around. preferred wins when it is among keys.
+func selectChannelKey(keys []models.ChannelKey, rotation string, cursor int64, preferred uint) *models.ChannelKey {
+	if len(keys) == 0 {
+		return nil
+	}
+	for i := range keys {
+		if preferred != 0 && keys[i].ID == preferred {
+			return &keys[i]
+		}
+	}
+	if rotation == models.ChannelKeyRotationLeastUsed {
+		best := &keys[0]
+		for i := range keys[1:] {
+			if keys[i+1].RequestCount < best.RequestCount {
+				best = &keys[i+1]
+			}
+		}
+		return best
+	}
+	if cursor < 0 {
+		cursor = -cursor
+	}
+	return &keys[cursor%int64(len(keys))]
+}
+
+// assignChannelKey sets ch.APIKey to the key the next request to ch should
+// use and returns that key's id. Channels without keys keep their own APIKey
+// and get id 0. preferred, when active, is used regardless of rotation so a
+// Responses API conversation stays on the key that holds its state.
+func assignChannelKey(app *AppContext, ch *models.Channel, preferred uint) uint {
+	if app == nil || app.DB == nil {
+		return 0
+	}
+	keys, err := loadChannelKeys(app, ch.ID)
+	if err != nil {
+		logger.Error("channel keys: failed to load", "error", err, "channelID", ch.ID)
+		return 0
+	}
+	active := activeChannelKeys(keys)
+	if len(keys) == 0 || len(active) == 0 {
+		return 0
+	}
+	var cursor int64
+	if ch.KeyRotation != models.ChannelKeyRotationLeastUsed {
+		cursor = int64(rand.IntN(len(active)))
+		if app.Redis != nil && app.Redis.Client != nil {
+			if n, err := app.Redis.Incr(context.Background(), channelKeyCursorKey(ch.ID)).Result(); err == nil {
+				cursor = n - 1
+			}
+		}
+	}
+	key := selectChannelKey(active, ch.KeyRotation, cursor, preferred)
+	ch.APIKey = key.APIKey
+	return key.ID
+}
+
+// channelHasActiveKey reports whether the channel still has an active key
+// to fall back to.
+func channelHasActiveKey(app *AppContext, channelID uint) bool {
+	var n int64
+	err := app.DB.Model(&models.ChannelKey{}).
+		Where("channel_id = ? AND status = ?", channelID, models.ChannelKeyStatusActive).Count(&n).Error
+	return err == nil && n > 0
+}
+
+// keyExhausted reports whether an upstream error answer means the key is
+// unusable: any 401 or 402, or an error body naming an invalid key or an
+// exhausted quota.
+func keyExhausted(statusCode int, body []byte) bool {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusPaymentRequired {
+		return true
+	}
+	if statusCode < 400 {
+		return false
+	}
+	lower := strings.ToLower(string(body))
+	for _, m := range exhaustedKeyMarkers {
+		if strings.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordChannelKeyResult counts an attempt against the key it used and
+// retires the key when upstream rejected it as invalid or out of quota. It
+// reports whether the key was retired.
+func recordChannelKeyResult(app *AppContext, keyID uint, resp *http.Response) bool {
+	if keyID == 0 || app == nil || app.DB == nil {
+		return false
+	}
+	now := time.Now()
+	updates := map[string]interface{}{
+		"request_count": gorm.Expr("request_count + 1"),
+		"last_used_at":  now,
+	}
+	exhausted := false
+	if resp != nil && resp.StatusCode >= 400 {
+		body := relay.PeekBody(resp, maxKeyErrorPeek)
+		if keyExhausted(resp.StatusCode, body) {
+			exhausted = true
+			updates["status"] = models.ChannelKeyStatusExhausted
+			updates["exhausted_at"] = now
+			updates["last_error"] = fmt.Sprintf("%d %s", resp.StatusCode, relay.UpstreamErrorMessage(body))
+		}
+	}
+	if err := app.DB.Model(&models.ChannelKey{}).Where("id = ?", keyID).Updates(updates).Error; err != nil {
+		logger.Error("channel keys: failed to record use", "error", err, "keyID", keyID)
+	}
+	if exhausted {
+		logger.Warn("channel keys: key exhausted", "keyID", keyID, "status", resp.StatusCode)
+	}
+	return exhausted
+}
+
+// maskAPIKey shows only the ends of a key to admins.
+func maskAPIKey(key string) string {
+	if len(key) <= 10 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:6] + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+
+	"linuxdo-relay/internal/models"
+)
+
+func TestSelectChannelKey(t *testing.T) {
+	keys := []models.ChannelKey{
+		{ID: 1, RequestCount: 30},
+		{ID: 2, RequestCount: 10},
+		{ID: 3, RequestCount: 20},
+	}
+	cases := []struct {
+		rotation  string
+		cursor    int64
+		preferred uint
+		want      uint
+	}{
+		{models.ChannelKeyRotationRoundRobin, 0, 0, 1},
+		{models.ChannelKeyRotationRoundRobin, 1, 0, 2},
+		{models.ChannelKeyRotationRoundRobin, 5, 0, 3},
+		{models.ChannelKeyRotationLeastUsed, 0, 0, 2},
+		{models.ChannelKeyRotationLeastUsed, 0, 3, 3},
+		{models.ChannelKeyRotationRoundRobin, 0, 9, 1},
+	}
+	for _, tc := range cases {
+		got := selectChannelKey(keys, tc.rotation, tc.cursor, tc.preferred)
+		if got == nil || got.ID != tc.want {
+			t.Fatalf("rotation %q cursor %d preferred %d: expected key %d, got %+v", tc.rotation, tc.cursor, tc.preferred, tc.want, got)
+		}
+	}
+	if selectChannelKey(nil, "", 0, 0) != nil {
+		t.Fatalf("expected no key from an empty pool")
+	}
+}
+
+func TestKeyExhausted(t *testing.T) {
+	cases := []struct {
+		status   int
+		body     string
+		expected bool
+	}{
+		{401, `{"error":{"message":"bad key"}}`, true},
+		{402, ``, true},
+		{429, `{"error":{"code":"insufficient_quota","message":"You exceeded your current quota"}}`, true},
+		{429, `{"error":{"code":"rate_limit_exceeded"}}`, false},
+		{400, `{"error":{"status":"INVALID_ARGUMENT","details":[{"reason":"API_KEY_INVALID"}]}}`, true},
+		{400, `{"type":"error","error":{"message":"Your credit balance is too low"}}`, true},
+		{400, `{"error":{"message":"messages is required"}}`, false},
+		{500, `{"error":{"message":"internal"}}`, false},
+	}
+	for _, tc := range cases {
+		if got := keyExhausted(tc.status, []byte(tc.body)); got != tc.expected {
+			t.Fatalf("status %d body %s: expected %v, got %v", tc.status, tc.body, tc.expected, got)
+		}
+	}
+}
+
+func TestMaskAPIKey(t *testing.T) {
+	if got := maskAPIKey("sk-abcdefghijklmnop"); got != "sk-abc...mnop" {
+		t.Fatalf("unexpected mask %q", got)
+	}
+	if got := maskAPIKey("short"); got != "*****" {
+		t.Fatalf("unexpected mask %q", got)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"linuxdo-relay/internal/logger"
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// channelQueuePoll is how often a queued request looks for a channel again.
+const channelQueuePoll = 250 * time.Millisecond
+
+// errChannelsSaturated is returned by pickChannelForModel when the only
+// thing keeping a request off the remaining channels is their RPM/TPM limit.
+var errChannelsSaturated = errors.New("all channels are at their rate limit")
+
+// takeChannelRateScript claims one request of a channel's per-minute budget
+// unless the minute's requests or tokens already reached the limit. It
+// returns 1 when the request was counted.
+//
+// KEYS[1] minute counter, ARGV[1] RPM limit, ARGV[2] TPM limit.
+var takeChannelRateScript = redis.NewScript(`
+local v = redis.call('HMGET', KEYS[1], 'requests', 'tokens')
+local requests = tonumber(v[1]) or 0
+local tokens = tonumber(v[2]) or 0
+local rpm = tonumber(ARGV[1])
+local tpm = tonumber(ARGV[2])
+if (rpm > 0 and requests >= rpm) or (tpm > 0 and tokens >= tpm) then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'requests', 1)
+redis.call('EXPIRE', KEYS[1], 120)
+return 1
+`)
+
+// releaseChannelRateScript gives back a request claimed by
+// takeChannelRateScript, never going below zero.
+//
+// KEYS[1] minute counter.
+var releaseChannelRateScript = redis.NewScript(`
+local requests = tonumber(redis.call('HGET', KEYS[1], 'requests')) or 0
+if requests > 0 then
+	redis.call('HINCRBY', KEYS[1], 'requests', -1)
+end
+return 1
+`)
+
+func channelRateKey(channelID uint, minute int64) string {
+	return fmt.Sprintf("channel:rate:%d:%d", channelID, minute)
+}
+
+func currentMinute() int64 {
+	return time.Now().Unix() / 60
+}
+
+// channelRateLimited reports whether ch has an RPM or TPM limit.
+func channelRateLimited(ch *models.Channel) bool {
+	return ch.RPMLimit > 0 || ch.TPMLimit > 0
+}
+
+// takeChannelRate counts a request against ch's per-minute limits and
+// reports whether it fits, along with the minute it was counted in. Tokens
+// are only known once a request finishes, so the TPM limit admits requests
+// until the minute's recorded tokens reach it. Channels without limits always
+// pass, and Redis errors fail open.
+func takeChannelRate(app *AppContext, ch *models.Channel) (minute int64, ok bool) {
+	minute = currentMinute()
+	if !channelRateLimited(ch) || app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return minute, true
+	}
+	key := channelRateKey(ch.ID, minute)
+	taken, err := takeChannelRateScript.Run(context.Background(), app.Redis.Client, []string{key}, ch.RPMLimit, ch.TPMLimit).Int()
+	if err != nil {
+		logger.Error("channel rate: redis error", "error", err, "channelID", ch.ID)
+		return minute, true
+	}
+	return minute, taken == 1
+}
+
+// releaseChannelRate gives back the request takeChannelRate counted for ch in
+// minute, for a channel that was not used after all. Passing the minute the
+// request was taken in keeps a release that crosses a minute boundary from
+// freeing a slot in the next minute instead.
+func releaseChannelRate(app *AppContext, ch *models.Channel, minute int64) {
+	if !channelRateLimited(ch) || app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return
+	}
+	key := channelRateKey(ch.ID, minute)
+	if err := releaseChannelRateScript.Run(context.Background(), app.Redis.Client, []string{key}).Err(); err != nil {
+		logger.Error("channel rate: failed to release request", "error", err, "channelID", ch.ID)
+	}
+}
+
+// recordChannelTokens adds the tokens a finished request used to ch's current
+// minute.
+func recordChannelTokens(app *AppContext, ch *models.Channel, usage relay.Usage) {
+	if !channelRateLimited(ch) || usage.TotalTokens() <= 0 || app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return
+	}
+	ctx := context.Background()
+	key := channelRateKey(ch.ID, currentMinute())
+	_, err := app.Redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+		p.HIncrBy(ctx, key, "tokens", int64(usage.TotalTokens()))
+		p.Expire(ctx, key, 2*time.Minute)
+		return nil
+	})
+	if err != nil {
+		logger.Error("channel rate: failed to record tokens", "error", err, "channelID", ch.ID)
+	}
+}
+
+// loadChannelRate returns the requests and tokens sent to a channel in the
+// current minute.
+func loadChannelRate(app *AppContext, channelID uint) (requests, tokens int64) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return 0, 0
+	}
+	vals, err := app.Redis.HGetAll(context.Background(), channelRateKey(channelID, currentMinute())).Result()
+	if err != nil {
+		return 0, 0
+	}
+	requests, _ = strconv.ParseInt(vals["requests"], 10, 64)
+	tokens, _ = strconv.ParseInt(vals["tokens"], 10, 64)
+	return requests, tokens
+}
+
+// channelQueueTimeout returns how long a request may wait for a saturated
+// channel.
+func channelQueueTimeout(app *AppContext) time.Duration {
+	if app == nil || app.Config == nil {
+		return 0
+	}
+	return time.Duration(app.Config.ChannelQueueTimeoutMs) * time.Millisecond
+}
+
+// pickChannelQueued picks the first channel for a request. When every
+// candidate is held back only by its rate limits, the request is queued:
+// it polls again until a channel frees up, the queue timeout passes or the
+// client goes away.
+func pickChannelQueued(c *gin.Context, app *AppContext, req relayRequest, level int) (*models.Channel, error) {
+	return waitForChannel(c.Request.Context(), channelQueueTimeout(app), channelQueuePoll, func() (*models.Channel, error) {
+		return pickChannelForModel(app, req, level, nil)
+	})
+}
+
+// waitForChannel calls pick every poll until it returns anything other than
+// errChannelsSaturated, timeout passes or ctx is done, in which case the last
+// saturated error is returned.
+func waitForChannel(ctx context.Context, timeout, poll time.Duration, pick func() (*models.Channel, error)) (*models.Channel, error) {
+	ch, err := pick()
+	if !errors.Is(err, errChannelsSaturated) {
+		return ch, err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !waitBackoff(ctx, min(poll, time.Until(deadline))) {
+			return nil, err
+		}
+		ch, err = pick()
+		if !errors.Is(err, errChannelsSaturated) {
+			return ch, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+func TestChannelRateLimited(t *testing.T) {
+	cases := []struct {
+		ch       models.Channel
+		expected bool
+	}{
+		{models.Channel{}, false},
+		{models.Channel{RPMLimit: 60}, true},
+		{models.Channel{TPMLimit: 100000}, true},
+	}
+	for _, tc := range cases {
+		if got := channelRateLimited(&tc.ch); got != tc.expected {
+			t.Fatalf("rpm %d tpm %d: expected %v, got %v", tc.ch.RPMLimit, tc.ch.TPMLimit, tc.expected, got)
+		}
+	}
+}
+
+func TestChannelRateWithoutRedisFailsOpen(t *testing.T) {
+	app := &AppContext{}
+	ch := &models.Channel{ID: 1, RPMLimit: 1, TPMLimit: 1}
+	for i := 0; i < 3; i++ {
+		if _, ok := takeChannelRate(app, ch); !ok {
+			t.Fatalf("channels must be allowed when redis is unavailable")
+		}
+	}
+	if requests, tokens := loadChannelRate(app, 1); requests != 0 || tokens != 0 {
+		t.Fatalf("expected empty usage without redis, got %d/%d", requests, tokens)
+	}
+}
+
+func TestTakeChannelRateStopsAtRPM(t *testing.T) {
+	app := &AppContext{Redis: newTestRedis(t)}
+	ch := &models.Channel{ID: 1, RPMLimit: 2}
+	for i := 0; i < 2; i++ {
+		if _, ok := takeChannelRate(app, ch); !ok {
+			t.Fatalf("request %d: expected to fit rpm 2", i)
+		}
+	}
+	if _, ok := takeChannelRate(app, ch); ok {
+		t.Fatalf("expected the third request to be turned away")
+	}
+	if requests, _ := loadChannelRate(app, 1); requests != 2 {
+		t.Fatalf("expected a rejected request not to be counted, got %d", requests)
+	}
+}
+
+func TestTakeChannelRateStopsAtTPM(t *testing.T) {
+	app := &AppContext{Redis: newTestRedis(t)}
+	ch := &models.Channel{ID: 1, TPMLimit: 100}
+	if _, ok := takeChannelRate(app, ch); !ok {
+		t.Fatalf("expected a request to fit before any tokens are recorded")
+	}
+	recordChannelTokens(app, ch, relay.Usage{PromptTokens: 60, CompletionTokens: 40})
+	if _, ok := takeChannelRate(app, ch); ok {
+		t.Fatalf("expected requests to be turned away once tpm is reached")
+	}
+}
+
+func TestReleaseChannelRateGivesBackTakenMinute(t *testing.T) {
+	app := &AppContext{Redis: newTestRedis(t)}
+	ch := &models.Channel{ID: 1, RPMLimit: 1}
+	minute, ok := takeChannelRate(app, ch)
+	if !ok {
+		t.Fatalf("expected the first request to fit")
+	}
+	ctx := context.Background()
+	next := channelRateKey(1, minute+1)
+	if err := app.Redis.HSet(ctx, next, "requests", 1).Err(); err != nil {
+		t.Fatalf("seed next minute: %v", err)
+	}
+
+	releaseChannelRate(app, ch, minute)
+	if got, _ := app.Redis.HGet(ctx, channelRateKey(1, minute), "requests").Int(); got != 0 {
+		t.Fatalf("expected the taken minute to be released, got %d", got)
+	}
+	if got, _ := app.Redis.HGet(ctx, next, "requests").Int(); got != 1 {
+		t.Fatalf("expected the next minute to be untouched, got %d", got)
+	}
+
+	releaseChannelRate(app, ch, minute)
+	if got, _ := app.Redis.HGet(ctx, channelRateKey(1, minute), "requests").Int(); got != 0 {
+		t.Fatalf("expected release not to go below zero, got %d", got)
+	}
+}
+
+func TestWaitForChannelReturnsFreedChannel(t *testing.T) {
+	saturated := fmt.Errorf("%w for model m", errChannelsSaturated)
+	calls := 0
+	ch, err := waitForChannel(context.Background(), time.Second, time.Millisecond, func() (*models.Channel, error) {
+		calls++
+		if calls < 3 {
+			return nil, saturated
+		}
+		return &models.Channel{ID: 1}, nil
+	})
+	if err != nil || ch == nil || ch.ID != 1 {
+		t.Fatalf("expected channel 1 once it frees up, got %+v, %v", ch, err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 picks, got %d", calls)
+	}
+}
+
+func TestWaitForChannelTimesOut(t *testing.T) {
+	saturated := fmt.Errorf("%w for model m", errChannelsSaturated)
+	start := time.Now()
+	ch, err := waitForChannel(context.Background(), 50*time.Millisecond, 10*time.Millisecond, func() (*models.Channel, error) {
+		return nil, saturated
+	})
+	if ch != nil || !errors.Is(err, errChannelsSaturated) {
+		t.Fatalf("expected a saturated error after the timeout, got %+v, %v", ch, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected to wait about the timeout, waited %v", elapsed)
+	}
+}
+
+func TestWaitForChannelStopsWhenCanceled(t *testing.T) {
+	saturated := fmt.Errorf("%w for model m", errChannelsSaturated)
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	ch, err := waitForChannel(ctx, time.Minute, 10*time.Millisecond, func() (*models.Channel, error) {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return nil, saturated
+	})
+	if ch != nil || !errors.Is(err, errChannelsSaturated) {
+		t.Fatalf("expected a saturated error on cancel, got %+v, %v", ch, err)
+	}
+	if calls != 2 || time.Since(start) > time.Second {
+		t.Fatalf("expected to stop right after the cancel, picked %d times in %v", calls, time.Since(start))
+	}
+}
+
+func TestWaitForChannelDoesNotQueueOtherErrors(t *testing.T) {
+	calls := 0
+	_, err := waitForChannel(context.Background(), time.Minute, time.Millisecond, func() (*models.Channel, error) {
+		calls++
+		return nil, errors.New("no channel supports model m")
+	})
+	if err == nil || errors.Is(err, errChannelsSaturated) || calls != 1 {
+		t.Fatalf("expected the error to be returned at once, got %v after %d picks", err, calls)
+	}
+}
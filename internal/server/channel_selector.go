@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+
+	"linuxdo-relay/internal/models"
+)
+
+// pickChannelForModel selects an enabled channel open to the user level whose
+// models JSON list contains the requested model name. Among the matching channels only the
+// highest priority tier is considered, and one channel is drawn from it at
+// random in proportion to its weight. Channels in exclude (already tried by a
+// failing attempt) are skipped, as are channels whose circuit breaker is open
+// or whose RPM/TPM limit is reached, so failover, tripped and saturated
+// channels all fall through to lower tiers. Channels whose format cannot serve
+// the request's endpoint are never candidates, nor are channels whose keys
+// are all exhausted or disabled. When saturated channels were the only ones
+// left, the error wraps errChannelsSaturated.
+func pickChannelForModel(app *AppContext, req relayRequest, level int, exclude map[uint]bool) (*models.Channel, error) {
+	model := req.Model
+	channels, err := channelsForModel(app, model, level)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(channels))
+	for i := range channels {
+		ids[i] = channels[i].ID
+	}
+	drained := drainedChannels(app, ids)
+	candidates := channels[:0]
+	for _, ch := range channels {
+		if !exclude[ch.ID] && !drained[ch.ID] && channelSupportsEndpoint(&ch, req.Endpoint) {
+			candidates = append(candidates, ch)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no channel supports model %s", model)
+	}
+
+	ch, saturated := drawChannel(candidates, channelGateFor(app), rand.IntN)
+	if ch != nil {
+		return ch, nil
+	}
+	if saturated {
+		return nil, fmt.Errorf("%w for model %s", errChannelsSaturated, model)
+	}
+	return nil, fmt.Errorf("no available channel for model %s", model)
+}
+
+// channelGate holds the checks a drawn channel must pass before it is used.
+// They are injected so tests can stand in for Redis.
+type channelGate struct {
+	takeRate    func(ch *models.Channel) (minute int64, ok bool)
+	releaseRate func(ch *models.Channel, minute int64)
+	allow       func(ch *models.Channel) bool
+}
+
+// channelGateFor returns the rate limit and breaker checks backed by app.
+func channelGateFor(app *AppContext) channelGate {
+	return channelGate{
+		takeRate:    func(ch *models.Channel) (int64, bool) { return takeChannelRate(app, ch) },
+		releaseRate: func(ch *models.Channel, minute int64) { releaseChannelRate(app, ch, minute) },
+		allow:       func(ch *models.Channel) bool { return allowChannel(app, ch.ID) },
+	}
+}
+
+// drawChannel draws from candidates until one passes its rate limit and
+// breaker, and reports whether a rate limit turned any channel away. Only the
+// drawn channel is checked so an unused half-open probe is never claimed; the
+// rate limit goes first for the same reason, and its slot is given back, in
+// the minute it was taken from, when the breaker then rejects the channel.
+func drawChannel(candidates []models.Channel, gate channelGate, randIntn func(n int) int) (*models.Channel, bool) {
+	saturated := false
+	for len(candidates) > 0 {
+		ch := selectWeightedChannel(candidates, randIntn)
+		minute, ok := gate.takeRate(ch)
+		if !ok {
+			saturated = true
+		} else if gate.allow(ch) {
+			return ch, saturated
+		} else {
+			gate.releaseRate(ch, minute)
+		}
+		candidates = removeChannel(candidates, ch.ID)
+	}
+	return nil, saturated
+}
+
+func removeChannel(channels []models.Channel, id uint) []models.Channel {
+	out := make([]models.Channel, 0, len(channels))
+	for _, ch := range channels {
+		if ch.ID != id {
+			out = append(out, ch)
+		}
+	}
+	return out
+}
+
+// channelsForModel loads every enabled channel open to level that lists
+// model.
+func channelsForModel(app *AppContext, model string, level int) ([]models.Channel, error) {
+	channels, err := channelsForLevel(app, level)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]models.Channel, 0, len(channels))
+	for i := range channels {
+		if channelServesModel(&channels[i], model) {
+			matched = append(matched, channels[i])
+		}
+	}
+	return matched, nil
+}
+
+// channelsForLevel loads every enabled channel a user of the given level may
+// use.
+func channelsForLevel(app *AppContext, level int) ([]models.Channel, error) {
+	var channels []models.Channel
+	if err := app.DB.Where("status = ? AND min_level <= ?", models.ChannelStatusEn, level).
+		Order("id ASC").Find(&channels).Error; err != nil {
+		return nil, fmt.Errorf("no available channel")
+	}
+	return channels, nil
+}
+
+// channelModels returns the models JSON list of a channel, or nil when it is
+// malformed.
+func channelModels(ch *models.Channel) []string {
+	var ms []string
+	if err := json.Unmarshal([]byte(ch.Models), &ms); err != nil {
+		return nil
+	}
+	return ms
+}
+
+// channelServesModel reports whether the channel's models JSON list contains
+// model.
+func channelServesModel(ch *models.Channel, model string) bool {
+	for _, m := range channelModels(ch) {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// channelSupportsEndpoint reports whether a channel of ch's format can serve
+// endpoint. Native channels take their own endpoints and, translated, OpenAI
+// chat completions; OpenAI channels take the OpenAI endpoints and, translated,
+// Anthropic messages.
+func channelSupportsEndpoint(ch *models.Channel, endpoint string) bool {
+	switch ch.Format {
+	case models.ChannelFormatOpenAI:
+		return !geminiMethods[endpoint] && endpoint != endpointMessagesCountTokens
+	case models.ChannelFormatAnthropic:
+		return endpoint == endpointMessages || endpoint == endpointMessagesCountTokens || endpoint == endpointChatCompletions
+	case models.ChannelFormatGemini:
+		return geminiMethods[endpoint] || endpoint == endpointChatCompletions
+	default:
+		return true
+	}
+}
+
+// selectWeightedChannel does a weighted random pick within the highest
+// priority tier of candidates. randIntn must return a value in [0, n); it is
+// injected so tests can be deterministic. Channels with a non-positive weight
+// count as weight 1.
+func selectWeightedChannel(candidates []models.Channel, randIntn func(n int) int) *models.Channel {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	topPriority := candidates[0].Priority
+	for _, ch := range candidates[1:] {
+		if ch.Priority > topPriority {
+			topPriority = ch.Priority
+		}
+	}
+
+	tier := make([]*models.Channel, 0, len(candidates))
+	total := 0
+	for i := range candidates {
+		if candidates[i].Priority != topPriority {
+			continue
+		}
+		tier = append(tier, &candidates[i])
+		total += channelWeight(&candidates[i])
+	}
+
+	n := randIntn(total)
+	for _, ch := range tier {
+		n -= channelWeight(ch)
+		if n < 0 {
+			return ch
+		}
+	}
+	return tier[len(tier)-1]
+}
+
+func channelWeight(ch *models.Channel) int {
+	if ch.Weight <= 0 {
+		return 1
+	}
+	return ch.Weight
+}
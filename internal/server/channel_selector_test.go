@@ -0,0 +1,99 @@
+package server
+
+import (
+	"testing"
+
+	"linuxdo-relay/internal/models"
+)
+
+func TestSelectWeightedChannelUsesHighestPriorityTier(t *testing.T) {
+	candidates := []models.Channel{
+		{ID: 1, Priority: 0, Weight: 100},
+		{ID: 2, Priority: 10, Weight: 1},
+		{ID: 3, Priority: 10, Weight: 3},
+	}
+
+	counts := map[uint]int{}
+	for n := 0; n < 4; n++ {
+		ch := selectWeightedChannel(candidates, func(int) int { return n })
+		counts[ch.ID]++
+	}
+
+	if counts[1] != 0 {
+		t.Fatalf("low priority channel should never be picked, got %d", counts[1])
+	}
+	if counts[2] != 1 || counts[3] != 3 {
+		t.Fatalf("expected picks proportional to weight 1:3, got %v", counts)
+	}
+}
+
+func TestSelectWeightedChannelTreatsZeroWeightAsOne(t *testing.T) {
+	candidates := []models.Channel{{ID: 1}, {ID: 2}}
+
+	var total int
+	ch := selectWeightedChannel(candidates, func(n int) int {
+		total = n
+		return 1
+	})
+	if total != 2 || ch.ID != 2 {
+		t.Fatalf("expected total weight 2 and channel 2, got total %d channel %d", total, ch.ID)
+	}
+}
+
+func TestSelectWeightedChannelEmpty(t *testing.T) {
+	if ch := selectWeightedChannel(nil, func(int) int { return 0 }); ch != nil {
+		t.Fatalf("expected nil for no candidates, got %+v", ch)
+	}
+}
+
+func TestChannelServesModel(t *testing.T) {
+	ch := &models.Channel{Models: `["gpt-4o","claude-sonnet-4"]`}
+	if !channelServesModel(ch, "gpt-4o") {
+		t.Fatalf("expected gpt-4o to be served")
+	}
+	if channelServesModel(ch, "gpt-4") {
+		t.Fatalf("prefix match must not count")
+	}
+	if channelServesModel(&models.Channel{Models: "oops"}, "gpt-4o") {
+		t.Fatalf("invalid models JSON must not match")
+	}
+}
+
+func TestDrawChannelGivesBackRateSlotToOpenBreaker(t *testing.T) {
+	candidates := []models.Channel{{ID: 1, RPMLimit: 1}}
+	used := map[uint]int64{}
+	breakerOpen := true
+	gate := channelGate{
+		takeRate: func(ch *models.Channel) (int64, bool) {
+			if used[ch.ID] >= int64(ch.RPMLimit) {
+				return 7, false
+			}
+			used[ch.ID]++
+			return 7, true
+		},
+		releaseRate: func(ch *models.Channel, minute int64) {
+			if minute != 7 {
+				t.Fatalf("expected the slot to be released in minute 7, got %d", minute)
+			}
+			used[ch.ID]--
+		},
+		allow: func(*models.Channel) bool { return !breakerOpen },
+	}
+	first := func(int) int { return 0 }
+
+	if ch, saturated := drawChannel(candidates, gate, first); ch != nil || saturated {
+		t.Fatalf("open breaker: expected no channel and no saturation, got %+v saturated=%v", ch, saturated)
+	}
+	if used[1] != 0 {
+		t.Fatalf("rejected channel must not keep its rate slot, used %d", used[1])
+	}
+
+	breakerOpen = false
+	ch, _ := drawChannel(candidates, gate, first)
+	if ch == nil || ch.ID != 1 {
+		t.Fatalf("expected channel 1 once the breaker closes, got %+v", ch)
+	}
+	if ch, saturated := drawChannel(candidates, gate, first); ch != nil || !saturated {
+		t.Fatalf("expected rpm 1 to be used up, got %+v saturated=%v", ch, saturated)
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+
+	"linuxdo-relay/internal/logger"
+)
+
+// concurrencyRetryAfter is the retry hint sent when a user has no free slot.
+// Slots free up whenever one of their requests finishes, so a short hint is
+// more useful than the lease length.
+const concurrencyRetryAfter = time.Second
+
+// acquireSlotScript atomically drops expired leases from a user's set and
+// adds a new one if fewer than the limit remain. Leases are sorted-set
+// members scored by their expiry in milliseconds. It returns {acquired,
+// in-flight count}.
+//
+// KEYS[1] lease set, ARGV[1] now, ARGV[2] lease expiry, ARGV[3] limit,
+// ARGV[4] lease id, ARGV[5] key TTL in seconds.
+var acquireSlotScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local n = redis.call('ZCARD', KEYS[1])
+if n >= tonumber(ARGV[3]) then
+	return {0, n}
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+return {1, n + 1}
+`)
+
+// concurrencyKey is the Redis sorted set holding a user's in-flight leases.
+func concurrencyKey(userID uint) string {
+	return fmt.Sprintf("concurrency:%d", userID)
+}
+
+// concurrencyLimit returns the number of concurrent relay requests allowed
+// for a user: their own override when positive, otherwise the entry of limits
+// for level, where levels beyond the list use its last entry. 0 means no
+// limit.
+func concurrencyLimit(limits []int, level, override int) int {
+	if override > 0 {
+		return override
+	}
+	if len(limits) == 0 {
+		return 0
+	}
+	i := level - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(limits) {
+		i = len(limits) - 1
+	}
+	if limits[i] < 0 {
+		return 0
+	}
+	return limits[i]
+}
+
+// concurrencyLimitFromContext resolves the limit of the authenticated user.
+func concurrencyLimitFromContext(app *AppContext, c *gin.Context) int {
+	if app == nil || app.Config == nil {
+		return 0
+	}
+	level := c.GetInt("level")
+	override := c.GetInt("max_concurrent_requests")
+	return concurrencyLimit(app.Config.MaxConcurrentRequests, level, override)
+}
+
+// concurrencyLease returns how long a slot is held without renewal.
+func concurrencyLease(app *AppContext) time.Duration {
+	if app == nil || app.Config == nil || app.Config.ConcurrencyLeaseSeconds <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(app.Config.ConcurrencyLeaseSeconds) * time.Second
+}
+
+// ConcurrencyMiddleware caps the number of relay requests a user may have in
+// flight at once. Each request holds a lease in Redis that is renewed while
+// it runs and released when it finishes; a lease left behind by a crashed
+// instance expires on its own. Free token-counting requests are not limited,
+// and Redis errors fail open.
+func ConcurrencyMiddleware(app *AppContext) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, isRelay := relayRequestFromContext(c)
+		if !isRelay || req.free() {
+			c.Next()
+			return
+		}
+		uidVal, ok := c.Get("user_id")
+		if !ok {
+			c.Next()
+			return
+		}
+		userID, ok := uidVal.(uint)
+		if !ok {
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "invalid user id type")
+			return
+		}
+		limit := concurrencyLimitFromContext(app, c)
+		if limit <= 0 || app.Redis == nil || app.Redis.Client == nil {
+			c.Next()
+			return
+		}
+
+		key := concurrencyKey(userID)
+		lease := concurrencyLease(app)
+		leaseID := uuid.NewString()
+		ctx := context.Background()
+		now := time.Now()
+		res, err := acquireSlotScript.Run(ctx, app.Redis.Client, []string{key},
+			now.UnixMilli(), now.Add(lease).UnixMilli(), limit, leaseID, int(lease.Seconds())+5).Int64Slice()
+		if err != nil || len(res) != 2 {
+			logger.Error("concurrency: redis error", "error", err, "key", key, "requestID", requestIDFromContext(c))
+			c.Next()
+			return
+		}
+		if res[0] == 0 {
+			setRetryAfter(c, concurrencyRetryAfter)
+			abortRelayError(c, http.StatusTooManyRequests, errCodeConcurrencyExceeded,
+				fmt.Sprintf("too many concurrent requests, limit is %d", limit))
+			return
+		}
+
+		done := make(chan struct{})
+		go renewConcurrencyLease(app, key, leaseID, lease, done)
+		defer func() {
+			close(done)
+			if err := app.Redis.ZRem(ctx, key, leaseID).Err(); err != nil {
+				logger.Error("concurrency: failed to release slot", "error", err, "key", key, "requestID", requestIDFromContext(c))
+			}
+		}()
+
+		c.Next()
+	}
+}
+
+// renewConcurrencyLease pushes the expiry of a held lease forward every third
+// of the lease until done is closed, so long streams keep their slot.
+func renewConcurrencyLease(app *AppContext, key, leaseID string, lease time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	ctx := context.Background()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			expiry := float64(now.Add(lease).UnixMilli())
+			err := app.Redis.ZAddXX(ctx, key, &redis.Z{Score: expiry, Member: leaseID}).Err()
+			if err == nil {
+				err = app.Redis.Expire(ctx, key, lease+5*time.Second).Err()
+			}
+			if err != nil {
+				logger.Error("concurrency: failed to renew slot", "error", err, "key", key)
+			}
+		}
+	}
+}
+
+// inFlightRequests counts a user's unexpired leases.
+func inFlightRequests(app *AppContext, userID uint) (int64, error) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return 0, nil
+	}
+	cutoff := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return app.Redis.ZCount(context.Background(), concurrencyKey(userID), cutoff, "+inf").Result()
+}
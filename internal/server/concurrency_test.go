@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"linuxdo-relay/internal/config"
+	"linuxdo-relay/internal/storage"
+)
+
+// newTestRedis starts an in-memory Redis server for the duration of the test.
+func newTestRedis(t *testing.T) *storage.Redis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &storage.Redis{Client: client}
+}
+
+// newConcurrencyTestRouter serves a relay route behind ConcurrencyMiddleware
+// for user 1 with a limit of one request. The handler runs inside while the
+// request holds its slot.
+func newConcurrencyTestRouter(app *AppContext, inside func()) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", uint(1))
+		c.Set("level", 1)
+	})
+	r.Use(ConcurrencyMiddleware(app))
+	r.POST("/v1/chat/completions", func(c *gin.Context) {
+		if inside != nil {
+			inside()
+		}
+		c.Status(http.StatusOK)
+	})
+	return r
+}
+
+func serveConcurrencyTestRequest(r *gin.Engine) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	cases := []struct {
+		limits   []int
+		level    int
+		override int
+		want     int
+	}{
+		{nil, 1, 0, 0},
+		{nil, 1, 3, 3},
+		{[]int{2, 5}, 1, 0, 2},
+		{[]int{2, 5}, 2, 0, 5},
+		{[]int{2, 5}, 7, 0, 5},
+		{[]int{2, 5}, 0, 0, 2},
+		{[]int{2, 5}, 2, 1, 1},
+		{[]int{-1}, 1, 0, 0},
+	}
+	for _, tc := range cases {
+		if got := concurrencyLimit(tc.limits, tc.level, tc.override); got != tc.want {
+			t.Fatalf("concurrencyLimit(%v, %d, %d) = %d, want %d", tc.limits, tc.level, tc.override, got, tc.want)
+		}
+	}
+}
+
+func TestConcurrencyMiddlewareFailsOpenWithoutRedis(t *testing.T) {
+	app := &AppContext{Config: &config.Config{MaxConcurrentRequests: []int{1}}}
+	rec := serveConcurrencyTestRequest(newConcurrencyTestRouter(app, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected request to pass without redis, got %d", rec.Code)
+	}
+}
+
+func TestConcurrencyMiddlewareRejectsAtLimit(t *testing.T) {
+	app := &AppContext{
+		Config: &config.Config{MaxConcurrentRequests: []int{1}},
+		Redis:  newTestRedis(t),
+	}
+	ctx := context.Background()
+	held := &redis.Z{Score: float64(time.Now().Add(time.Minute).UnixMilli()), Member: "held"}
+	if err := app.Redis.ZAdd(ctx, concurrencyKey(1), held).Err(); err != nil {
+		t.Fatalf("seed lease: %v", err)
+	}
+
+	rec := serveConcurrencyTestRequest(newConcurrencyTestRouter(app, func() {
+		t.Fatalf("expected the request to be rejected before the handler")
+	}))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 at the limit, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("expected Retry-After 1, got %q", got)
+	}
+	if !strings.Contains(rec.Body.String(), errCodeConcurrencyExceeded) {
+		t.Fatalf("expected %s error, got %s", errCodeConcurrencyExceeded, rec.Body.String())
+	}
+	if n, _ := app.Redis.ZCard(ctx, concurrencyKey(1)).Result(); n != 1 {
+		t.Fatalf("expected the rejected request not to add a lease, got %d", n)
+	}
+}
+
+func TestConcurrencyMiddlewareReleasesSlot(t *testing.T) {
+	app := &AppContext{
+		Config: &config.Config{MaxConcurrentRequests: []int{1}},
+		Redis:  newTestRedis(t),
+	}
+	var inFlight int64
+	r := newConcurrencyTestRouter(app, func() {
+		inFlight, _ = inFlightRequests(app, 1)
+	})
+
+	for i := 0; i < 2; i++ {
+		if rec := serveConcurrencyTestRequest(r); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+		if inFlight != 1 {
+			t.Fatalf("request %d: expected one lease while running, got %d", i, inFlight)
+		}
+		if n, _ := inFlightRequests(app, 1); n != 0 {
+			t.Fatalf("request %d: expected the lease to be released, got %d", i, n)
+		}
+	}
+}
+
+func TestConcurrencyMiddlewareReclaimsExpiredLease(t *testing.T) {
+	app := &AppContext{
+		Config: &config.Config{MaxConcurrentRequests: []int{1}},
+		Redis:  newTestRedis(t),
+	}
+	ctx := context.Background()
+	stale := &redis.Z{Score: float64(time.Now().Add(-time.Second).UnixMilli()), Member: "crashed"}
+	if err := app.Redis.ZAdd(ctx, concurrencyKey(1), stale).Err(); err != nil {
+		t.Fatalf("seed lease: %v", err)
+	}
+
+	rec := serveConcurrencyTestRequest(newConcurrencyTestRouter(app, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the expired lease to be reclaimed, got %d", rec.Code)
+	}
+	if _, err := app.Redis.ZScore(ctx, concurrencyKey(1), "crashed").Result(); err != redis.Nil {
+		t.Fatalf("expected the expired lease to be removed, got %v", err)
+	}
+}
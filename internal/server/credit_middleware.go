@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
+	"math"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,6 +16,7 @@ import (
 
 	"linuxdo-relay/internal/logger"
 	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
 )
 
 const (
@@ -29,10 +33,13 @@ const (
 var errInsufficientCredits = errors.New("insufficient credits")
 
 // CreditMiddleware reserves per-request credits before proxying upstream. On
-// failure responses the reservation is refunded.
+// failure responses the reservation is refunded. For token-priced models the
+// reservation is an estimate, and is settled against the usage reported by
+// upstream once the response finishes.
 func CreditMiddleware(app *AppContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !isRelayPath(c) {
+		req, isRelay := relayRequestFromContext(c)
+		if !isRelay || req.free() {
 			c.Next()
 			return
 		}
@@ -44,49 +51,54 @@ func CreditMiddleware(app *AppContext) gin.HandlerFunc {
 		}
 		userID, ok := uidVal.(uint)
 		if !ok {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "invalid user id type"})
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "invalid user id type")
 			return
 		}
 
-		path := c.FullPath()
-		if path == "" {
-			path = c.Request.URL.Path
-		}
-
-		model := extractModelForQuota(c, path)
+		model := req.Model
 		if model == "" {
 			c.Next()
 			return
 		}
 
-		cost, err := determineCreditCost(app, model)
+		price, err := determineCreditPrice(app, req)
 		if err != nil {
-			logger.Error("credit: failed to determine cost", "error", err, "model", model)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "credit_cost_lookup_failed"})
+			logger.Error("credit: failed to determine cost", "error", err, "model", model, "requestID", requestIDFromContext(c))
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "credit cost lookup failed")
 			return
 		}
+		cost := price.Flat
+		if price.metered() {
+			estimateOutput := 0
+			if app.Config != nil {
+				estimateOutput = app.Config.CreditEstimateOutputTokens
+			}
+			cost = price.cost(estimateRequestUsage(req, peekRequestBody(c), estimateOutput))
+			if cost < 1 {
+				cost = 1
+			}
+		}
 		if cost <= 0 {
 			c.Next()
 			return
 		}
 
-		requestID := uuid.NewString()
+		requestID := requestIDFromContext(c)
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
 		txnID, err := reserveCreditsForRequest(app, userID, model, cost, requestID)
 		if err != nil {
 			if errors.Is(err, errInsufficientCredits) {
-				c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
-					"error":   "credit_insufficient",
-					"message": "not enough credits for this model",
-				})
+				abortRelayError(c, http.StatusPaymentRequired, errCodeCreditInsufficient, "not enough credits for this model")
 				return
 			}
-			logger.Error("credit: reserve failed", "error", err, "userID", userID, "model", model, "cost", cost)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "credit_reserve_failed"})
+			logger.Error("credit: reserve failed", "error", err, "userID", userID, "model", model, "cost", cost, "requestID", requestID)
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "credit reserve failed")
 			return
 		}
 
 		c.Set("credit_cost", cost)
-		c.Set("credit_request_id", requestID)
 		c.Set("credit_txn_id", txnID)
 		c.Set("credit_model", model)
 
@@ -94,60 +106,207 @@ func CreditMiddleware(app *AppContext) gin.HandlerFunc {
 
 		statusCode := c.Writer.Status()
 		if statusCode >= 200 && statusCode < 300 {
-			commitReservedCredits(app, txnID)
+			if percent, hit := cacheHitPercentFromContext(c); hit {
+				// Cache hits are charged a share of what the request would
+				// have cost upstream.
+				full := cost
+				if usage, ok := relayUsageFromContext(c); ok && price.metered() {
+					full = price.cost(usage)
+				}
+				settleReservedCredits(app, txnID, userID, cacheHitCost(full, percent), requestID)
+				return
+			}
+			if price.metered() {
+				if usage, ok := relayUsageFromContext(c); ok {
+					settleReservedCredits(app, txnID, userID, price.cost(usage), requestID)
+					return
+				}
+			}
+			commitReservedCredits(app, txnID, requestID)
 			return
 		}
 
-		refundReservedCredits(app, txnID, userID, cost)
+		refundReservedCredits(app, txnID, userID, cost, requestID)
 	}
 }
 
-func isRelayPath(c *gin.Context) bool {
-	path := c.FullPath()
-	if path == "" && c.Request != nil {
-		path = c.Request.URL.Path
+// creditPrice is the pricing that applies to one request: a flat per-request
+// cost plus optional per-million token prices and per-unit image and audio
+// prices.
+type creditPrice struct {
+	Flat             int
+	InputPerMillion  float64
+	OutputPerMillion float64
+	CachedPerMillion float64
+	PerImage         float64
+	PerAudioSecond   float64
+}
+
+func (p creditPrice) tokenBased() bool {
+	return p.InputPerMillion > 0 || p.OutputPerMillion > 0 || p.CachedPerMillion > 0
+}
+
+// metered reports whether the price depends on the usage upstream reports,
+// so the reservation is an estimate to be settled afterwards.
+func (p creditPrice) metered() bool {
+	return p.tokenBased() || p.PerImage > 0 || p.PerAudioSecond > 0
+}
+
+// cost returns the credits owed for the given usage, rounded up to a whole
+// credit.
+func (p creditPrice) cost(u relay.Usage) int {
+	cached := u.CachedTokens
+	if cached > u.PromptTokens {
+		cached = u.PromptTokens
 	}
-	return strings.HasPrefix(path, "/v1/chat/completions") ||
-		strings.HasPrefix(path, "/v1/messages") ||
-		strings.HasPrefix(path, "/v1beta/models/")
+	cachedPrice := p.CachedPerMillion
+	if cachedPrice <= 0 {
+		cachedPrice = p.InputPerMillion
+	}
+	tokens := float64(u.PromptTokens-cached)*p.InputPerMillion +
+		float64(cached)*cachedPrice +
+		float64(u.CompletionTokens)*p.OutputPerMillion
+	units := float64(u.Images)*p.PerImage + u.AudioSeconds*p.PerAudioSecond
+	// Shave float noise so exact multiples do not round up an extra credit.
+	total := float64(p.Flat) + tokens/1e6 + units
+	return int(math.Ceil(total - 1e-9))
 }
 
-func determineCreditCost(app *AppContext, model string) (int, error) {
-	if app == nil || app.DB == nil || model == "" {
-		return 0, nil
+func determineCreditPrice(app *AppContext, req relayRequest) (creditPrice, error) {
+	if app == nil || app.DB == nil || req.Model == "" {
+		return creditPrice{}, nil
 	}
 	var rules []models.ModelCreditRule
 	if err := app.DB.Order("model_pattern ASC").Find(&rules).Error; err != nil {
-		return 0, err
+		return creditPrice{}, err
 	}
 	defaultCost := 0
 	if app.Config != nil {
 		defaultCost = app.Config.DefaultModelCreditCost
 	}
-	return selectCreditCost(model, rules, defaultCost), nil
+	return selectCreditPrice(req.Model, req.Endpoint, rules, defaultCost), nil
 }
 
 func selectCreditCost(model string, rules []models.ModelCreditRule, defaultCost int) int {
-	bestCost := defaultCost
-	bestLen := -1
+	return selectCreditPrice(model, "", rules, defaultCost).Flat
+}
+
+// selectCreditPrice picks the rule with the longest matching model prefix,
+// preferring rules scoped to endpoint over endpoint-agnostic ones. An empty
+// pattern matches every model but loses to any real prefix; without a match
+// the flat default cost applies.
+func selectCreditPrice(model, endpoint string, rules []models.ModelCreditRule, defaultCost int) creditPrice {
+	best := creditPrice{Flat: defaultCost}
+	bestRank := -1
 	for _, rule := range rules {
-		pattern := rule.ModelPattern
-		if pattern == "" {
-			if bestLen < 0 {
-				bestCost = rule.CreditCost
-				bestLen = 0
-			}
-			continue
+		if rank := ruleMatchRank(rule.ModelPattern, rule.Endpoint, model, endpoint); rank > bestRank {
+			bestRank = rank
+			best = priceFromRule(rule)
+		}
+	}
+	if best.Flat < 0 {
+		best.Flat = 0
+	}
+	return best
+}
+
+func priceFromRule(rule models.ModelCreditRule) creditPrice {
+	return creditPrice{
+		Flat:             rule.CreditCost,
+		InputPerMillion:  math.Max(rule.InputPricePerMillion, 0),
+		OutputPerMillion: math.Max(rule.OutputPricePerMillion, 0),
+		CachedPerMillion: math.Max(rule.CachedPricePerMillion, 0),
+		PerImage:         math.Max(rule.PricePerImage, 0),
+		PerAudioSecond:   math.Max(rule.PricePerAudioSecond, 0),
+	}
+}
+
+// estimateTokenUsage guesses the usage of a request before it is sent, for
+// the up-front reservation of token-priced models. Prompt tokens are
+// approximated from the body size; completion tokens use the output limit the
+// request asks for, falling back to defaultOutput.
+func estimateTokenUsage(body []byte, defaultOutput int) relay.Usage {
+	var req struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+		MaxOutputTokens     int `json:"max_output_tokens"`
+		GenerationConfig    *struct {
+			MaxOutputTokens int `json:"maxOutputTokens"`
+		} `json:"generationConfig"`
+	}
+	_ = json.Unmarshal(body, &req)
+
+	output := defaultOutput
+	for _, v := range []int{req.MaxTokens, req.MaxCompletionTokens, req.MaxOutputTokens} {
+		if v > 0 {
+			output = v
+		}
+	}
+	if req.GenerationConfig != nil && req.GenerationConfig.MaxOutputTokens > 0 {
+		output = req.GenerationConfig.MaxOutputTokens
+	}
+	return relay.Usage{
+		PromptTokens:     (len(body) + 3) / 4,
+		CompletionTokens: output,
+	}
+}
+
+// estimatedAudioBytesPerSecond approximates compressed speech audio at
+// 128 kbit/s, used to guess the duration of an uploaded file.
+const estimatedAudioBytesPerSecond = 16000
+
+// estimateRequestUsage guesses the usage of a request on the given endpoint
+// for the up-front reservation. Image generations count the requested "n"
+// images, audio transcriptions estimate the duration from the upload size,
+// and every other endpoint is estimated in tokens. Endpoints that produce no
+// completion are not charged the default output estimate.
+func estimateRequestUsage(req relayRequest, body []byte, defaultOutput int) relay.Usage {
+	switch req.Endpoint {
+	case endpointImageGenerations:
+		var tmp struct {
+			N int `json:"n"`
 		}
-		if strings.HasPrefix(model, pattern) && len(pattern) > bestLen {
-			bestLen = len(pattern)
-			bestCost = rule.CreditCost
+		_ = json.Unmarshal(body, &tmp)
+		if tmp.N < 1 {
+			tmp.N = 1
 		}
+		u := estimateTokenUsage(body, 0)
+		u.Images = tmp.N
+		return u
+	case endpointAudioTranscriptions:
+		return relay.Usage{AudioSeconds: math.Ceil(float64(len(body)) / estimatedAudioBytesPerSecond)}
 	}
-	if bestCost < 0 {
-		bestCost = 0
+	if !req.generatesOutput() {
+		defaultOutput = 0
 	}
-	return bestCost
+	return estimateTokenUsage(body, defaultOutput)
+}
+
+// peekRequestBody reads the request body and puts it back for the handlers.
+func peekRequestBody(c *gin.Context) []byte {
+	if c.Request == nil || c.Request.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+// relayUsageFromContext returns the upstream usage recorded by the relay
+// handler, if it saw any.
+func relayUsageFromContext(c *gin.Context) (relay.Usage, bool) {
+	val, ok := c.Get("relay_usage")
+	if !ok {
+		return relay.Usage{}, false
+	}
+	usage, ok := val.(relay.Usage)
+	if !ok || usage.IsZero() {
+		return relay.Usage{}, false
+	}
+	return usage, true
 }
 
 func reserveCreditsForRequest(app *AppContext, userID uint, model string, cost int, requestID string) (uint, error) {
@@ -185,7 +344,7 @@ func reserveCreditsForRequest(app *AppContext, userID uint, model string, cost i
 	return txnID, err
 }
 
-func commitReservedCredits(app *AppContext, txnID uint) {
+func commitReservedCredits(app *AppContext, txnID uint, requestID string) {
 	if app == nil || app.DB == nil || txnID == 0 {
 		return
 	}
@@ -195,11 +354,66 @@ func commitReservedCredits(app *AppContext, txnID uint) {
 			"status":     creditStatusCommitted,
 			"updated_at": time.Now(),
 		}).Error; err != nil {
-		logger.Error("credit: commit failed", "error", err, "txnID", txnID)
+		logger.Error("credit: commit failed", "error", err, "txnID", txnID, "requestID", requestID)
+	}
+}
+
+// settleReservedCredits turns a reservation into the final charge of actual
+// credits. The reserved transaction itself is updated to the settled amount,
+// and the difference is refunded to or taken from the user's balance. An
+// extra charge never takes the balance below zero; what it could not take is
+// recorded as the transaction's Uncollected amount.
+func settleReservedCredits(app *AppContext, txnID uint, userID uint, actual int, requestID string) {
+	if app == nil || app.DB == nil || txnID == 0 {
+		return
+	}
+	if actual < 0 {
+		actual = 0
+	}
+	var uncollected int
+	err := app.DB.Transaction(func(tx *gorm.DB) error {
+		var txn models.CreditTransaction
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&txn, txnID).Error; err != nil {
+			return err
+		}
+		if txn.Status != creditStatusReserved {
+			return nil
+		}
+		reserved := -txn.Delta
+		diff := actual - reserved
+		if diff > 0 {
+			var user models.User
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+				return err
+			}
+			if diff > user.Credits {
+				txn.Uncollected = diff - max(user.Credits, 0)
+				diff -= txn.Uncollected
+			}
+		}
+		if diff != 0 {
+			if err := tx.Model(&models.User{}).
+				Where("id = ?", userID).
+				UpdateColumn("credits", gorm.Expr("credits - ?", diff)).Error; err != nil {
+				return err
+			}
+		}
+		txn.Delta = -(reserved + diff)
+		txn.Status = creditStatusCommitted
+		txn.UpdatedAt = time.Now()
+		uncollected = txn.Uncollected
+		return tx.Save(&txn).Error
+	})
+	if err != nil {
+		logger.Error("credit: settle failed", "error", err, "txnID", txnID, "userID", userID, "actual", actual, "requestID", requestID)
+		return
+	}
+	if uncollected > 0 {
+		logger.Warn("credit: charge exceeds balance", "txnID", txnID, "userID", userID, "requestID", requestID, "actual", actual, "uncollected", uncollected)
 	}
 }
 
-func refundReservedCredits(app *AppContext, txnID uint, userID uint, cost int) {
+func refundReservedCredits(app *AppContext, txnID uint, userID uint, cost int, requestID string) {
 	if app == nil || app.DB == nil || txnID == 0 || cost <= 0 {
 		return
 	}
@@ -227,10 +441,11 @@ func refundReservedCredits(app *AppContext, txnID uint, userID uint, cost int) {
 			Reason:    creditReasonRefund,
 			Status:    creditStatusCommitted,
 			ModelName: txn.ModelName,
+			RequestID: txn.RequestID,
 		}
 		return tx.Create(&refundTxn).Error
 	})
 	if err != nil {
-		logger.Error("credit: refund failed", "error", err, "txnID", txnID, "userID", userID, "cost", cost)
+		logger.Error("credit: refund failed", "error", err, "txnID", txnID, "userID", userID, "cost", cost, "requestID", requestID)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
 )
 
 func TestSelectCreditCostPrefersLongestPrefix(t *testing.T) {
@@ -34,3 +35,92 @@ func TestSelectCreditCostHandlesEmptyPattern(t *testing.T) {
 		t.Fatalf("expected empty-pattern override to 7, got %d", cost)
 	}
 }
+
+func TestSelectCreditPriceCarriesTokenPrices(t *testing.T) {
+	rules := []models.ModelCreditRule{
+		{ModelPattern: "claude", CreditCost: 1},
+		{ModelPattern: "claude-sonnet", CreditCost: 0, InputPricePerMillion: 3, OutputPricePerMillion: 15},
+	}
+	price := selectCreditPrice("claude-sonnet-4", "", rules, 1)
+	if !price.tokenBased() || price.Flat != 0 || price.InputPerMillion != 3 || price.OutputPerMillion != 15 {
+		t.Fatalf("unexpected price: %+v", price)
+	}
+}
+
+func TestSelectCreditPriceByEndpoint(t *testing.T) {
+	rules := []models.ModelCreditRule{
+		{ModelPattern: "gemini-2.5-pro", CreditCost: 5},
+		{ModelPattern: "gemini", Endpoint: "countTokens", CreditCost: 0},
+	}
+	if price := selectCreditPrice("gemini-2.5-pro", "countTokens", rules, 1); price.Flat != 0 {
+		t.Fatalf("expected free countTokens, got %+v", price)
+	}
+	if price := selectCreditPrice("gemini-2.5-pro", "streamGenerateContent", rules, 1); price.Flat != 5 {
+		t.Fatalf("expected model price, got %+v", price)
+	}
+}
+
+func TestCreditPriceCost(t *testing.T) {
+	price := creditPrice{Flat: 1, InputPerMillion: 2, OutputPerMillion: 10, CachedPerMillion: 1}
+
+	// 1 + (600k*2 + 400k*1 + 100k*10)/1M = 1 + 1.2 + 0.4 + 1.0 = 3.6 -> 4
+	usage := relay.Usage{PromptTokens: 1_000_000, CompletionTokens: 100_000, CachedTokens: 400_000}
+	if got := price.cost(usage); got != 4 {
+		t.Fatalf("expected 4 credits, got %d", got)
+	}
+
+	// Exact multiples must not round up an extra credit.
+	exact := creditPrice{InputPerMillion: 3}
+	if got := exact.cost(relay.Usage{PromptTokens: 1_000_000}); got != 3 {
+		t.Fatalf("expected 3 credits, got %d", got)
+	}
+
+	// Without a cached price, cached tokens fall back to the input price.
+	noCache := creditPrice{InputPerMillion: 2}
+	if got := noCache.cost(relay.Usage{PromptTokens: 500_000, CachedTokens: 500_000}); got != 1 {
+		t.Fatalf("expected 1 credit, got %d", got)
+	}
+
+	// Images and audio seconds are billed per unit.
+	units := creditPrice{PerImage: 4, PerAudioSecond: 0.1}
+	if got := units.cost(relay.Usage{Images: 2, AudioSeconds: 15}); got != 10 {
+		t.Fatalf("expected 10 credits, got %d", got)
+	}
+}
+
+func TestEstimateRequestUsage(t *testing.T) {
+	images := estimateRequestUsage(relayRequest{Endpoint: endpointImageGenerations}, []byte(`{"prompt":"cat","n":3}`), 1024)
+	if images.Images != 3 || images.CompletionTokens != 0 {
+		t.Fatalf("unexpected image estimate %+v", images)
+	}
+
+	audio := estimateRequestUsage(relayRequest{Endpoint: endpointAudioTranscriptions}, make([]byte, 48000), 1024)
+	if audio.AudioSeconds != 3 || audio.PromptTokens != 0 {
+		t.Fatalf("unexpected audio estimate %+v", audio)
+	}
+
+	embeddings := estimateRequestUsage(relayRequest{Endpoint: endpointEmbeddings}, []byte(`{"input":"hello"}`), 1024)
+	if embeddings.CompletionTokens != 0 || embeddings.PromptTokens == 0 {
+		t.Fatalf("unexpected embeddings estimate %+v", embeddings)
+	}
+}
+
+func TestEstimateTokenUsage(t *testing.T) {
+	body := []byte(`{"model":"claude-sonnet","max_tokens":2000}`)
+	u := estimateTokenUsage(body, 1024)
+	if u.CompletionTokens != 2000 {
+		t.Fatalf("expected requested max_tokens, got %d", u.CompletionTokens)
+	}
+	if u.PromptTokens != (len(body)+3)/4 {
+		t.Fatalf("unexpected prompt estimate %d", u.PromptTokens)
+	}
+
+	gemini := estimateTokenUsage([]byte(`{"generationConfig":{"maxOutputTokens":64}}`), 1024)
+	if gemini.CompletionTokens != 64 {
+		t.Fatalf("expected gemini maxOutputTokens, got %d", gemini.CompletionTokens)
+	}
+
+	if got := estimateTokenUsage([]byte(`{}`), 1024).CompletionTokens; got != 1024 {
+		t.Fatalf("expected default output estimate, got %d", got)
+	}
+}
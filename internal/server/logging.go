@@ -10,42 +10,70 @@ import (
 )
 
 // nonBlockingSave ignores errors and ensures that logging failures never break
-// main request handling paths.
-func nonBlockingSave(err error) {
+// main request handling paths. args are extra log fields, such as the
+// request ID.
+func nonBlockingSave(err error, args ...any) {
 	if err != nil {
-		logger.Error("log insert failed", "error", err)
+		logger.Error("log insert failed", append([]any{"error", err}, args...)...)
 	}
 }
 
-func recordAPILog(app *AppContext, userID uint, model, status string, statusCode int, errorMessage, ip string) {
-	if app == nil || app.DB == nil {
+func recordAPILog(app *AppContext, log *models.APILog) {
+	if app == nil || app.DB == nil || log == nil {
 		return
 	}
-	log := &models.APILog{
-		UserID:       userID,
-		Model:        model,
-		Status:       status,
-		StatusCode:   statusCode,
-		ErrorMessage: errorMessage,
-		IPAddress:    ip,
-		CreatedAt:    time.Now(),
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = time.Now()
 	}
-	nonBlockingSave(app.DB.Create(log).Error)
+	nonBlockingSave(app.DB.Create(log).Error, "requestID", log.RequestID)
 }
 
 // recordAPILogFromContext is a convenience helper for relay routes to record
 // a single API call using values from gin.Context.
 func recordAPILogFromContext(app *AppContext, c *gin.Context, model string, statusCode int, status, errorMessage string) {
-	if c == nil {
+	recordRelayLog(app, c, &models.APILog{
+		Model:        model,
+		Status:       status,
+		StatusCode:   statusCode,
+		ErrorMessage: errorMessage,
+	}, nil)
+}
+
+// recordRelayLog fills the caller identity of log from gin.Context and stores
+// it together with the upstream attempts made for the request and, when the
+// request was sampled for capture, its payloads. Relay routes
+// use it when they have more than a status to record, such as token usage.
+func recordRelayLog(app *AppContext, c *gin.Context, log *models.APILog, attempts []models.APIAttempt) {
+	if c == nil || log == nil {
 		return
 	}
 	uidVal, _ := c.Get("user_id")
-	userID, _ := uidVal.(uint)
-	ip := ""
+	log.UserID, _ = uidVal.(uint)
+	if log.RequestID == "" {
+		log.RequestID = requestIDFromContext(c)
+	}
+	if log.Endpoint == "" {
+		if req, ok := relayRequestFromContext(c); ok {
+			log.Endpoint = req.Endpoint
+		}
+	}
 	if c.Request != nil {
-		ip = c.ClientIP()
+		log.IPAddress = c.ClientIP()
+	}
+	log.Attempts = len(attempts)
+	recordAPILog(app, log)
+	if log.ID == 0 {
+		return
+	}
+	recordPayloadCapture(app, c, log)
+
+	if len(attempts) == 0 {
+		return
+	}
+	for i := range attempts {
+		attempts[i].APILogID = log.ID
 	}
-	recordAPILog(app, userID, model, status, statusCode, errorMessage, ip)
+	nonBlockingSave(app.DB.Create(&attempts).Error, "requestID", log.RequestID)
 }
 
 func recordOperationLog(app *AppContext, userID uint, opType, details string) {
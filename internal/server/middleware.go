@@ -10,43 +10,99 @@ import (
 	"linuxdo-relay/internal/models"
 )
 
-// AuthMiddleware validates Authorization header and injects user info into
+// credentialSource names where a request carried its credential.
+type credentialSource string
+
+const (
+	credentialBearer   credentialSource = "bearer"
+	credentialXAPIKey  credentialSource = "x-api-key"
+	credentialXGoogKey credentialSource = "x-goog-api-key"
+	credentialQueryKey credentialSource = "query"
+)
+
+// credentialQueryName is the query parameter Gemini clients put the key in.
+const credentialQueryName = "key"
+
+// requestCredential finds the caller's credential. Locations are tried in a
+// fixed order: Authorization: Bearer, then x-api-key (Anthropic SDKs), then
+// x-goog-api-key and the ?key= query parameter (Gemini clients). The first
+// non-empty one wins; an Authorization header that is not a bearer token is
+// ignored so another location can still match.
+func requestCredential(r *http.Request) (string, credentialSource) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		if token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer ")); token != "" {
+			return token, credentialBearer
+		}
+	}
+	if token := strings.TrimSpace(r.Header.Get("x-api-key")); token != "" {
+		return token, credentialXAPIKey
+	}
+	if token := strings.TrimSpace(r.Header.Get("x-goog-api-key")); token != "" {
+		return token, credentialXGoogKey
+	}
+	if token := strings.TrimSpace(r.URL.Query().Get(credentialQueryName)); token != "" {
+		return token, credentialQueryKey
+	}
+	return "", ""
+}
+
+// clearCredentials removes every credential location from r once the caller
+// has been authenticated, so the user's key cannot leak upstream or into
+// anything that records the request later.
+func clearCredentials(r *http.Request) {
+	r.Header.Del("Authorization")
+	r.Header.Del("x-api-key")
+	r.Header.Del("x-goog-api-key")
+	if r.URL.RawQuery != "" {
+		q := r.URL.Query()
+		if q.Has(credentialQueryName) {
+			q.Del(credentialQueryName)
+			r.URL.RawQuery = q.Encode()
+		}
+	}
+}
+
+// AuthMiddleware validates the caller's credential and injects user info into
 // context. It supports both JWT (for web login) and per-user API keys for
-// programmatic access.
+// programmatic access. JWTs are only read from the Authorization header; API
+// keys are also accepted in the provider-native locations listed in
+// requestCredential so official SDKs work unmodified.
 func AuthMiddleware(app *AppContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid Authorization header"})
+		tokenStr, source := requestCredential(c.Request)
+		if tokenStr == "" {
+			abortRelayError(c, http.StatusUnauthorized, errCodeInvalidAPIKey, "missing or invalid Authorization header")
 			return
 		}
 
-		tokenStr := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
-
 		// First, try to parse as JWT (web login flow).
-		if claims, err := authpkg.ParseToken(app.JWTSecret, tokenStr); err == nil {
-			var user models.User
-			if err := app.DB.First(&user, claims.UserID).Error; err != nil {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid user"})
-				return
-			}
-			if user.Status != models.UserStatusNormal {
-				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user disabled"})
+		if source == credentialBearer {
+			if claims, err := authpkg.ParseToken(app.JWTSecret, tokenStr); err == nil {
+				var user models.User
+				if err := app.DB.First(&user, claims.UserID).Error; err != nil {
+					abortRelayError(c, http.StatusUnauthorized, errCodeInvalidAPIKey, "invalid user")
+					return
+				}
+				if user.Status != models.UserStatusNormal {
+					abortRelayError(c, http.StatusForbidden, errCodeUserDisabled, "user disabled")
+					return
+				}
+				c.Set("user_id", user.ID)
+				c.Set("role", user.Role)
+				c.Set("level", user.Level)
+				c.Set("max_concurrent_requests", user.MaxConcurrentRequests)
+				c.Set("auth_method", "jwt")
+				clearCredentials(c.Request)
+				c.Next()
 				return
 			}
-			c.Set("user_id", user.ID)
-			c.Set("role", user.Role)
-			c.Set("level", user.Level)
-			c.Set("auth_method", "jwt")
-			c.Next()
-			return
 		}
 
 		// If not a valid JWT, treat as per-user API key. We only accept keys
 		// that start with the expected prefix to avoid confusing random tokens
 		// with API keys.
 		if !strings.HasPrefix(tokenStr, "sk-") {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			abortRelayError(c, http.StatusUnauthorized, errCodeInvalidAPIKey, "invalid token")
 			return
 		}
 
@@ -54,11 +110,11 @@ func AuthMiddleware(app *AppContext) gin.HandlerFunc {
 		hash := authpkg.HashAPIKey(tokenStr)
 		var user models.User
 		if err := app.DB.Where("api_key_hash = ?", hash).First(&user).Error; err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			abortRelayError(c, http.StatusUnauthorized, errCodeInvalidAPIKey, "invalid token")
 			return
 		}
 		if user.Status != models.UserStatusNormal {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "user disabled"})
+			abortRelayError(c, http.StatusForbidden, errCodeUserDisabled, "user disabled")
 			return
 		}
 
@@ -66,7 +122,9 @@ func AuthMiddleware(app *AppContext) gin.HandlerFunc {
 		c.Set("user_id", user.ID)
 		c.Set("role", user.Role)
 		c.Set("level", user.Level)
+		c.Set("max_concurrent_requests", user.MaxConcurrentRequests)
 		c.Set("auth_method", "api_key")
+		clearCredentials(c.Request)
 
 		c.Next()
 	}
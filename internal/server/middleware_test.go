@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestCredentialPrecedence(t *testing.T) {
+	cases := []struct {
+		name   string
+		url    string
+		header map[string]string
+		token  string
+		source credentialSource
+	}{
+		{"bearer wins", "/v1/messages?key=sk-q", map[string]string{"Authorization": "Bearer sk-a", "x-api-key": "sk-b"}, "sk-a", credentialBearer},
+		{"anthropic sdk", "/v1/messages", map[string]string{"x-api-key": "sk-b", "x-goog-api-key": "sk-c"}, "sk-b", credentialXAPIKey},
+		{"non-bearer authorization ignored", "/v1/messages", map[string]string{"Authorization": "Basic abc", "x-api-key": "sk-b"}, "sk-b", credentialXAPIKey},
+		{"gemini header", "/v1beta/models/g:generateContent?key=sk-q", map[string]string{"x-goog-api-key": "sk-c"}, "sk-c", credentialXGoogKey},
+		{"gemini query", "/v1beta/models/g:generateContent?key=sk-q", nil, "sk-q", credentialQueryKey},
+		{"missing", "/v1/messages", map[string]string{"Authorization": "Bearer "}, "", ""},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodPost, tc.url, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		token, source := requestCredential(r)
+		if token != tc.token || source != tc.source {
+			t.Fatalf("%s: expected %q from %q, got %q from %q", tc.name, tc.token, tc.source, token, source)
+		}
+	}
+}
+
+func TestClearCredentials(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1beta/models/g:generateContent?alt=sse&key=sk-q", nil)
+	r.Header.Set("Authorization", "Bearer sk-a")
+	r.Header.Set("x-api-key", "sk-b")
+	r.Header.Set("x-goog-api-key", "sk-c")
+	r.Header.Set("anthropic-version", "2023-06-01")
+
+	clearCredentials(r)
+
+	if r.Header.Get("Authorization") != "" || r.Header.Get("x-api-key") != "" || r.Header.Get("x-goog-api-key") != "" {
+		t.Fatalf("credential headers left: %v", r.Header)
+	}
+	if r.Header.Get("anthropic-version") == "" {
+		t.Fatalf("unrelated header removed")
+	}
+	if r.URL.RawQuery != "alt=sse" {
+		t.Fatalf("unexpected query %q", r.URL.RawQuery)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// parseModelMapping decodes a channel's ModelMapping JSON object. An empty
+// value means no mapping.
+func parseModelMapping(raw string) (map[string]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var mapping map[string]string
+	if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+		return nil, errors.New("invalid model_mapping JSON format")
+	}
+	for public, upstream := range mapping {
+		if strings.TrimSpace(public) == "" || strings.TrimSpace(upstream) == "" {
+			return nil, errors.New("model_mapping entries must not be empty")
+		}
+	}
+	return mapping, nil
+}
+
+// parseChannelHeaders decodes a channel's Headers JSON object of extra
+// upstream headers. An empty value means none.
+func parseChannelHeaders(raw string) (map[string]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil, errors.New("invalid headers JSON format")
+	}
+	for name, value := range headers {
+		if !relay.ValidUpstreamHeader(name) {
+			return nil, errors.New("header " + name + " cannot be set on a channel")
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.New("header values must be a single line")
+		}
+	}
+	return headers, nil
+}
+
+// channelHeaders returns the extra upstream headers of ch.
+func channelHeaders(ch *models.Channel) map[string]string {
+	headers, err := parseChannelHeaders(ch.Headers)
+	if err != nil {
+		return nil
+	}
+	return headers
+}
+
+// upstreamModelName returns the model name ch expects for the public model
+// name the client asked for.
+func upstreamModelName(ch *models.Channel, model string) string {
+	mapping, err := parseModelMapping(ch.ModelMapping)
+	if err != nil {
+		return model
+	}
+	if upstream, ok := mapping[model]; ok {
+		return upstream
+	}
+	return model
+}
+
+// rewriteModelField replaces the top-level "model" field of a JSON request
+// body, leaving every other field untouched. Bodies that are not JSON objects
+// are returned unchanged.
+func rewriteModelField(body []byte, model string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	raw, err := json.Marshal(model)
+	if err != nil {
+		return body
+	}
+	fields["model"] = raw
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// rewriteMultipartModel replaces the "model" form field of a multipart body.
+// The boundary is kept so the original Content-Type header stays valid; the
+// body is returned unchanged if it cannot be parsed.
+func rewriteMultipartModel(body []byte, contentType, model string) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return body
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		return body
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body
+		}
+		w, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return body
+		}
+		if part.FormName() == "model" && part.FileName() == "" {
+			_, err = io.WriteString(w, model)
+		} else {
+			_, err = io.Copy(w, part)
+		}
+		if err != nil {
+			return body
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return body
+	}
+	return out.Bytes()
+}
+
+// upstreamRequest returns the path and body to send to ch for a request on
+// the public model. Routes with a fixed path carry the model in the JSON body;
+// Gemini routes carry it in the path, followed by the requested method.
+func upstreamRequest(ch *models.Channel, req relayRequest, fixedPath string, body []byte) (string, []byte) {
+	upModel := upstreamModelName(ch, req.Model)
+	if fixedPath == "" {
+		return determineUpstreamPath(upModel, req.Endpoint), body
+	}
+	if upModel != req.Model {
+		if req.multipart() {
+			body = rewriteMultipartModel(body, req.ContentType, upModel)
+		} else {
+			body = rewriteModelField(body, upModel)
+		}
+	}
+	return fixedPath, body
+}
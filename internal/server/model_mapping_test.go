@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"testing"
+
+	"linuxdo-relay/internal/models"
+)
+
+func TestUpstreamRequestRewritesBodyModel(t *testing.T) {
+	ch := &models.Channel{ModelMapping: `{"gpt-4o":"gpt-4o-2024-08-06"}`}
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`)
+
+	path, out := upstreamRequest(ch, relayRequest{Model: "gpt-4o", Endpoint: endpointChatCompletions}, "/v1/chat/completions", body)
+	if path != "/v1/chat/completions" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("invalid body: %v", err)
+	}
+	if got["model"] != "gpt-4o-2024-08-06" || got["stream"] != true {
+		t.Fatalf("unexpected rewritten body %s", out)
+	}
+}
+
+func TestUpstreamRequestRewritesGeminiPath(t *testing.T) {
+	ch := &models.Channel{ModelMapping: `{"gemini-pro":"gemini-2.5-pro"}`}
+	body := []byte(`{"contents":[]}`)
+
+	path, out := upstreamRequest(ch, relayRequest{Model: "gemini-pro", Endpoint: endpointStreamGenerateContent}, "", body)
+	if path != "/v1beta/models/gemini-2.5-pro:streamGenerateContent" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	if string(out) != string(body) {
+		t.Fatalf("gemini body must not change, got %s", out)
+	}
+}
+
+func TestUpstreamRequestWithoutMappingKeepsBody(t *testing.T) {
+	ch := &models.Channel{ModelMapping: `{}`}
+	body := []byte(`{"model":"claude-sonnet-4","max_tokens":10}`)
+
+	_, out := upstreamRequest(ch, relayRequest{Model: "claude-sonnet-4", Endpoint: endpointMessages}, "/v1/messages", body)
+	if string(out) != string(body) {
+		t.Fatalf("expected body untouched, got %s", out)
+	}
+}
+
+func TestParseModelMappingRejectsInvalid(t *testing.T) {
+	for _, raw := range []string{`[]`, `{"a":1}`, `{"":"x"}`, `{"a":""}`} {
+		if _, err := parseModelMapping(raw); err == nil {
+			t.Fatalf("expected error for %s", raw)
+		}
+	}
+	if m, err := parseModelMapping(""); err != nil || m != nil {
+		t.Fatalf("empty mapping must be accepted, got %v %v", m, err)
+	}
+}
+
+func TestUpstreamRequestRewritesMultipartModel(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	_ = mw.WriteField("model", "whisper")
+	fw, _ := mw.CreateFormFile("file", "a.mp3")
+	_, _ = fw.Write([]byte("audio-bytes"))
+	_ = mw.Close()
+
+	ch := &models.Channel{ModelMapping: `{"whisper":"whisper-1"}`}
+	req := relayRequest{Model: "whisper", Endpoint: endpointAudioTranscriptions, ContentType: mw.FormDataContentType()}
+
+	path, out := upstreamRequest(ch, req, "/v1/audio/transcriptions", buf.Bytes())
+	if path != "/v1/audio/transcriptions" {
+		t.Fatalf("unexpected path %s", path)
+	}
+	if got := multipartModel(out, req.ContentType); got != "whisper-1" {
+		t.Fatalf("expected rewritten model, got %q", got)
+	}
+	if !bytes.Contains(out, []byte("audio-bytes")) {
+		t.Fatalf("file part lost: %s", out)
+	}
+}
+
+func TestParseChannelHeaders(t *testing.T) {
+	headers, err := parseChannelHeaders(`{"anthropic-beta":"prompt-caching-2024-07-31"}`)
+	if err != nil || headers["anthropic-beta"] != "prompt-caching-2024-07-31" {
+		t.Fatalf("unexpected headers %v (%v)", headers, err)
+	}
+	for _, raw := range []string{`[]`, `{"Connection":"close"}`, `{"X-A":"a\nb"}`} {
+		if _, err := parseChannelHeaders(raw); err == nil {
+			t.Fatalf("expected %s to be rejected", raw)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/logger"
+	"linuxdo-relay/internal/models"
+)
+
+// maxCapturedResponseSize caps how much of a response is buffered for capture
+// before redaction; inline images can make raw bodies much larger than what
+// is finally stored.
+const maxCapturedResponseSize = 4 << 20
+
+// payloadPurgeInterval is how often expired captures are deleted at most.
+const payloadPurgeInterval = 10 * time.Minute
+
+// lastPayloadPurge is the unix time of the last purge of expired captures.
+var lastPayloadPurge atomic.Int64
+
+// payloadCapture holds what a captured relay request keeps until its APILog
+// row has been written.
+type payloadCapture struct {
+	request     []byte
+	contentType string
+	response    *captureWriter
+}
+
+// captureWriter passes everything through to the client while keeping a copy
+// of the first limit bytes written.
+type captureWriter struct {
+	gin.ResponseWriter
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.capture(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *captureWriter) capture(b []byte) {
+	room := w.limit - w.buf.Len()
+	if len(b) > room {
+		b = b[:room]
+		w.truncated = true
+	}
+	w.buf.Write(b)
+}
+
+// payloadCaptureRate returns the sampling rate of the enabled rules matching
+// userID and model; the highest rate wins when several match.
+func payloadCaptureRate(rules []models.PayloadCaptureRule, userID uint, model string) float64 {
+	rate := 0.0
+	for _, r := range rules {
+		if !r.Enabled || (r.UserID != 0 && r.UserID != userID) || !strings.HasPrefix(model, r.ModelPattern) {
+			continue
+		}
+		if r.SampleRate > rate {
+			rate = r.SampleRate
+		}
+	}
+	return rate
+}
+
+// startPayloadCapture decides whether the current relay request is captured
+// and, if so, starts recording the response written to the client. The
+// capture is stored by recordRelayLog once the request's APILog exists.
+func startPayloadCapture(app *AppContext, c *gin.Context, req relayRequest, body []byte) {
+	if app == nil || app.DB == nil {
+		return
+	}
+	var rules []models.PayloadCaptureRule
+	if err := app.DB.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+		logger.Error("payload capture: failed to load rules", "error", err, "requestID", requestIDFromContext(c))
+		return
+	}
+	rate := payloadCaptureRate(rules, currentUserID(c), req.Model)
+	if rate <= 0 || rand.Float64() >= rate {
+		return
+	}
+	w := &captureWriter{ResponseWriter: c.Writer, limit: maxCapturedResponseSize}
+	c.Writer = w
+	c.Set("payload_capture", &payloadCapture{request: body, contentType: req.ContentType, response: w})
+}
+
+// recordPayloadCapture stores the capture started for the request, if any,
+// against log, purging expired captures when a purge is due.
+func recordPayloadCapture(app *AppContext, c *gin.Context, log *models.APILog) {
+	val, ok := c.Get("payload_capture")
+	if !ok {
+		return
+	}
+	capture, ok := val.(*payloadCapture)
+	if !ok {
+		return
+	}
+	// A request is logged once; never store its capture twice.
+	c.Set("payload_capture", nil)
+
+	maxBytes, ttl := 64*1024, 72*time.Hour
+	if app.Config != nil {
+		maxBytes = app.Config.PayloadCaptureMaxBytes
+		ttl = time.Duration(app.Config.PayloadCaptureTTLHours) * time.Hour
+	}
+	responseType := capture.response.Header().Get("Content-Type")
+	reqBody, reqCut := truncatePayload(redactPayload(capture.request, capture.contentType), maxBytes)
+	respBody, respCut := truncatePayload(redactPayload(capture.response.buf.Bytes(), responseType), maxBytes)
+
+	now := time.Now()
+	row := &models.PayloadCapture{
+		APILogID:       log.ID,
+		UserID:         log.UserID,
+		Model:          log.Model,
+		RequestBody:    reqBody,
+		ResponseBody:   respBody,
+		ResponseStatus: capture.response.Status(),
+		ContentType:    responseType,
+		Truncated:      reqCut || respCut || capture.response.truncated,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(ttl),
+	}
+	nonBlockingSave(app.DB.Create(row).Error, "requestID", log.RequestID)
+	purgeExpiredPayloadCaptures(app)
+}
+
+// purgeExpiredPayloadCaptures deletes captures past their TTL, at most once
+// per payloadPurgeInterval. Expired rows left in between are hidden from the
+// admin list by their expires_at.
+func purgeExpiredPayloadCaptures(app *AppContext) {
+	now := time.Now().Unix()
+	last := lastPayloadPurge.Load()
+	if now-last < int64(payloadPurgeInterval/time.Second) || !lastPayloadPurge.CompareAndSwap(last, now) {
+		return
+	}
+	err := app.DB.Where("expires_at < ?", time.Now()).Delete(&models.PayloadCapture{}).Error
+	if err != nil {
+		logger.Error("payload capture: purge failed", "error", err)
+	}
+}
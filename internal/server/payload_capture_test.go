@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/models"
+)
+
+func TestPayloadCaptureRate(t *testing.T) {
+	rules := []models.PayloadCaptureRule{
+		{UserID: 7, SampleRate: 1, Enabled: true},
+		{ModelPattern: "claude", SampleRate: 0.25, Enabled: true},
+		{ModelPattern: "gpt-", SampleRate: 1, Enabled: false},
+	}
+	cases := []struct {
+		userID uint
+		model  string
+		want   float64
+	}{
+		{7, "gpt-4o", 1},
+		{8, "claude-sonnet-4", 0.25},
+		{8, "gpt-4o", 0},
+	}
+	for _, tc := range cases {
+		if got := payloadCaptureRate(rules, tc.userID, tc.model); got != tc.want {
+			t.Fatalf("user %d model %s: expected %v, got %v", tc.userID, tc.model, tc.want, got)
+		}
+	}
+}
+
+func TestRedactPayloadJSON(t *testing.T) {
+	body := `{"model":"claude","api_key":"abc","max_tokens":10,"messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"my key is sk-abcdefghijklmnop"},` +
+		`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw0KGgo="}},` +
+		`{"type":"image_url","image_url":{"url":"data:image/jpeg;base64,/9j/4AAQ"}}]}]}`
+	out := redactPayload([]byte(body), "application/json")
+
+	for _, leaked := range []string{"abc\"", "abcdefghijklmnop", "iVBORw0KGgo=", "/9j/4AAQ"} {
+		if strings.Contains(out, leaked) {
+			t.Fatalf("%q leaked into %s", leaked, out)
+		}
+	}
+	for _, kept := range []string{`"max_tokens":10`, `sk-abc[redacted]`, `[redacted 12 bytes]`, `data:image/jpeg;base64,[redacted 8 bytes]`} {
+		if !strings.Contains(out, kept) {
+			t.Fatalf("expected %q in %s", kept, out)
+		}
+	}
+}
+
+func TestRedactPayloadStreamAndMultipart(t *testing.T) {
+	stream := "event: message\ndata: {\"candidates\":[{\"content\":{\"parts\":[{\"inlineData\":{\"mimeType\":\"image/png\",\"data\":\"AAAA\"}}]}}]}\n\ndata: [DONE]\n"
+	out := redactPayload([]byte(stream), "text/event-stream; charset=utf-8")
+	if strings.Contains(out, "AAAA") || !strings.Contains(out, "event: message\n") || !strings.Contains(out, "data: [DONE]") {
+		t.Fatalf("unexpected redacted stream %q", out)
+	}
+
+	if out := redactPayload([]byte("--x\r\n..."), "multipart/form-data; boundary=x"); !strings.HasPrefix(out, "[multipart body omitted") {
+		t.Fatalf("unexpected multipart capture %q", out)
+	}
+}
+
+func TestTruncatePayloadKeepsRunes(t *testing.T) {
+	out, cut := truncatePayload("héllo", 2)
+	if out != "h" || !cut {
+		t.Fatalf("expected a rune-safe cut, got %q %v", out, cut)
+	}
+	if out, cut := truncatePayload("hello", 10); out != "hello" || cut {
+		t.Fatalf("expected no cut, got %q %v", out, cut)
+	}
+}
+
+func TestCaptureWriterCopiesResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	w := &captureWriter{ResponseWriter: c.Writer, limit: 8}
+	c.Writer = w
+
+	c.Data(http.StatusTeapot, "application/json", []byte(`{"ok":true}`))
+	if rec.Body.String() != `{"ok":true}` || w.buf.String() != `{"ok":tr` || !w.truncated || w.Status() != http.StatusTeapot {
+		t.Fatalf("unexpected capture %q / %q / %d", rec.Body.String(), w.buf.String(), w.Status())
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// redactedKeys are JSON fields whose values are always replaced, wherever
+// they appear in a payload. Keys are compared lowercased.
+var redactedKeys = map[string]bool{
+	"api_key":       true,
+	"apikey":        true,
+	"x-api-key":     true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"client_secret": true,
+	"access_token":  true,
+	"refresh_token": true,
+	"id_token":      true,
+}
+
+// secretPattern matches credentials pasted into free text: relay and
+// provider keys and bearer tokens.
+var secretPattern = regexp.MustCompile(`(?i)\b(sk-[a-z0-9_-]{3})[a-z0-9_-]{8,}|\b(AIza)[0-9a-z_-]{20,}|\b(bearer\s+)[a-z0-9._~+/-]{8,}=*`)
+
+// redactPayload renders body for storage with secrets and inline media
+// removed. JSON bodies and the data lines of event streams are rewritten
+// field by field; multipart uploads are not stored at all.
+func redactPayload(body []byte, contentType string) string {
+	if len(body) == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return fmt.Sprintf("[multipart body omitted, %d bytes]", len(body))
+	case mediaType == "text/event-stream":
+		return redactSecrets(redactEventStream(body))
+	}
+	if out, ok := redactJSON(body); ok {
+		return redactSecrets(out)
+	}
+	return redactSecrets(string(bytes.ToValidUTF8(body, []byte("�"))))
+}
+
+// redactEventStream redacts the JSON payload of every data line of an SSE
+// body, leaving the framing intact.
+func redactEventStream(body []byte) string {
+	var out strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if data, ok := strings.CutPrefix(line, "data:"); ok {
+			if redacted, ok := redactJSON([]byte(strings.TrimSpace(data))); ok {
+				line = "data: " + redacted
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+// redactJSON re-encodes a JSON document with redactValue applied. It returns
+// false when body is not JSON.
+func redactJSON(body []byte) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return "", false
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(redactValue(v)); err != nil {
+		return "", false
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), true
+}
+
+// redactValue replaces secret fields and base64 media in a decoded JSON
+// value: data URLs, the data of Anthropic image sources and Gemini inline
+// data, and generated images returned as b64_json.
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, field := range val {
+			key := strings.ToLower(k)
+			switch {
+			case redactedKeys[key]:
+				val[k] = "[redacted]"
+			case key == "b64_json" || (key == "data" && isInlineMedia(val)):
+				if s, ok := field.(string); ok {
+					val[k] = redactedBytes(len(s))
+				}
+			default:
+				val[k] = redactValue(field)
+			}
+		}
+		return val
+	case []interface{}:
+		for i := range val {
+			val[i] = redactValue(val[i])
+		}
+		return val
+	case string:
+		if mediaType, data, ok := strings.Cut(val, ";base64,"); ok && strings.HasPrefix(mediaType, "data:") {
+			return mediaType + ";base64," + redactedBytes(len(data))
+		}
+	}
+	return v
+}
+
+// isInlineMedia reports whether obj is a container of base64 media, such as
+// {"type":"base64","media_type":...,"data":...} or {"mimeType":...,"data":...}.
+func isInlineMedia(obj map[string]interface{}) bool {
+	if t, _ := obj["type"].(string); t == "base64" {
+		return true
+	}
+	for _, k := range []string{"media_type", "mime_type", "mimeType"} {
+		if _, ok := obj[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func redactedBytes(n int) string {
+	return fmt.Sprintf("[redacted %d bytes]", n)
+}
+
+// redactSecrets masks credentials in free text, keeping a short prefix so
+// the kind of key stays recognisable.
+func redactSecrets(s string) string {
+	return secretPattern.ReplaceAllString(s, "$1$2$3[redacted]")
+}
+
+// truncatePayload cuts s to at most limit bytes without splitting a UTF-8
+// sequence, and reports whether anything was cut.
+func truncatePayload(s string, limit int) (string, bool) {
+	if limit <= 0 || len(s) <= limit {
+		return s, false
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut], true
+}
@@ -1,13 +1,9 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,16 +19,9 @@ import (
 // (no token-based quota). If no matching rule exists, the request passes.
 func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		path := c.FullPath()
-		if path == "" {
-			path = c.Request.URL.Path
-		}
-
 		// Only guard relay endpoints; admin and auth routes are not limited here.
-		isRelayPath := strings.HasPrefix(path, "/v1/chat/completions") ||
-			strings.HasPrefix(path, "/v1/messages") ||
-			strings.HasPrefix(path, "/v1beta/models/")
-		if !isRelayPath {
+		req, isRelay := relayRequestFromContext(c)
+		if !isRelay {
 			c.Next()
 			return
 		}
@@ -44,7 +33,17 @@ func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 		}
 		userID, ok := uidVal.(uint)
 		if !ok {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "invalid user id type"})
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "invalid user id type")
+			return
+		}
+
+		if req.free() {
+			if exceeded := countTokensLimitExceeded(app, userID); exceeded {
+				setRetryAfter(c, time.Minute-time.Duration(time.Now().Unix()%60)*time.Second)
+				abortRelayError(c, http.StatusTooManyRequests, errCodeQuotaExceeded, "token counting rate limit exceeded")
+				return
+			}
+			c.Next()
 			return
 		}
 
@@ -55,21 +54,21 @@ func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 		}
 		level, ok := levelVal.(int)
 		if !ok {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "invalid user level type"})
+			abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "invalid user level type")
 			return
 		}
 
-		model := extractModelForQuota(c, path)
+		model := req.Model
 		// If we cannot determine model, fall back to no limit.
 		if model == "" {
 			c.Next()
 			return
 		}
 
-		rule, err := findQuotaRuleForRequest(app, level, model)
+		rule, err := findQuotaRuleForRequest(app, level, req)
 		if err != nil {
 			// Fail-open on DB errors.
-			logger.Error("quota: failed to load rules", "error", err, "level", level, "model", model)
+			logger.Error("quota: failed to load rules", "error", err, "level", level, "model", model, "requestID", requestIDFromContext(c))
 			c.Next()
 			return
 		}
@@ -100,12 +99,16 @@ func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 			aligned = aligned.Add(8 * time.Hour)
 		}
 		bucket := aligned.Unix() / window
-		key := fmt.Sprintf("quota:%d:%d:%s:%d", userID, level, rule.ModelPattern, bucket)
+		scope := rule.ModelPattern
+		if rule.Endpoint != "" {
+			scope += "@" + rule.Endpoint
+		}
+		key := fmt.Sprintf("quota:%d:%d:%s:%d", userID, level, scope, bucket)
 
 		ctx := context.Background()
 		cnt, err := app.Redis.Incr(ctx, key).Result()
 		if err != nil {
-			logger.Error("quota: redis error", "error", err, "key", key)
+			logger.Error("quota: redis error", "error", err, "key", key, "requestID", requestIDFromContext(c))
 			c.Next()
 			return
 		}
@@ -115,10 +118,8 @@ func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 		}
 
 		if cnt > int64(rule.MaxRequests) {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-				"error":   "quota_exceeded",
-				"message": fmt.Sprintf("request limit exceeded for model %s", model),
-			})
+			setRetryAfter(c, time.Duration((bucket+1)*window-aligned.Unix())*time.Second)
+			abortRelayError(c, http.StatusTooManyRequests, errCodeQuotaExceeded, fmt.Sprintf("request limit exceeded for model %s", model))
 			return
 		}
 
@@ -126,68 +127,49 @@ func QuotaMiddleware(app *AppContext) gin.HandlerFunc {
 	}
 }
 
+// countTokensLimitExceeded counts a free token-counting request against the
+// per-user, per-minute limit. These requests bypass the quota rules so that
+// sizing a prompt never eats into the generation quota. Redis errors fail
+// open.
+func countTokensLimitExceeded(app *AppContext, userID uint) bool {
+	if app == nil || app.Config == nil || app.Config.CountTokensPerMinute <= 0 {
+		return false
+	}
+	if app.Redis == nil || app.Redis.Client == nil {
+		return false
+	}
+	ctx := context.Background()
+	key := fmt.Sprintf("quota:count_tokens:%d:%d", userID, time.Now().Unix()/60)
+	cnt, err := app.Redis.Incr(ctx, key).Result()
+	if err != nil {
+		logger.Error("quota: redis error", "error", err, "key", key)
+		return false
+	}
+	if cnt == 1 {
+		_ = app.Redis.Expire(ctx, key, 65*time.Second).Err()
+	}
+	return cnt > int64(app.Config.CountTokensPerMinute)
+}
+
 // findQuotaRuleForRequest selects the most specific quota rule for a given
-// user level and model name. ModelPattern is treated as a simple prefix.
-func findQuotaRuleForRequest(app *AppContext, level int, model string) (*models.QuotaRule, error) {
+// user level and request. ModelPattern is treated as a simple prefix, and a
+// rule scoped to the request's endpoint beats an endpoint-agnostic one.
+func findQuotaRuleForRequest(app *AppContext, level int, req relayRequest) (*models.QuotaRule, error) {
 	var rules []models.QuotaRule
 	if err := app.DB.Where("level = ?", level).Find(&rules).Error; err != nil {
 		return nil, err
 	}
+	return selectQuotaRule(rules, req), nil
+}
 
+func selectQuotaRule(rules []models.QuotaRule, req relayRequest) *models.QuotaRule {
 	var best *models.QuotaRule
-	bestLen := -1
+	bestRank := -1
 	for i := range rules {
-		p := rules[i].ModelPattern
-		if p == "" || strings.HasPrefix(model, p) {
-			if len(p) > bestLen {
-				bestLen = len(p)
-				best = &rules[i]
-			}
+		if rank := ruleMatchRank(rules[i].ModelPattern, rules[i].Endpoint, req.Model, req.Endpoint); rank > bestRank {
+			bestRank = rank
+			best = &rules[i]
 		}
 	}
-	return best, nil
-}
-
-// extractModelForQuota extracts the requested model name from different
-// provider-style endpoints without consuming the request body for handlers.
-func extractModelForQuota(c *gin.Context, path string) string {
-	// OpenAI /v1/chat/completions
-	if strings.HasPrefix(path, "/v1/chat/completions") {
-		body, err := io.ReadAll(c.Request.Body)
-		if err != nil {
-			return ""
-		}
-		c.Request.Body = io.NopCloser(bytes.NewReader(body))
-		var tmp struct {
-			Model string `json:"model"`
-		}
-		if err := json.Unmarshal(body, &tmp); err != nil {
-			return ""
-		}
-		return tmp.Model
-	}
-
-	// Claude /v1/messages
-	if strings.HasPrefix(path, "/v1/messages") {
-		body, err := io.ReadAll(c.Request.Body)
-		if err != nil {
-			return ""
-		}
-		c.Request.Body = io.NopCloser(bytes.NewReader(body))
-		var tmp struct {
-			Model string `json:"model"`
-		}
-		if err := json.Unmarshal(body, &tmp); err != nil {
-			return ""
-		}
-		return tmp.Model
-	}
-
-	// Gemini /v1beta/models/*: model is encoded in URL path.
-	if strings.HasPrefix(path, "/v1beta/models/") {
-		param := c.Param("path")
-		return extractGeminiModelName(param)
-	}
-
-	return ""
+	return best
 }
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/relay"
+)
+
+// Stable codes for errors the relay raises itself, reported as the OpenAI
+// error code.
+const (
+	errCodeInvalidAPIKey       = "invalid_api_key"
+	errCodeUserDisabled        = "user_disabled"
+	errCodeAPIKeyRequired      = "api_key_required"
+	errCodeQuotaExceeded       = "quota_exceeded"
+	errCodeConcurrencyExceeded = "concurrency_limit_exceeded"
+	errCodeCreditInsufficient  = "credit_insufficient"
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeNoAvailableChannel  = "no_available_channel"
+	errCodeChannelSaturated    = "channel_rate_limited"
+	errCodeUpstreamFailed      = "upstream_request_failed"
+	errCodeUpstreamTimeout     = "upstream_timeout"
+	errCodeResponseNotFound    = "response_not_found"
+	errCodeInternal            = "internal_error"
+)
+
+// relayErrorFormat returns the error shape clients of path expect, and false
+// for paths outside the relay API, which keep the {"error": message} shape
+// the web console reads. Anthropic's model listing is recognised by the
+// anthropic-version header, as in listModels.
+func relayErrorFormat(c *gin.Context) (relay.Format, bool) {
+	path := c.Request.URL.Path
+	switch {
+	case path == "/v1/messages" || strings.HasPrefix(path, "/v1/messages/"):
+		return relay.FormatAnthropic, true
+	case strings.HasPrefix(path, "/v1beta/"):
+		return relay.FormatGemini, true
+	case path == "/v1/models" && c.GetHeader("anthropic-version") != "":
+		return relay.FormatAnthropic, true
+	case strings.HasPrefix(path, "/v1/"):
+		return relay.FormatOpenAI, true
+	}
+	return relay.FormatAuto, false
+}
+
+// abortRelayError ends the request with an error raised by the relay itself,
+// rendered in the shape of the API that was called.
+func abortRelayError(c *gin.Context, status int, code, message string) {
+	format, ok := relayErrorFormat(c)
+	if !ok {
+		c.AbortWithStatusJSON(status, gin.H{"error": message})
+		return
+	}
+	status, body := relay.ErrorBody(format, status, code, message)
+	c.Abort()
+	c.Data(status, "application/json", body)
+}
+
+// setRetryAfter tells the client when a limited request may be retried,
+// rounding up to whole seconds.
+func setRetryAfter(c *gin.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// upstreamFailureError maps an error from sending a request upstream to the
+// status and code reported to the client.
+func upstreamFailureError(err error) (int, string) {
+	if relay.IsTimeout(err) {
+		return http.StatusGatewayTimeout, errCodeUpstreamTimeout
+	}
+	return http.StatusBadGateway, errCodeUpstreamFailed
+}
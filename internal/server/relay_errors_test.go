@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAbortRelayErrorUsesEndpointShape(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/v1/chat/completions", `{"error":{"code":"quota_exceeded","message":"limited","type":"rate_limit_error"}}`},
+		{"/v1/messages", `{"error":{"message":"limited","type":"rate_limit_error"},"type":"error"}`},
+		{"/v1beta/models/gemini-pro:generateContent", `{"error":{"code":429,"message":"limited","status":"RESOURCE_EXHAUSTED"}}`},
+		{"/me", `{"error":"limited"}`},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		c.Request = httptest.NewRequest(http.MethodPost, tc.path, nil)
+		setRetryAfter(c, 1500*time.Millisecond)
+		abortRelayError(c, http.StatusTooManyRequests, errCodeQuotaExceeded, "limited")
+
+		if !c.IsAborted() || rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+			t.Fatalf("%s: unexpected response %d %v", tc.path, rec.Code, rec.Header())
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != tc.want {
+			t.Fatalf("%s: expected %s, got %s", tc.path, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/models"
+)
+
+// modelListing is one model the caller may use, with the credit pricing that
+// applies to it.
+type modelListing struct {
+	ID      string
+	Created time.Time
+	Price   creditPrice
+}
+
+// listModels answers GET /v1/models with every model served by an enabled
+// channel open to the caller's level. The OpenAI list shape is returned by
+// default; clients that send anthropic-version get Anthropic's shape. Both
+// carry the credit pricing as extra fields.
+func listModels(c *gin.Context, app *AppContext) {
+	levelVal, _ := c.Get("level")
+	level, _ := levelVal.(int)
+
+	channels, err := channelsForLevel(app, level)
+	if err != nil {
+		abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "failed to list models")
+		return
+	}
+	var rules []models.ModelCreditRule
+	if err := app.DB.Order("model_pattern ASC").Find(&rules).Error; err != nil {
+		abortRelayError(c, http.StatusInternalServerError, errCodeInternal, "failed to load model credit rules")
+		return
+	}
+	defaultCost := 0
+	if app.Config != nil {
+		defaultCost = app.Config.DefaultModelCreditCost
+	}
+
+	listing := collectModelListing(channels, rules, defaultCost)
+	if c.GetHeader("anthropic-version") != "" {
+		c.JSON(http.StatusOK, anthropicModelList(listing))
+		return
+	}
+	c.JSON(http.StatusOK, openAIModelList(listing))
+}
+
+// collectModelListing merges the models of all channels, sorted by name. A
+// model offered by several channels is listed once, dated by the oldest
+// channel.
+func collectModelListing(channels []models.Channel, rules []models.ModelCreditRule, defaultCost int) []modelListing {
+	byID := map[string]*modelListing{}
+	for i := range channels {
+		for _, m := range channelModels(&channels[i]) {
+			if m == "" {
+				continue
+			}
+			if existing, ok := byID[m]; ok {
+				if channels[i].CreatedAt.Before(existing.Created) {
+					existing.Created = channels[i].CreatedAt
+				}
+				continue
+			}
+			byID[m] = &modelListing{
+				ID:      m,
+				Created: channels[i].CreatedAt,
+				Price:   selectCreditPrice(m, "", rules, defaultCost),
+			}
+		}
+	}
+
+	out := make([]modelListing, 0, len(byID))
+	for _, m := range byID {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// addPricing attaches the credit pricing of a model to its list entry.
+func addPricing(entry gin.H, price creditPrice) gin.H {
+	entry["credit_cost"] = price.Flat
+	if price.tokenBased() {
+		entry["input_price_per_million"] = price.InputPerMillion
+		entry["output_price_per_million"] = price.OutputPerMillion
+		entry["cached_price_per_million"] = price.CachedPerMillion
+	}
+	if price.PerImage > 0 {
+		entry["price_per_image"] = price.PerImage
+	}
+	if price.PerAudioSecond > 0 {
+		entry["price_per_audio_second"] = price.PerAudioSecond
+	}
+	return entry
+}
+
+func openAIModelList(listing []modelListing) gin.H {
+	data := make([]gin.H, 0, len(listing))
+	for _, m := range listing {
+		data = append(data, addPricing(gin.H{
+			"id":       m.ID,
+			"object":   "model",
+			"created":  m.Created.Unix(),
+			"owned_by": "linuxdo-relay",
+		}, m.Price))
+	}
+	return gin.H{"object": "list", "data": data}
+}
+
+func anthropicModelList(listing []modelListing) gin.H {
+	data := make([]gin.H, 0, len(listing))
+	for _, m := range listing {
+		data = append(data, addPricing(gin.H{
+			"type":         "model",
+			"id":           m.ID,
+			"display_name": m.ID,
+			"created_at":   m.Created.UTC().Format(time.RFC3339),
+		}, m.Price))
+	}
+	res := gin.H{"data": data, "has_more": false, "first_id": nil, "last_id": nil}
+	if len(listing) > 0 {
+		res["first_id"] = listing[0].ID
+		res["last_id"] = listing[len(listing)-1].ID
+	}
+	return res
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/models"
+)
+
+func TestCollectModelListingMergesChannels(t *testing.T) {
+	older := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(24 * time.Hour)
+	channels := []models.Channel{
+		{ID: 1, Models: `["gpt-4o","claude-sonnet-4"]`, CreatedAt: newer},
+		{ID: 2, Models: `["gpt-4o"]`, CreatedAt: older},
+		{ID: 3, Models: `not json`, CreatedAt: older},
+	}
+	rules := []models.ModelCreditRule{
+		{ModelPattern: "gpt-", CreditCost: 3},
+		{ModelPattern: "claude", InputPricePerMillion: 3, OutputPricePerMillion: 15},
+	}
+
+	listing := collectModelListing(channels, rules, 1)
+	if len(listing) != 2 {
+		t.Fatalf("expected 2 models, got %+v", listing)
+	}
+	if listing[0].ID != "claude-sonnet-4" || listing[1].ID != "gpt-4o" {
+		t.Fatalf("expected models sorted by id, got %+v", listing)
+	}
+	if !listing[1].Created.Equal(older) {
+		t.Fatalf("expected oldest channel date, got %v", listing[1].Created)
+	}
+	if listing[1].Price.Flat != 3 || !listing[0].Price.tokenBased() {
+		t.Fatalf("unexpected pricing %+v", listing)
+	}
+}
+
+func TestAnthropicModelListShape(t *testing.T) {
+	listing := []modelListing{
+		{ID: "a", Price: creditPrice{Flat: 1}},
+		{ID: "b", Price: creditPrice{Flat: 2}},
+	}
+	res := anthropicModelList(listing)
+	if res["first_id"] != "a" || res["last_id"] != "b" || res["has_more"] != false {
+		t.Fatalf("unexpected anthropic list %+v", res)
+	}
+	data := res["data"].([]gin.H)
+	if data[0]["type"] != "model" || data[1]["credit_cost"] != 2 {
+		t.Fatalf("unexpected entries %+v", data)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Relay endpoints. Quota and credit rules may be scoped to one of these so a
+// model can be limited or priced differently per endpoint; Gemini endpoints
+// use the method name from the request path.
+const (
+	endpointChatCompletions       = "chat.completions"
+	endpointResponses             = "responses"
+	endpointCompletions           = "completions"
+	endpointEmbeddings            = "embeddings"
+	endpointImageGenerations      = "images.generations"
+	endpointAudioTranscriptions   = "audio.transcriptions"
+	endpointModerations           = "moderations"
+	endpointMessages              = "messages"
+	endpointMessagesCountTokens   = "messages.count_tokens"
+	endpointGenerateContent       = "generateContent"
+	endpointStreamGenerateContent = "streamGenerateContent"
+	endpointCountTokens           = "countTokens"
+	endpointEmbedContent          = "embedContent"
+	endpointBatchEmbedContents    = "batchEmbedContents"
+)
+
+// relayEndpointPaths maps the fixed-path relay routes to their endpoint.
+// These carry the model in the request body.
+var relayEndpointPaths = map[string]string{
+	"/v1/chat/completions":      endpointChatCompletions,
+	"/v1/responses":             endpointResponses,
+	"/v1/completions":           endpointCompletions,
+	"/v1/embeddings":            endpointEmbeddings,
+	"/v1/images/generations":    endpointImageGenerations,
+	"/v1/audio/transcriptions":  endpointAudioTranscriptions,
+	"/v1/moderations":           endpointModerations,
+	"/v1/messages":              endpointMessages,
+	"/v1/messages/count_tokens": endpointMessagesCountTokens,
+}
+
+// defaultEndpointModels are the models OpenAI assumes when a request on these
+// endpoints leaves "model" out.
+var defaultEndpointModels = map[string]string{
+	endpointImageGenerations: "dall-e-2",
+	endpointModerations:      "omni-moderation-latest",
+}
+
+// geminiMethods are the Gemini model methods the relay forwards.
+var geminiMethods = map[string]bool{
+	endpointGenerateContent:       true,
+	endpointStreamGenerateContent: true,
+	endpointCountTokens:           true,
+	endpointEmbedContent:          true,
+	endpointBatchEmbedContents:    true,
+}
+
+// isRuleEndpoint reports whether endpoint may be used to scope a rule. The
+// empty endpoint matches every request; free endpoints never see rules.
+func isRuleEndpoint(endpoint string) bool {
+	if endpoint == "" || geminiMethods[endpoint] {
+		return true
+	}
+	for _, e := range relayEndpointPaths {
+		if e == endpoint {
+			return !(relayRequest{Endpoint: e}).free()
+		}
+	}
+	return false
+}
+
+// relayRequest describes a request on one of the relay endpoints.
+// ContentType is kept so multipart bodies can be rewritten per channel.
+type relayRequest struct {
+	Model       string
+	Endpoint    string
+	ContentType string
+}
+
+// generatesOutput reports whether the endpoint produces completion tokens.
+// Token counting, embeddings and moderations only consume input, and images
+// and audio are billed in their own units.
+func (r relayRequest) generatesOutput() bool {
+	switch r.Endpoint {
+	case endpointCountTokens, endpointMessagesCountTokens, endpointEmbedContent, endpointBatchEmbedContents,
+		endpointEmbeddings, endpointModerations, endpointImageGenerations, endpointAudioTranscriptions:
+		return false
+	}
+	return true
+}
+
+// free reports whether the endpoint is exempt from credits and quota rules.
+// Anthropic's count_tokens only sizes a prompt and is limited separately.
+func (r relayRequest) free() bool {
+	return r.Endpoint == endpointMessagesCountTokens
+}
+
+// multipart reports whether the request body is multipart/form-data.
+func (r relayRequest) multipart() bool {
+	mediaType, _, _ := mime.ParseMediaType(r.ContentType)
+	return mediaType == "multipart/form-data"
+}
+
+// relayRequestFromContext identifies the relay endpoint and model of the
+// current request. The result is cached on the context so the middlewares
+// and the handler agree on it and the body is only parsed once. It returns
+// false for paths that are not relay endpoints; Model is empty when it could
+// not be determined, and Endpoint is empty for unsupported Gemini methods.
+func relayRequestFromContext(c *gin.Context) (relayRequest, bool) {
+	if val, ok := c.Get("relay_request"); ok {
+		if req, ok := val.(relayRequest); ok {
+			return req, true
+		}
+	}
+
+	path := c.FullPath()
+	if path == "" && c.Request != nil {
+		path = c.Request.URL.Path
+	}
+
+	var req relayRequest
+	if endpoint, ok := relayEndpointPaths[path]; ok {
+		req = relayRequest{Endpoint: endpoint, ContentType: c.GetHeader("Content-Type")}
+		req.Model = bodyModel(c, req)
+		if req.Model == "" {
+			req.Model = defaultEndpointModels[endpoint]
+		}
+	} else if strings.HasPrefix(path, "/v1beta/models/") {
+		model, method := parseGeminiPath(c.Param("path"))
+		if !geminiMethods[method] {
+			method = ""
+		}
+		req = relayRequest{Model: model, Endpoint: method}
+	} else {
+		return relayRequest{}, false
+	}
+	c.Set("relay_request", req)
+	return req, true
+}
+
+// bodyModel reads the "model" field of a JSON or multipart request body
+// without consuming the body for later handlers.
+func bodyModel(c *gin.Context, req relayRequest) string {
+	if c.Request == nil || c.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return ""
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if req.multipart() {
+		return multipartModel(body, req.ContentType)
+	}
+	var tmp struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &tmp); err != nil {
+		return ""
+	}
+	return tmp.Model
+}
+
+// multipartModel returns the "model" form field of a multipart body.
+func multipartModel(body []byte, contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return ""
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == "model" && part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 256))
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(value))
+		}
+	}
+}
+
+// parseGeminiPath splits a Gemini path like "/gemini-2.5-pro:streamGenerateContent"
+// into the model and method. A path without a method means generateContent.
+func parseGeminiPath(path string) (model, method string) {
+	path = strings.TrimPrefix(path, "/")
+	parts := strings.Split(path, "/")
+	last := parts[len(parts)-1]
+	if idx := strings.Index(last, ":"); idx >= 0 {
+		return last[:idx], last[idx+1:]
+	}
+	if last == "" {
+		return "", ""
+	}
+	return last, endpointGenerateContent
+}
+
+// ruleMatchRank ranks how specifically a rule with the given model prefix and
+// endpoint matches a request, or returns -1 when the rule does not apply. A
+// rule scoped to the request's endpoint outranks any endpoint-agnostic rule;
+// within each group the longest model prefix wins.
+func ruleMatchRank(pattern, ruleEndpoint, model, endpoint string) int {
+	if ruleEndpoint != "" && ruleEndpoint != endpoint {
+		return -1
+	}
+	if !strings.HasPrefix(model, pattern) {
+		return -1
+	}
+	rank := len(pattern)
+	if ruleEndpoint != "" {
+		rank += 1 << 16
+	}
+	return rank
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/logger"
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// responseChannelTTL is how long the channel that created a Responses API
+// object is remembered; upstream keeps stored responses for 30 days.
+const responseChannelTTL = 30 * 24 * time.Hour
+
+// responseOwner records where a Responses API object lives and who created
+// it, so follow-up calls reach the same channel and key and nobody else's.
+type responseOwner struct {
+	ChannelID uint
+	KeyID     uint
+	UserID    uint
+	Model     string
+}
+
+func responseChannelKey(responseID string) string {
+	return "responses:" + responseID
+}
+
+// rememberResponseChannel stores the owner of a newly created response.
+func rememberResponseChannel(app *AppContext, responseID string, owner responseOwner) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil || responseID == "" {
+		return
+	}
+	ctx := context.Background()
+	key := responseChannelKey(responseID)
+	pipe := app.Redis.TxPipeline()
+	pipe.HSet(ctx, key, map[string]interface{}{
+		"channel_id": owner.ChannelID,
+		"key_id":     owner.KeyID,
+		"user_id":    owner.UserID,
+		"model":      owner.Model,
+	})
+	pipe.Expire(ctx, key, responseChannelTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error("responses: failed to store channel", "error", err, "responseID", responseID)
+	}
+}
+
+// lookupResponseChannel returns the owner stored for responseID.
+func lookupResponseChannel(app *AppContext, responseID string) (responseOwner, bool) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil || responseID == "" {
+		return responseOwner{}, false
+	}
+	vals, err := app.Redis.HGetAll(context.Background(), responseChannelKey(responseID)).Result()
+	if err != nil || len(vals) == 0 {
+		return responseOwner{}, false
+	}
+	channelID, err := strconv.ParseUint(vals["channel_id"], 10, 64)
+	if err != nil {
+		return responseOwner{}, false
+	}
+	userID, _ := strconv.ParseUint(vals["user_id"], 10, 64)
+	keyID, _ := strconv.ParseUint(vals["key_id"], 10, 64)
+	return responseOwner{ChannelID: uint(channelID), KeyID: uint(keyID), UserID: uint(userID), Model: vals["model"]}, true
+}
+
+func forgetResponseChannel(app *AppContext, responseID string) {
+	if app == nil || app.Redis == nil || app.Redis.Client == nil {
+		return
+	}
+	_ = app.Redis.Del(context.Background(), responseChannelKey(responseID)).Err()
+}
+
+// previousResponseChannel returns the channel holding the response named by
+// previous_response_id, so a conversation continues where its state lives.
+// It returns nil when there is no such response for this user, or when the
+// channel is no longer usable for the request, leaving normal selection to
+// pick a channel. The key that created the response is preferred for the
+// first attempt.
+func previousResponseChannel(app *AppContext, c *gin.Context, body []byte, model string, level int) *models.Channel {
+	var tmp struct {
+		PreviousResponseID string `json:"previous_response_id"`
+	}
+	if err := json.Unmarshal(body, &tmp); err != nil || tmp.PreviousResponseID == "" {
+		return nil
+	}
+	owner, ok := lookupResponseChannel(app, tmp.PreviousResponseID)
+	if !ok || owner.UserID != currentUserID(c) {
+		return nil
+	}
+	var ch models.Channel
+	if err := app.DB.Where("id = ? AND status = ? AND min_level <= ?", owner.ChannelID, models.ChannelStatusEn, level).
+		First(&ch).Error; err != nil {
+		return nil
+	}
+	if !channelServesModel(&ch, model) || !channelSupportsEndpoint(&ch, endpointResponses) ||
+		drainedChannels(app, []uint{ch.ID})[ch.ID] {
+		return nil
+	}
+	if owner.KeyID != 0 {
+		c.Set("preferred_channel_key", owner.KeyID)
+	}
+	return &ch
+}
+
+func currentUserID(c *gin.Context) uint {
+	uidVal, _ := c.Get("user_id")
+	userID, _ := uidVal.(uint)
+	return userID
+}
+
+// proxyResponseFollowUp relays GET/DELETE /v1/responses/:id and its
+// sub-resources to the channel that created the response. Responses created
+// by another user, or unknown to the relay, are reported as not found. These
+// calls are logged but neither quota-limited nor charged.
+func proxyResponseFollowUp(c *gin.Context, app *AppContext, client *relay.ProxyClient) {
+	responseID := c.Param("id")
+	owner, ok := lookupResponseChannel(app, responseID)
+	if !ok || owner.UserID != currentUserID(c) {
+		abortRelayError(c, http.StatusNotFound, errCodeResponseNotFound, "response not found")
+		return
+	}
+	// The response lives on its channel only, but a disabled channel or one
+	// above the user's level is off limits like for any other request.
+	var ch models.Channel
+	if err := app.DB.Where("id = ? AND status = ? AND min_level <= ?", owner.ChannelID, models.ChannelStatusEn, c.GetInt("level")).
+		First(&ch).Error; err != nil {
+		abortRelayError(c, http.StatusServiceUnavailable, errCodeNoAvailableChannel, fmt.Sprintf("no available channel for model %s", owner.Model))
+		return
+	}
+
+	var body []byte
+	if c.Request.Method == http.MethodPost {
+		raw, err := c.GetRawData()
+		if err != nil {
+			abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, "failed to read request body")
+			return
+		}
+		body = raw
+	}
+
+	targetURL := strings.TrimRight(ch.BaseURL, "/") + c.Request.URL.Path
+	if rawQuery := relay.StripQueryCredentials(c.Request.URL.RawQuery); rawQuery != "" {
+		targetURL += "?" + rawQuery
+	}
+	keyID := assignChannelKey(app, &ch, owner.KeyID)
+	started := time.Now()
+	resp, err := client.SendUpstream(c.Request, relay.Upstream{
+		Method:    c.Request.Method,
+		URL:       targetURL,
+		APIKey:    ch.APIKey,
+		Body:      body,
+		Format:    relay.Format(ch.Format),
+		Headers:   channelHeaders(&ch),
+		Timeouts:  channelTimeouts(&ch),
+		Transport: channelTransport(&ch),
+		ChannelID: ch.ID,
+	})
+	attempt := models.APIAttempt{ChannelID: ch.ID, ChannelKeyID: keyID, Attempt: 1, LatencyMs: time.Since(started).Milliseconds(), CreatedAt: started}
+	recordChannelKeyResult(app, keyID, resp)
+	if err != nil {
+		attempt.ErrorMessage = err.Error()
+		recordRelayLog(app, c, &models.APILog{
+			Model:        owner.Model,
+			Status:       relayFailureStatus(c, err),
+			ErrorMessage: "upstream request failed: " + err.Error(),
+			ChannelID:    ch.ID,
+		}, []models.APIAttempt{attempt})
+		status, code := upstreamFailureError(err)
+		abortRelayError(c, status, code, "upstream request failed")
+		return
+	}
+	attempt.StatusCode = resp.StatusCode
+
+	res, err := client.Relay(c.Writer, c.Request, resp)
+	if err != nil {
+		recordRelayLog(app, c, newRelayLog(owner.Model, &ch, res, relayFailureStatus(c, err), "upstream response interrupted: "+err.Error()), []models.APIAttempt{attempt})
+		return
+	}
+	status := "success"
+	var errMsg string
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		status = "fail"
+		errMsg = res.ErrorMessage
+	}
+	// Follow-ups only read or delete existing responses; their usage was
+	// charged when the response was created.
+	res.Usage = relay.Usage{}
+	recordRelayLog(app, c, newRelayLog(owner.Model, &ch, res, status, errMsg), []models.APIAttempt{attempt})
+
+	if c.Request.Method == http.MethodDelete && status == "success" {
+		forgetResponseChannel(app, responseID)
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/relay"
+)
+
+func TestResponseFollowUpUnknownResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest(http.MethodGet, "/v1/responses/resp_1", nil)
+	c.Params = gin.Params{{Key: "id", Value: "resp_1"}}
+	c.Set("user_id", uint(1))
+
+	proxyResponseFollowUp(c, &AppContext{}, relay.NewProxyClient())
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown response, got %d", rec.Code)
+	}
+}
+
+func TestPreviousResponseChannelIgnoresBodiesWithoutID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if ch := previousResponseChannel(&AppContext{}, c, []byte(`{"model":"gpt-4o","input":"hi"}`), "gpt-4o", 1); ch != nil {
+		t.Fatalf("expected no pinned channel, got %+v", ch)
+	}
+}
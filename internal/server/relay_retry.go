@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"linuxdo-relay/internal/config"
+)
+
+// retryPolicy decides when a failed upstream attempt is retried on the next
+// eligible channel, and how long to wait before doing so.
+type retryPolicy struct {
+	MaxAttempts int
+	StatusCodes map[int]bool
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func retryPolicyFromConfig(cfg *config.Config) retryPolicy {
+	p := retryPolicy{MaxAttempts: 1, StatusCodes: map[int]bool{}}
+	if cfg == nil {
+		return p
+	}
+	if cfg.RelayRetryMaxAttempts > 1 {
+		p.MaxAttempts = cfg.RelayRetryMaxAttempts
+	}
+	for _, code := range cfg.RelayRetryStatusCodes {
+		p.StatusCodes[code] = true
+	}
+	p.Backoff = time.Duration(cfg.RelayRetryBackoffMs) * time.Millisecond
+	p.MaxBackoff = time.Duration(cfg.RelayRetryMaxBackoffMs) * time.Millisecond
+	return p
+}
+
+// retryable reports whether an attempt that ended with statusCode (zero when
+// no response was received) or err should be tried again.
+func (p retryPolicy) retryable(statusCode int, err error) bool {
+	if err != nil {
+		return true
+	}
+	return p.StatusCodes[statusCode]
+}
+
+// backoff returns the delay before the retry that follows the given failed
+// attempt (1-based): Backoff, then doubling, capped at MaxBackoff.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// waitBackoff sleeps for d unless ctx ends first. It reports whether the
+// full delay elapsed.
+func waitBackoff(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"linuxdo-relay/internal/config"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	p := retryPolicyFromConfig(&config.Config{
+		RelayRetryMaxAttempts: 3,
+		RelayRetryStatusCodes: []int{429, 503},
+	})
+
+	if !p.retryable(0, errors.New("dial tcp: connection refused")) {
+		t.Fatalf("transport errors must be retryable")
+	}
+	if !p.retryable(429, nil) || !p.retryable(503, nil) {
+		t.Fatalf("configured statuses must be retryable")
+	}
+	if p.retryable(400, nil) || p.retryable(200, nil) {
+		t.Fatalf("other statuses must not be retryable")
+	}
+}
+
+func TestRetryPolicyBackoffDoublesUpToCap(t *testing.T) {
+	p := retryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		if got := p.backoff(i + 1); got != want {
+			t.Fatalf("attempt %d: expected %v, got %v", i+1, want, got)
+		}
+	}
+}
+
+func TestRetryPolicyDefaultsToSingleAttempt(t *testing.T) {
+	if p := retryPolicyFromConfig(nil); p.MaxAttempts != 1 {
+		t.Fatalf("expected a single attempt without config, got %d", p.MaxAttempts)
+	}
+}
@@ -3,19 +3,22 @@ package server
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"linuxdo-relay/internal/logger"
 	"linuxdo-relay/internal/models"
 	"linuxdo-relay/internal/relay"
 )
 
 // RegisterRelayRoutes registers provider-style relay endpoints that proxy
-// transparently to new-api without any format conversion.
+// transparently to new-api. Only OpenAI chat completions sent to a native
+// Anthropic or Gemini channel are converted between formats.
 func RegisterRelayRoutes(r *gin.RouterGroup, app *AppContext) {
 	client := relay.NewProxyClient()
 
@@ -24,11 +27,47 @@ func RegisterRelayRoutes(r *gin.RouterGroup, app *AppContext) {
 		proxyToNewAPI(c, app, client, "/v1/chat/completions")
 	})
 
+	// OpenAI Responses API. Follow-up calls on a stored response go to the
+	// channel that created it.
+	r.POST("/v1/responses", func(c *gin.Context) {
+		proxyToNewAPI(c, app, client, "/v1/responses")
+	})
+	followUp := func(c *gin.Context) { proxyResponseFollowUp(c, app, client) }
+	r.GET("/v1/responses/:id", followUp)
+	r.DELETE("/v1/responses/:id", followUp)
+	r.GET("/v1/responses/:id/input_items", followUp)
+	r.POST("/v1/responses/:id/cancel", followUp)
+
+	// Other OpenAI-compatible endpoints. Audio transcriptions take a
+	// multipart body; the rest are JSON.
+	for _, path := range []string{
+		"/v1/completions",
+		"/v1/embeddings",
+		"/v1/images/generations",
+		"/v1/audio/transcriptions",
+		"/v1/moderations",
+	} {
+		r.POST(path, func(c *gin.Context) {
+			proxyToNewAPI(c, app, client, path)
+		})
+	}
+
 	// Claude /v1/messages entrypoint.
 	r.POST("/v1/messages", func(c *gin.Context) {
 		proxyToNewAPI(c, app, client, "/v1/messages")
 	})
 
+	// Claude token counting: routed like /v1/messages but free of credits and
+	// quota rules, with its own per-minute limit.
+	r.POST("/v1/messages/count_tokens", func(c *gin.Context) {
+		proxyToNewAPI(c, app, client, "/v1/messages/count_tokens")
+	})
+
+	// OpenAI-compatible model listing, also served in Anthropic's shape.
+	r.GET("/v1/models", func(c *gin.Context) {
+		listModels(c, app)
+	})
+
 	// Gemini generateContent entrypoint.
 	r.POST("/v1beta/models/*path", func(c *gin.Context) {
 		proxyToNewAPI(c, app, client, "")
@@ -42,113 +81,358 @@ func proxyToNewAPI(c *gin.Context, app *AppContext, client *relay.ProxyClient, f
 	// Read entire body; quota middleware already read-and-reset body earlier.
 	body, err := c.GetRawData()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, "failed to read request body")
 		return
 	}
 
 	// Restore body for potential further use by Gin (not strictly required here).
 	c.Request.Body = io.NopCloser(bytes.NewReader(body))
 
-	// Determine model depending on path.
-	path := c.FullPath()
-	if path == "" {
-		path = c.Request.URL.Path
-	}
-
-	var model string
-	if strings.HasPrefix(path, "/v1/chat/completions") || strings.HasPrefix(path, "/v1/messages") {
-		var tmp struct {
-			Model string `json:"model"`
-		}
-		if err := json.Unmarshal(body, &tmp); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
-			return
-		}
-		model = tmp.Model
-	} else if strings.HasPrefix(path, "/v1beta/models/") {
-		param := c.Param("path")
-		model = extractGeminiModelName(param)
-	}
-
+	req, _ := relayRequestFromContext(c)
+	model := req.Model
 	if model == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, "model is required")
 		return
 	}
-
-	// Select a channel that supports this model.
-	ch, err := pickChannelForModel(app, model)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	if req.Endpoint == "" {
+		abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, "unsupported Gemini method")
 		return
 	}
 
 	// Determine upstream path based on model name if not fixed by route.
 	upPath := fixedPath
 	if upPath == "" {
-		upPath = determineUpstreamPath(model)
+		upPath = determineUpstreamPath(model, req.Endpoint)
 	}
 
 	if upPath == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported model"})
+		abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, "unsupported model")
 		return
 	}
+	startPayloadCapture(app, c, req, body)
 
-	targetURL := strings.TrimRight(ch.BaseURL, "/") + upPath
-	if strings.HasPrefix(upPath, "/v1beta/models/") {
-		// Preserve query string (e.g. alt=sse) for Gemini.
-		if q := c.Request.URL.RawQuery; q != "" {
-			targetURL = targetURL + "?" + q
+	// Identical requests opted into the response cache are answered without
+	// going upstream.
+	cache := planResponseCache(app, c, req, body)
+	if cache != nil {
+		if hit, ok := serveCachedResponse(app, c, cache); ok {
+			recordRelayLog(app, c, &models.APILog{
+				Model:            model,
+				Status:           "success",
+				StatusCode:       hit.Status,
+				PromptTokens:     hit.Usage.PromptTokens,
+				CompletionTokens: hit.Usage.CompletionTokens,
+				CachedTokens:     hit.Usage.CachedTokens,
+				CacheHit:         true,
+			}, nil)
+			return
 		}
 	}
 
-	statusCode, err := client.ProxyRequest(c.Writer, c.Request, http.MethodPost, targetURL, ch.APIKey, body)
+	// Streams that did not ask for usage get it anyway, for billing; the
+	// usage chunk is then kept from the client.
+	clientUsage := true
+	if upPath == "/v1/chat/completions" || upPath == "/v1/completions" {
+		body, clientUsage = ensureStreamUsage(body)
+	}
+
+	// Select a channel that supports this model. A Responses API request
+	// continuing an earlier response stays on that response's channel.
+	levelVal, _ := c.Get("level")
+	level, _ := levelVal.(int)
+	var ch *models.Channel
+	if req.Endpoint == endpointResponses {
+		ch = previousResponseChannel(app, c, body, model, level)
+	}
+	if ch == nil {
+		ch, err = pickChannelQueued(c, app, req, level)
+		if errors.Is(err, errChannelsSaturated) {
+			setRetryAfter(c, time.Minute-time.Duration(time.Now().Unix()%60)*time.Second)
+			abortRelayError(c, http.StatusTooManyRequests, errCodeChannelSaturated, err.Error())
+			return
+		}
+		if err != nil {
+			abortRelayError(c, http.StatusServiceUnavailable, errCodeNoAvailableChannel, err.Error())
+			return
+		}
+	}
+
+	resp, ch, attempts, err := sendWithFailover(c, app, client, ch, req, fixedPath, body)
+	if errors.Is(err, relay.ErrInvalidRequest) {
+		abortRelayError(c, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
 	if err != nil {
 		// Network or upstream transport error before we got a valid response.
-		recordAPILogFromContext(app, c, model, 0, "fail", "upstream request failed: "+err.Error())
-		c.JSON(http.StatusBadGateway, gin.H{"error": "upstream request failed"})
+		logger.Warn("relay: upstream request failed", "error", err, "model", model, "channelID", ch.ID, "requestID", requestIDFromContext(c))
+		recordRelayLog(app, c, &models.APILog{
+			Model:        model,
+			Status:       relayFailureStatus(c, err),
+			ErrorMessage: "upstream request failed: " + err.Error(),
+			ChannelID:    ch.ID,
+		}, attempts)
+		status, code := upstreamFailureError(err)
+		abortRelayError(c, status, code, "upstream request failed")
+		return
+	}
+
+	var cacheWriter *captureWriter
+	if cache != nil {
+		cacheWriter = &captureWriter{ResponseWriter: c.Writer, limit: maxCachedResponseSize}
+		c.Writer = cacheWriter
+		c.Header(cacheHeader, "MISS")
+	}
+	res, err := client.RelayTranslated(c.Writer, c.Request, resp, responseTranslator(ch, req, clientUsage), !clientUsage)
+	recordChannelTokens(app, ch, res.Usage)
+	if !res.Usage.IsZero() {
+		// Lets CreditMiddleware settle token-priced requests.
+		c.Set("relay_usage", res.Usage)
+	}
+	if req.Endpoint == endpointResponses && res.ResponseID != "" && res.StatusCode >= 200 && res.StatusCode < 300 {
+		rememberResponseChannel(app, res.ResponseID, responseOwner{ChannelID: ch.ID, KeyID: attempts[len(attempts)-1].ChannelKeyID, UserID: currentUserID(c), Model: model})
+	}
+	if err != nil {
+		// Headers (and possibly part of a stream) already went out, so we
+		// can only record that the relay was cut short.
+		logger.Warn("relay: upstream response interrupted", "error", err, "model", model, "channelID", ch.ID, "requestID", requestIDFromContext(c))
+		recordRelayLog(app, c, newRelayLog(model, ch, res, relayFailureStatus(c, err), "upstream response interrupted: "+err.Error()), attempts)
 		return
 	}
 
 	// Successful round-trip to upstream; record log with actual status code.
 	status := "success"
 	var errMsg string
-	if statusCode < 200 || statusCode >= 300 {
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
 		status = "fail"
-		// We don't parse body here; HTTP status code is usually enough for debugging.
+		errMsg = res.ErrorMessage
+	} else if cache != nil {
+		storeCachedResponse(app, cache, cacheWriter, res)
 	}
-	recordAPILogFromContext(app, c, model, statusCode, status, errMsg)
+	recordRelayLog(app, c, newRelayLog(model, ch, res, status, errMsg), attempts)
 }
 
-// pickChannelForModel selects an enabled channel whose models JSON list
-// contains the requested model name.
-func pickChannelForModel(app *AppContext, model string) (*models.Channel, error) {
-	var channels []models.Channel
-	if err := app.DB.Where("status = ?", models.ChannelStatusEn).Find(&channels).Error; err != nil {
-		return nil, fmt.Errorf("no available channel")
+// sendWithFailover sends the request to ch and, while the retry policy
+// allows, retries transport errors and retryable statuses on the next
+// eligible channel serving model. Nothing is written to the client here, so a
+// retried response never reaches it. Every attempt is returned for logging,
+// along with the channel that produced the final response.
+//
+// The model name is translated through each channel's model mapping before
+// the request goes out, so req.Model stays the public name throughout. The
+// body is converted per channel too, when a native channel needs another
+// protocol. A body the first channel cannot take ends the loop with an error
+// wrapping relay.ErrInvalidRequest; failover channels that cannot take it are
+// skipped instead, since the request already reached an upstream.
+func sendWithFailover(c *gin.Context, app *AppContext, client *relay.ProxyClient, ch *models.Channel, req relayRequest, fixedPath string, body []byte) (*http.Response, *models.Channel, []models.APIAttempt, error) {
+	policy := retryPolicyFromConfig(app.Config)
+	tried := map[uint]bool{ch.ID: true}
+	var attempts []models.APIAttempt
+	keyID := assignChannelKey(app, ch, c.GetUint("preferred_channel_key"))
+	up, err := upstreamCall(ch, req, fixedPath, body, c.Request.URL.RawQuery)
+	if err != nil {
+		releaseChannelProbe(app, ch.ID)
+		return nil, ch, attempts, err
 	}
+	for {
+		started := time.Now()
+		resp, err := client.SendUpstream(c.Request, up)
+
+		statusCode := 0
+		attempt := models.APIAttempt{
+			ChannelID:    ch.ID,
+			ChannelKeyID: keyID,
+			Attempt:      len(attempts) + 1,
+			LatencyMs:    time.Since(started).Milliseconds(),
+			CreatedAt:    started,
+		}
+		if err != nil {
+			attempt.ErrorMessage = err.Error()
+		} else {
+			statusCode = resp.StatusCode
+			attempt.StatusCode = statusCode
+		}
+		attempts = append(attempts, attempt)
+		if err != nil && c.Request.Context().Err() != nil {
+			// The client went away; that says nothing about the channel and
+			// leaves nobody to retry for. A probe this attempt held is freed
+			// for the next request.
+			releaseChannelProbe(app, ch.ID)
+			return nil, ch, attempts, err
+		}
+		recordChannelResult(app, ch.ID, statusCode, err, time.Since(started))
+		exhausted := recordChannelKeyResult(app, keyID, resp)
 
-	for i := range channels {
-		var ms []string
-		if err := json.Unmarshal([]byte(channels[i].Models), &ms); err != nil {
-			continue
+		// A retired key is always worth another attempt, on the same channel
+		// while it has keys left.
+		if len(attempts) >= policy.MaxAttempts || (!exhausted && !policy.retryable(statusCode, err)) {
+			return resp, ch, attempts, err
 		}
-		for _, m := range ms {
-			if m == model {
-				return &channels[i], nil
+		var retry *models.Channel
+		if exhausted && channelHasActiveKey(app, ch.ID) {
+			retry = ch
+		}
+		// The next channel is picked only after the backoff, so a client
+		// leaving meanwhile never holds its rate slot or breaker probe.
+		if !waitBackoff(c.Request.Context(), policy.backoff(len(attempts))) {
+			relay.Discard(resp)
+			return nil, ch, attempts, c.Request.Context().Err()
+		}
+		next, nextKeyID, nextUp, ok := nextFailoverCall(c, app, req, fixedPath, body, retry, tried)
+		if !ok {
+			// No other channel left; hand back what we have.
+			return resp, ch, attempts, err
+		}
+		relay.Discard(resp)
+		ch, keyID, up = next, nextKeyID, nextUp
+	}
+}
+
+// nextFailoverCall picks the channel for the next attempt, starting with
+// retry when set, and builds its upstream call. Channels that cannot take the
+// body are ruled out before picking, so none of them claims a rate slot or
+// breaker probe. It returns false when no channel is left.
+func nextFailoverCall(c *gin.Context, app *AppContext, req relayRequest, fixedPath string, body []byte, retry *models.Channel, tried map[uint]bool) (*models.Channel, uint, relay.Upstream, bool) {
+	next := retry
+	if next == nil {
+		level := c.GetInt("level")
+		if channels, err := channelsForModel(app, req.Model, level); err == nil {
+			for i := range channels {
+				if tried[channels[i].ID] {
+					continue
+				}
+				if _, err := upstreamCall(&channels[i], req, fixedPath, body, ""); err != nil {
+					logger.Warn("relay: skipping failover channel", "error", err, "channelID", channels[i].ID, "requestID", requestIDFromContext(c))
+					tried[channels[i].ID] = true
+				}
 			}
 		}
+		var err error
+		if next, err = pickChannelForModel(app, req, level, tried); err != nil {
+			return nil, 0, relay.Upstream{}, false
+		}
+	}
+	tried[next.ID] = true
+	keyID := assignChannelKey(app, next, 0)
+	up, err := upstreamCall(next, req, fixedPath, body, c.Request.URL.RawQuery)
+	if err != nil {
+		return nil, 0, relay.Upstream{}, false
+	}
+	return next, keyID, up, true
+}
+
+// channelTransport returns the transport settings configured on ch.
+func channelTransport(ch *models.Channel) relay.TransportConfig {
+	return relay.TransportConfig{
+		ProxyURL:            strings.TrimSpace(ch.ProxyURL),
+		CACert:              strings.TrimSpace(ch.CACert),
+		TLSServerName:       strings.TrimSpace(ch.TLSServerName),
+		DisableHTTP2:        ch.DisableHTTP2,
+		MaxIdleConnsPerHost: ch.MaxIdleConnsPerHost,
+	}
+}
+
+// channelTimeouts returns the upstream timeouts configured on ch.
+func channelTimeouts(ch *models.Channel) relay.Timeouts {
+	return relay.Timeouts{
+		Connect: time.Duration(ch.ConnectTimeoutSeconds) * time.Second,
+		Header:  time.Duration(ch.HeaderTimeoutSeconds) * time.Second,
+		Idle:    time.Duration(ch.IdleTimeoutSeconds) * time.Second,
+	}
+}
+
+// relayFailureStatus returns the log status for a relay that ended with err:
+// "cancelled" when the client hung up, "timeout" when an upstream timeout
+// fired, and "fail" otherwise.
+func relayFailureStatus(c *gin.Context, err error) string {
+	if c.Request.Context().Err() != nil {
+		return "cancelled"
+	}
+	if relay.IsTimeout(err) {
+		return "timeout"
+	}
+	return "fail"
+}
+
+// upstreamURL joins the channel base URL and upstream path.
+func upstreamURL(ch *models.Channel, upPath, rawQuery string) string {
+	targetURL := strings.TrimRight(ch.BaseURL, "/") + upPath
+	if strings.HasPrefix(upPath, "/v1beta/models/") {
+		// Preserve query string (e.g. alt=sse) for Gemini, minus any key
+		// the client authenticated with.
+		if rawQuery = relay.StripQueryCredentials(rawQuery); rawQuery != "" {
+			targetURL = targetURL + "?" + rawQuery
+		}
 	}
+	return targetURL
+}
 
-	return nil, fmt.Errorf("no channel supports model %s", model)
+// newRelayLog builds an API log entry for a relayed response, including the
+// token usage upstream reported.
+func newRelayLog(model string, ch *models.Channel, res relay.ProxyResult, status, errMsg string) *models.APILog {
+	return &models.APILog{
+		Model:            model,
+		ChannelID:        ch.ID,
+		Status:           status,
+		StatusCode:       res.StatusCode,
+		ErrorMessage:     errMsg,
+		PromptTokens:     res.Usage.PromptTokens,
+		CompletionTokens: res.Usage.CompletionTokens,
+		CachedTokens:     res.Usage.CachedTokens,
+	}
+}
+
+// ensureStreamUsage asks OpenAI-style upstreams to append a usage chunk to
+// streamed chat and legacy completions. Without stream_options.include_usage
+// the stream carries no token counts at all. It also reports whether the
+// client asked for the usage chunk itself; bodies that are not streaming, or
+// that already ask for it, are returned unchanged.
+func ensureStreamUsage(body []byte) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, true
+	}
+	var stream bool
+	if err := json.Unmarshal(fields["stream"], &stream); err != nil || !stream {
+		return body, true
+	}
+	var opts map[string]json.RawMessage
+	if raw, ok := fields["stream_options"]; ok {
+		if err := json.Unmarshal(raw, &opts); err != nil {
+			return body, true
+		}
+		var include bool
+		if err := json.Unmarshal(opts["include_usage"], &include); err == nil && include {
+			return body, true
+		}
+	}
+	if opts == nil {
+		opts = map[string]json.RawMessage{}
+	}
+	opts["include_usage"] = json.RawMessage("true")
+	rawOpts, err := json.Marshal(opts)
+	if err != nil {
+		return body, true
+	}
+	fields["stream_options"] = rawOpts
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body, true
+	}
+	return out, false
 }
 
 // determineUpstreamPath maps a model name to the appropriate new-api path.
-func determineUpstreamPath(model string) string {
+// A request on the Gemini route keeps the method the client called, e.g.
+// streamGenerateContent, whatever the model is named.
+func determineUpstreamPath(model, method string) string {
 	lower := strings.ToLower(model)
 
-	// Gemini models: gemini-*.
-	if strings.HasPrefix(lower, "gemini-") {
-		return "/v1beta/models/" + model + ":generateContent"
+	// Gemini route, or Gemini models: gemini-*.
+	if geminiMethods[method] || strings.HasPrefix(lower, "gemini-") {
+		if method == "" {
+			method = endpointGenerateContent
+		}
+		return "/v1beta/models/" + model + ":" + method
 	}
 
 	// Anthropic Claude models.
@@ -163,14 +447,6 @@ func determineUpstreamPath(model string) string {
 // extractGeminiModelName parses model name from a Gemini path like
 // "models/gemini-1.5-pro:generateContent".
 func extractGeminiModelName(path string) string {
-	path = strings.TrimPrefix(path, "/")
-	parts := strings.Split(path, "/")
-	if len(parts) == 0 {
-		return ""
-	}
-	last := parts[len(parts)-1]
-	if idx := strings.Index(last, ":"); idx >= 0 {
-		return last[:idx]
-	}
-	return last
+	model, _ := parseGeminiPath(path)
+	return model
 }
@@ -1,19 +1,37 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
 
 func TestDetermineUpstreamPath(t *testing.T) {
 	cases := []struct {
 		model    string
+		method   string
 		expected string
 	}{
-		{"gemini-1.5-pro", "/v1beta/models/gemini-1.5-pro:generateContent"},
-		{"claude-3", "/v1/messages"},
-		{"gpt-4o", "/v1/chat/completions"},
+		{"gemini-1.5-pro", "", "/v1beta/models/gemini-1.5-pro:generateContent"},
+		{"gemini-1.5-pro", "streamGenerateContent", "/v1beta/models/gemini-1.5-pro:streamGenerateContent"},
+		{"gemini-2.5-flash", "countTokens", "/v1beta/models/gemini-2.5-flash:countTokens"},
+		{"learnlm-2.0-flash", "generateContent", "/v1beta/models/learnlm-2.0-flash:generateContent"},
+		{"text-embedding-004", "embedContent", "/v1beta/models/text-embedding-004:embedContent"},
+		{"claude-3", "", "/v1/messages"},
+		{"gpt-4o", "", "/v1/chat/completions"},
 	}
 
 	for _, tc := range cases {
-		if got := determineUpstreamPath(tc.model); got != tc.expected {
+		if got := determineUpstreamPath(tc.model, tc.method); got != tc.expected {
 			t.Fatalf("model %s: expected %s, got %s", tc.model, tc.expected, got)
 		}
 	}
@@ -36,3 +54,113 @@ func TestExtractGeminiModelName(t *testing.T) {
 		}
 	}
 }
+
+func TestParseGeminiPath(t *testing.T) {
+	cases := []struct {
+		path   string
+		model  string
+		method string
+	}{
+		{"/gemini-2.5-pro:streamGenerateContent", "gemini-2.5-pro", "streamGenerateContent"},
+		{"/text-embedding-004:batchEmbedContents", "text-embedding-004", "batchEmbedContents"},
+		{"/gemini-pro", "gemini-pro", "generateContent"},
+		{"", "", ""},
+	}
+
+	for _, tc := range cases {
+		model, method := parseGeminiPath(tc.path)
+		if model != tc.model || method != tc.method {
+			t.Fatalf("path %s: expected %s/%s, got %s/%s", tc.path, tc.model, tc.method, model, method)
+		}
+	}
+}
+
+func TestSelectQuotaRulePrefersEndpointScope(t *testing.T) {
+	rules := []models.QuotaRule{
+		{ModelPattern: "gemini-2.5", MaxRequests: 10},
+		{ModelPattern: "", Endpoint: "countTokens", MaxRequests: 100},
+		{ModelPattern: "gemini", Endpoint: "embedContent", MaxRequests: 50},
+	}
+
+	if got := selectQuotaRule(rules, relayRequest{Model: "gemini-2.5-pro", Endpoint: "countTokens"}); got == nil || got.MaxRequests != 100 {
+		t.Fatalf("expected countTokens rule, got %+v", got)
+	}
+	if got := selectQuotaRule(rules, relayRequest{Model: "gemini-2.5-pro", Endpoint: "generateContent"}); got == nil || got.MaxRequests != 10 {
+		t.Fatalf("expected model rule, got %+v", got)
+	}
+	if got := selectQuotaRule(rules, relayRequest{Model: "gpt-4o", Endpoint: "chat.completions"}); got != nil {
+		t.Fatalf("expected no rule, got %+v", got)
+	}
+}
+
+func TestEnsureStreamUsage(t *testing.T) {
+	added := []string{
+		`{"model":"gpt-4o","stream":true}`,
+		`{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":false}}`,
+	}
+	for _, body := range added {
+		out, clientUsage := ensureStreamUsage([]byte(body))
+		var got struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		if err := json.Unmarshal(out, &got); err != nil {
+			t.Fatalf("invalid output: %v", err)
+		}
+		if !got.StreamOptions.IncludeUsage || clientUsage {
+			t.Fatalf("%s: expected include_usage to be added for the relay, got %s (client %v)", body, out, clientUsage)
+		}
+	}
+
+	unchanged := []string{
+		`{"model":"gpt-4o"}`,
+		`{"model":"gpt-4o","stream":false}`,
+		`{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true}}`,
+	}
+	for _, body := range unchanged {
+		if got, clientUsage := ensureStreamUsage([]byte(body)); string(got) != body || !clientUsage {
+			t.Fatalf("expected %s to stay unchanged, got %s (client %v)", body, got, clientUsage)
+		}
+	}
+}
+
+func TestRelayRequestCountTokensIsFree(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages/count_tokens", strings.NewReader(`{"model":"claude-sonnet-4","messages":[]}`))
+
+	req, ok := relayRequestFromContext(c)
+	if !ok || req.Endpoint != endpointMessagesCountTokens || req.Model != "claude-sonnet-4" {
+		t.Fatalf("unexpected relay request %+v (%v)", req, ok)
+	}
+	if !req.free() || req.generatesOutput() {
+		t.Fatalf("count_tokens must be free and produce no output")
+	}
+	if isRuleEndpoint(endpointMessagesCountTokens) {
+		t.Fatalf("rules must not be scoped to a free endpoint")
+	}
+	if (relayRequest{Endpoint: endpointMessages}).free() {
+		t.Fatalf("messages must not be free")
+	}
+}
+
+func TestRelayFailureStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	if got := relayFailureStatus(c, errors.New("connection reset")); got != "fail" {
+		t.Fatalf("expected fail, got %s", got)
+	}
+	if got := relayFailureStatus(c, relay.ErrHeaderTimeout); got != "timeout" {
+		t.Fatalf("expected timeout, got %s", got)
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	cancel()
+	c.Request = c.Request.WithContext(ctx)
+	if got := relayFailureStatus(c, context.Canceled); got != "cancelled" {
+		t.Fatalf("expected cancelled, got %s", got)
+	}
+}
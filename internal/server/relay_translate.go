@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// channelTranslates reports whether req has to be translated before it can go
+// to ch: OpenAI chat completions sent to a native provider channel, or
+// Anthropic messages sent to an OpenAI channel.
+func channelTranslates(ch *models.Channel, req relayRequest) bool {
+	switch ch.Format {
+	case models.ChannelFormatAnthropic, models.ChannelFormatGemini:
+		return req.Endpoint == endpointChatCompletions
+	case models.ChannelFormatOpenAI:
+		return req.Endpoint == endpointMessages
+	}
+	return false
+}
+
+// upstreamCall builds the request sent to ch: the body with the channel's
+// model name, the upstream URL and the way the channel key is presented.
+// Requests for native channels in another protocol are translated; a body
+// that cannot be translated yields an error wrapping relay.ErrInvalidRequest.
+func upstreamCall(ch *models.Channel, req relayRequest, fixedPath string, body []byte, rawQuery string) (relay.Upstream, error) {
+	up := relay.Upstream{
+		Method:    http.MethodPost,
+		APIKey:    ch.APIKey,
+		Format:    relay.Format(ch.Format),
+		Headers:   channelHeaders(ch),
+		Timeouts:  channelTimeouts(ch),
+		Transport: channelTransport(ch),
+		ChannelID: ch.ID,
+	}
+	if !channelTranslates(ch, req) {
+		upPath, upBody := upstreamRequest(ch, req, fixedPath, body)
+		up.URL = upstreamURL(ch, upPath, rawQuery)
+		up.Body = upBody
+		return up, nil
+	}
+
+	upModel := upstreamModelName(ch, req.Model)
+	switch ch.Format {
+	case models.ChannelFormatAnthropic:
+		out, _, err := relay.OpenAIChatToAnthropic(body, upModel)
+		if err != nil {
+			return up, err
+		}
+		up.URL = upstreamURL(ch, "/v1/messages", "")
+		up.Body = out
+	case models.ChannelFormatGemini:
+		out, stream, err := relay.OpenAIChatToGemini(body)
+		if err != nil {
+			return up, err
+		}
+		if stream {
+			up.URL = upstreamURL(ch, "/v1beta/models/"+upModel+":"+endpointStreamGenerateContent, "alt=sse")
+		} else {
+			up.URL = upstreamURL(ch, "/v1beta/models/"+upModel+":"+endpointGenerateContent, "")
+		}
+		up.Body = out
+	case models.ChannelFormatOpenAI:
+		out, _, err := relay.AnthropicToOpenAIChat(body, upModel)
+		if err != nil {
+			return up, err
+		}
+		up.URL = upstreamURL(ch, "/v1/chat/completions", "")
+		up.Body = out
+	}
+	return up, nil
+}
+
+// responseTranslator returns the translator turning ch's responses back into
+// the protocol of req, or nil when the response is relayed as it is.
+// Translated responses report the public model name, and OpenAI chat streams
+// end with a usage chunk only when includeUsage is set.
+func responseTranslator(ch *models.Channel, req relayRequest, includeUsage bool) relay.Translator {
+	if !channelTranslates(ch, req) {
+		return nil
+	}
+	switch ch.Format {
+	case models.ChannelFormatAnthropic:
+		return relay.NewAnthropicChatTranslator(req.Model, includeUsage)
+	case models.ChannelFormatGemini:
+		return relay.NewGeminiChatTranslator(req.Model, includeUsage)
+	case models.ChannelFormatOpenAI:
+		return relay.NewOpenAIMessagesTranslator(req.Model)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+func TestChannelSupportsEndpoint(t *testing.T) {
+	cases := []struct {
+		format   string
+		endpoint string
+		want     bool
+	}{
+		{models.ChannelFormatAuto, endpointResponses, true},
+		{models.ChannelFormatAnthropic, endpointMessages, true},
+		{models.ChannelFormatAnthropic, endpointChatCompletions, true},
+		{models.ChannelFormatAnthropic, endpointResponses, false},
+		{models.ChannelFormatGemini, endpointStreamGenerateContent, true},
+		{models.ChannelFormatGemini, endpointChatCompletions, true},
+		{models.ChannelFormatGemini, endpointMessages, false},
+		{models.ChannelFormatOpenAI, endpointMessages, true},
+		{models.ChannelFormatOpenAI, endpointEmbeddings, true},
+		{models.ChannelFormatOpenAI, endpointMessagesCountTokens, false},
+		{models.ChannelFormatOpenAI, endpointGenerateContent, false},
+	}
+	for _, tc := range cases {
+		ch := &models.Channel{Format: tc.format}
+		if got := channelSupportsEndpoint(ch, tc.endpoint); got != tc.want {
+			t.Fatalf("format %q endpoint %q: expected %v, got %v", tc.format, tc.endpoint, tc.want, got)
+		}
+	}
+}
+
+func TestUpstreamCallTranslatesForNativeChannels(t *testing.T) {
+	req := relayRequest{Model: "gemini-pro", Endpoint: endpointChatCompletions}
+	body := []byte(`{"model":"gemini-pro","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	ch := &models.Channel{BaseURL: "https://generativelanguage.googleapis.com/", APIKey: "k", Format: models.ChannelFormatGemini, ModelMapping: `{"gemini-pro":"gemini-2.5-pro"}`}
+
+	up, err := upstreamCall(ch, req, "/v1/chat/completions", body, "")
+	if err != nil {
+		t.Fatalf("upstreamCall: %v", err)
+	}
+	if up.URL != "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse" {
+		t.Fatalf("unexpected url %s", up.URL)
+	}
+	if up.Format != relay.FormatGemini || !strings.Contains(string(up.Body), `"contents"`) {
+		t.Fatalf("unexpected upstream %+v", up)
+	}
+	if responseTranslator(ch, req, true) == nil {
+		t.Fatalf("expected a response translator")
+	}
+
+	ch = &models.Channel{BaseURL: "https://api.anthropic.com", Format: models.ChannelFormatAnthropic, ModelMapping: `{}`}
+	claude := relayRequest{Model: "claude-sonnet-4", Endpoint: endpointChatCompletions}
+	up, err = upstreamCall(ch, claude, "/v1/chat/completions", []byte(`{"messages":[{"role":"user","content":"hi"}]}`), "")
+	if err != nil || up.URL != "https://api.anthropic.com/v1/messages" || !strings.Contains(string(up.Body), `"model":"claude-sonnet-4"`) {
+		t.Fatalf("unexpected anthropic upstream %+v err=%v", up, err)
+	}
+	if _, err := upstreamCall(ch, claude, "/v1/chat/completions", []byte(`{"messages":"hi"}`), ""); !errors.Is(err, relay.ErrInvalidRequest) {
+		t.Fatalf("expected ErrInvalidRequest, got %v", err)
+	}
+
+	ch = &models.Channel{BaseURL: "https://api.openai.com", Format: models.ChannelFormatOpenAI, ModelMapping: `{}`}
+	messages := relayRequest{Model: "gpt-4o", Endpoint: endpointMessages}
+	up, err = upstreamCall(ch, messages, "/v1/messages", []byte(`{"max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`), "")
+	if err != nil || up.URL != "https://api.openai.com/v1/chat/completions" || !strings.Contains(string(up.Body), `"model":"gpt-4o"`) {
+		t.Fatalf("unexpected openai upstream %+v err=%v", up, err)
+	}
+	if responseTranslator(ch, messages, true) == nil {
+		t.Fatalf("expected a messages translator")
+	}
+
+	// Native endpoints on a native channel go through unchanged.
+	ch = &models.Channel{BaseURL: "https://api.anthropic.com", Format: models.ChannelFormatAnthropic, ModelMapping: `{}`}
+	native := relayRequest{Model: "claude-sonnet-4", Endpoint: endpointMessages}
+	up, err = upstreamCall(ch, native, "/v1/messages", []byte(`{"model":"claude-sonnet-4"}`), "")
+	if err != nil || responseTranslator(ch, native, true) != nil || string(up.Body) != `{"model":"claude-sonnet-4"}` {
+		t.Fatalf("unexpected native upstream %+v err=%v", up, err)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the relay request ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds inbound IDs to what the log and ledger columns
+// hold.
+const maxRequestIDLength = 64
+
+// RequestIDMiddleware assigns every relay request a single ID. A well-formed
+// inbound X-Request-ID is kept so callers can trace their own IDs; otherwise
+// a UUID is generated. The ID is returned in the X-Request-ID response
+// header, forwarded upstream in the same header, and stored on the request's
+// APILog and credit transactions.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Set("request_id", id)
+		c.Request.Header.Set(requestIDHeader, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// validRequestID accepts IDs of printable, header- and log-safe characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		ch := id[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '_' || ch == '.' || ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the ID assigned by RequestIDMiddleware, or ""
+// outside the relay routes.
+func requestIDFromContext(c *gin.Context) string {
+	if c == nil {
+		return ""
+	}
+	id, _ := c.Get("request_id")
+	s, _ := id.(string)
+	return s
+}
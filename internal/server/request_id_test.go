@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		inbound string
+		keep    bool
+	}{
+		{"ticket-42.retry:1", true},
+		{"", false},
+		{"has space", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tc := range cases {
+		r := gin.New()
+		var seen, forwarded string
+		r.Use(RequestIDMiddleware())
+		r.POST("/v1/chat/completions", func(c *gin.Context) {
+			seen = requestIDFromContext(c)
+			forwarded = c.Request.Header.Get(requestIDHeader)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if tc.inbound != "" {
+			req.Header.Set(requestIDHeader, tc.inbound)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+
+		got := rec.Header().Get(requestIDHeader)
+		if got == "" || got != seen || got != forwarded {
+			t.Fatalf("inbound %q: inconsistent ids header=%q context=%q forwarded=%q", tc.inbound, got, seen, forwarded)
+		}
+		if (got == tc.inbound) != tc.keep {
+			t.Fatalf("inbound %q: expected keep=%v, got %q", tc.inbound, tc.keep, got)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"linuxdo-relay/internal/logger"
+	"linuxdo-relay/internal/models"
+	"linuxdo-relay/internal/relay"
+)
+
+// maxCachedResponseSize caps the responses stored in the cache; larger ones
+// are relayed as usual but not cached.
+const maxCachedResponseSize = 1 << 20
+
+// cacheHeader reports on cacheable requests whether they were served from
+// the cache ("HIT") or upstream ("MISS").
+const cacheHeader = "X-Relay-Cache"
+
+// cacheIgnoredFields identify the caller or tune delivery without changing
+// the answer, so they are left out of the cache key. stream_options stays in:
+// a cached stream carries the usage chunk only if the client asked for it.
+var cacheIgnoredFields = []string{"user", "metadata", "safety_identifier", "prompt_cache_key", "service_tier"}
+
+// responseCachePlan is a request that may be answered from, or stored in,
+// the response cache under key.
+type responseCachePlan struct {
+	key  string
+	rule models.ResponseCacheRule
+}
+
+// cachedResponse is what the cache stores: the response as the client saw
+// it, plus the upstream usage so hits can be priced.
+type cachedResponse struct {
+	Status      int         `json:"status"`
+	ContentType string      `json:"content_type"`
+	Body        []byte      `json:"body"`
+	Usage       relay.Usage `json:"usage"`
+}
+
+// selectResponseCacheRule picks the most specific enabled rule for req,
+// matched like quota rules.
+func selectResponseCacheRule(rules []models.ResponseCacheRule, req relayRequest) *models.ResponseCacheRule {
+	var best *models.ResponseCacheRule
+	bestRank := -1
+	for i := range rules {
+		if !rules[i].Enabled {
+			continue
+		}
+		if rank := ruleMatchRank(rules[i].ModelPattern, rules[i].Endpoint, req.Model, req.Endpoint); rank > bestRank {
+			bestRank = rank
+			best = &rules[i]
+		}
+	}
+	return best
+}
+
+// responseCacheable reports whether a request with the given JSON fields may
+// use the cache under rule. Multipart uploads and Responses API calls, which
+// create server-side state, never do.
+func responseCacheable(rule *models.ResponseCacheRule, req relayRequest, fields map[string]interface{}) bool {
+	if req.multipart() || req.Endpoint == endpointResponses {
+		return false
+	}
+	if requestStreams(req, fields) && !rule.AllowStream {
+		return false
+	}
+	if requestSamples(req, fields) && !rule.AllowSampling {
+		return false
+	}
+	return true
+}
+
+// requestStreams reports whether the request asks for an SSE response.
+func requestStreams(req relayRequest, fields map[string]interface{}) bool {
+	if req.Endpoint == endpointStreamGenerateContent {
+		return true
+	}
+	stream, _ := fields["stream"].(bool)
+	return stream
+}
+
+// requestSamples reports whether the answer may differ between identical
+// requests. Embeddings, moderations and token counts are deterministic and
+// image generation never is; elsewhere only an explicit temperature of zero
+// counts as deterministic, since every provider defaults above it.
+func requestSamples(req relayRequest, fields map[string]interface{}) bool {
+	switch req.Endpoint {
+	case endpointEmbeddings, endpointModerations, endpointCountTokens, endpointMessagesCountTokens,
+		endpointEmbedContent, endpointBatchEmbedContents:
+		return false
+	case endpointImageGenerations:
+		return true
+	}
+	temperature, ok := fields["temperature"]
+	if config, isMap := fields["generationConfig"].(map[string]interface{}); isMap && !ok {
+		temperature, ok = config["temperature"]
+	}
+	if !ok {
+		return true
+	}
+	n, isNumber := temperature.(json.Number)
+	if !isNumber {
+		return true
+	}
+	t, err := n.Float64()
+	return err != nil || t > 0
+}
+
+// responseCacheKey hashes the request into a cache key. A non-zero userID
+// scopes the key to that user; 0 shares it across users. The body is
+// canonicalised (sorted keys, ignored fields removed) so formatting and
+// field order do not matter.
+func responseCacheKey(userID uint, req relayRequest, rawQuery string, fields map[string]interface{}) (string, error) {
+	for _, f := range cacheIgnoredFields {
+		delete(fields, f)
+	}
+	canonical, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n%s\n", userID, req.Model, req.Endpoint, rawQuery)
+	h.Write(canonical)
+	return "relay_cache:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// planResponseCache returns the cache plan for the current request, or nil
+// when no enabled rule covers it, the request is not cacheable, or the client
+// sent Cache-Control: no-cache.
+func planResponseCache(app *AppContext, c *gin.Context, req relayRequest, body []byte) *responseCachePlan {
+	if app == nil || app.DB == nil || app.Redis == nil || app.Redis.Client == nil {
+		return nil
+	}
+	if strings.Contains(strings.ToLower(c.GetHeader("Cache-Control")), "no-cache") {
+		return nil
+	}
+	var rules []models.ResponseCacheRule
+	if err := app.DB.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+		logger.Error("cache: failed to load rules", "error", err, "requestID", requestIDFromContext(c))
+		return nil
+	}
+	rule := selectResponseCacheRule(rules, req)
+	if rule == nil || rule.TTLSeconds <= 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil
+	}
+	if !responseCacheable(rule, req, fields) {
+		return nil
+	}
+	var scope uint
+	if rule.PerUser {
+		scope = currentUserID(c)
+	}
+	key, err := responseCacheKey(scope, req, relay.StripQueryCredentials(c.Request.URL.RawQuery), fields)
+	if err != nil {
+		return nil
+	}
+	return &responseCachePlan{key: key, rule: *rule}
+}
+
+// serveCachedResponse answers the request from the cache if plan has an
+// entry. The cached usage and the rule's hit price are left on the context
+// for CreditMiddleware.
+func serveCachedResponse(app *AppContext, c *gin.Context, plan *responseCachePlan) (cachedResponse, bool) {
+	var entry cachedResponse
+	raw, err := app.Redis.Get(context.Background(), plan.key).Bytes()
+	if err != nil || json.Unmarshal(raw, &entry) != nil {
+		return entry, false
+	}
+	if !entry.Usage.IsZero() {
+		c.Set("relay_usage", entry.Usage)
+	}
+	c.Set("relay_cache_hit_percent", plan.rule.HitCreditPercent)
+	c.Header(cacheHeader, "HIT")
+	c.Data(entry.Status, entry.ContentType, entry.Body)
+	return entry, true
+}
+
+// storeCachedResponse caches a successful response captured by w, unless it
+// was too large to capture whole.
+func storeCachedResponse(app *AppContext, plan *responseCachePlan, w *captureWriter, res relay.ProxyResult) {
+	status := w.Status()
+	if w.truncated || status < 200 || status >= 300 || res.StatusCode < 200 || res.StatusCode >= 300 {
+		return
+	}
+	raw, err := json.Marshal(cachedResponse{
+		Status:      status,
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        w.buf.Bytes(),
+		Usage:       res.Usage,
+	})
+	if err != nil {
+		return
+	}
+	ttl := time.Duration(plan.rule.TTLSeconds) * time.Second
+	if err := app.Redis.Set(context.Background(), plan.key, raw, ttl).Err(); err != nil {
+		logger.Error("cache: failed to store response", "error", err)
+	}
+}
+
+// cacheHitPercentFromContext returns the share of the price charged for a
+// request served from the cache, and false for requests that were not.
+func cacheHitPercentFromContext(c *gin.Context) (int, bool) {
+	val, ok := c.Get("relay_cache_hit_percent")
+	if !ok {
+		return 0, false
+	}
+	percent, ok := val.(int)
+	return percent, ok
+}
+
+// cacheHitCost applies a hit percentage to the full cost, rounding up.
+func cacheHitCost(full, percent int) int {
+	if full <= 0 || percent <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(full) * float64(percent) / 100))
+}
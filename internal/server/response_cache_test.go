@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"linuxdo-relay/internal/models"
+)
+
+func decodeCacheFields(t *testing.T, body string) map[string]interface{} {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader([]byte(body)))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+	return fields
+}
+
+func TestResponseCacheKeyIsCanonical(t *testing.T) {
+	req := relayRequest{Model: "gpt-4o", Endpoint: endpointChatCompletions}
+	a, _ := responseCacheKey(1, req, "", decodeCacheFields(t, `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}],"user":"alice"}`))
+	b, _ := responseCacheKey(1, req, "", decodeCacheFields(t, `{ "messages": [ {"content":"hi", "role":"user"} ], "temperature": 0, "model": "gpt-4o", "user": "bob" }`))
+	if a != b {
+		t.Fatalf("expected equal keys for equivalent bodies, got %s and %s", a, b)
+	}
+	other, _ := responseCacheKey(2, req, "", decodeCacheFields(t, `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`))
+	if other == a {
+		t.Fatalf("expected keys to be scoped per user")
+	}
+	shared, _ := responseCacheKey(0, req, "", decodeCacheFields(t, `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}],"user":"alice"}`))
+	if shared == a || shared == other {
+		t.Fatalf("expected shared keys to differ from per-user keys")
+	}
+	usage, _ := responseCacheKey(1, req, "", decodeCacheFields(t, `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}],"stream_options":{"include_usage":true}}`))
+	if usage == a {
+		t.Fatalf("expected stream_options to be part of the key")
+	}
+	changed, _ := responseCacheKey(1, req, "", decodeCacheFields(t, `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hello"}]}`))
+	if changed == a {
+		t.Fatalf("expected different prompts to have different keys")
+	}
+}
+
+func TestResponseCacheable(t *testing.T) {
+	strict := &models.ResponseCacheRule{TTLSeconds: 60, Enabled: true}
+	cases := []struct {
+		req  relayRequest
+		body string
+		want bool
+	}{
+		{relayRequest{Endpoint: endpointChatCompletions}, `{"temperature":0}`, true},
+		{relayRequest{Endpoint: endpointChatCompletions}, `{"temperature":0.7}`, false},
+		{relayRequest{Endpoint: endpointChatCompletions}, `{}`, false},
+		{relayRequest{Endpoint: endpointChatCompletions}, `{"temperature":0,"stream":true}`, false},
+		{relayRequest{Endpoint: endpointGenerateContent}, `{"generationConfig":{"temperature":0}}`, true},
+		{relayRequest{Endpoint: endpointStreamGenerateContent}, `{"generationConfig":{"temperature":0}}`, false},
+		{relayRequest{Endpoint: endpointEmbeddings}, `{"input":"hi"}`, true},
+		{relayRequest{Endpoint: endpointResponses}, `{"temperature":0}`, false},
+	}
+	for _, tc := range cases {
+		if got := responseCacheable(strict, tc.req, decodeCacheFields(t, tc.body)); got != tc.want {
+			t.Fatalf("%s %s: expected %v, got %v", tc.req.Endpoint, tc.body, tc.want, got)
+		}
+	}
+
+	relaxed := &models.ResponseCacheRule{TTLSeconds: 60, Enabled: true, AllowStream: true, AllowSampling: true}
+	if !responseCacheable(relaxed, relayRequest{Endpoint: endpointChatCompletions}, decodeCacheFields(t, `{"stream":true}`)) {
+		t.Fatalf("expected streaming, sampled requests to be cacheable when allowed")
+	}
+}
+
+func TestSelectResponseCacheRule(t *testing.T) {
+	rules := []models.ResponseCacheRule{
+		{ID: 1, ModelPattern: "", TTLSeconds: 60, Enabled: true},
+		{ID: 2, ModelPattern: "gpt-4", TTLSeconds: 60, Enabled: true},
+		{ID: 3, ModelPattern: "gpt-4o", TTLSeconds: 60, Enabled: false},
+	}
+	if rule := selectResponseCacheRule(rules, relayRequest{Model: "gpt-4o"}); rule == nil || rule.ID != 2 {
+		t.Fatalf("expected the longest enabled prefix, got %+v", rule)
+	}
+	if rule := selectResponseCacheRule(rules[2:], relayRequest{Model: "gpt-4o"}); rule != nil {
+		t.Fatalf("expected disabled rules to be ignored, got %+v", rule)
+	}
+}
+
+func TestCacheHitCost(t *testing.T) {
+	cases := []struct{ full, percent, want int }{
+		{10, 0, 0},
+		{10, 100, 10},
+		{10, 25, 3},
+		{0, 50, 0},
+	}
+	for _, tc := range cases {
+		if got := cacheHitCost(tc.full, tc.percent); got != tc.want {
+			t.Fatalf("cacheHitCost(%d, %d): expected %d, got %d", tc.full, tc.percent, tc.want, got)
+		}
+	}
+}
@@ -352,7 +352,14 @@ func SetupRoutes(r *gin.Engine, app *AppContext) {
 			})
 		}
 
-		c.JSON(http.StatusOK, gin.H{"items": res})
+		inFlight, _ := inFlightRequests(app, userID)
+		c.JSON(http.StatusOK, gin.H{
+			"items": res,
+			"concurrency": gin.H{
+				"in_flight": inFlight,
+				"limit":     concurrencyLimitFromContext(app, c),
+			},
+		})
 	})
 
 	jwtGroup.GET("/me/api_logs", func(c *gin.Context) {
@@ -379,6 +386,9 @@ func SetupRoutes(r *gin.Engine, app *AppContext) {
 		}
 
 		db := app.DB.Model(&models.APILog{}).Where("user_id = ?", userID)
+		if requestID := c.Query("request_id"); requestID != "" {
+			db = db.Where("request_id = ?", requestID)
+		}
 
 		if start := c.Query("start"); start != "" {
 			db = db.Where("created_at >= ?", start)
@@ -458,8 +468,10 @@ func SetupRoutes(r *gin.Engine, app *AppContext) {
 	// These endpoints require API key and do not accept JWT
 	// ========================================
 	apiKeyGroup := r.Group("/")
+	apiKeyGroup.Use(RequestIDMiddleware())
 	apiKeyGroup.Use(AuthMiddleware(app))
 	apiKeyGroup.Use(APIKeyOnlyMiddleware())
+	apiKeyGroup.Use(ConcurrencyMiddleware(app))
 	apiKeyGroup.Use(QuotaMiddleware(app))
 	apiKeyGroup.Use(CreditMiddleware(app))
 	RegisterRelayRoutes(apiKeyGroup, app)
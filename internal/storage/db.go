@@ -75,10 +75,15 @@ func (db *DB) AutoMigrate() error {
 	return db.DB.AutoMigrate(
 		&models.User{},
 		&models.Channel{},
+		&models.ChannelKey{},
 		&models.QuotaRule{},
 		&models.ModelCreditRule{},
 		&models.CreditTransaction{},
 		&models.APILog{},
+		&models.APIAttempt{},
+		&models.PayloadCaptureRule{},
+		&models.PayloadCapture{},
+		&models.ResponseCacheRule{},
 		&models.OperationLog{},
 		&models.LoginLog{},
 		&models.CheckInLog{},
@@ -1,7 +1,19 @@
 import React, { useCallback, useEffect, useMemo, useState } from 'react';
-import { Button, Card, Form, Modal, Popconfirm, Space, Table, Toast, Typography } from '@douyinfe/semi-ui';
+import {
+  Button,
+  Card,
+  Form,
+  Modal,
+  Popconfirm,
+  Select,
+  Space,
+  Table,
+  Toast,
+  Typography,
+} from '@douyinfe/semi-ui';
 import axios from 'axios';
 import { useAuth } from '../auth/AuthContext.jsx';
+import { RELAY_ENDPOINTS } from './relayEndpoints.js';
 
 const { Title, Text } = Typography;
 
@@ -110,6 +122,12 @@ export function AdminCreditRulesPage() {
           columns={[
             { title: 'ID', dataIndex: 'id', width: 80 },
             { title: '模型前缀', dataIndex: 'model_pattern' },
+            {
+              title: '端点',
+              dataIndex: 'endpoint',
+              width: 180,
+              render: (v) => v || '全部',
+            },
             { title: '积分单价', dataIndex: 'credit_cost', width: 140 },
             {
               title: '更新时间',
@@ -161,7 +179,13 @@ export function AdminCreditRulesPage() {
           initValues={
             editing || {
               model_pattern: '',
+              endpoint: '',
               credit_cost: 1,
+              input_price_per_million: 0,
+              output_price_per_million: 0,
+              cached_price_per_million: 0,
+              price_per_image: 0,
+              price_per_audio_second: 0,
             }
           }
           onSubmit={handleSubmit}
@@ -172,14 +196,56 @@ export function AdminCreditRulesPage() {
             required
             placeholder='例如 gpt-4'
           />
+          <Form.Select
+            field='endpoint'
+            label='端点（留空表示全部）'
+            style={{ width: '100%' }}
+          >
+            <Select.Option value=''>全部端点</Select.Option>
+            {RELAY_ENDPOINTS.map((e) => (
+              <Select.Option key={e} value={e}>
+                {e}
+              </Select.Option>
+            ))}
+          </Form.Select>
           <Form.InputNumber
             field='credit_cost'
-            label='积分单价'
-            min={1}
+            label='积分单价（每次请求）'
+            min={0}
             precision={0}
             required
             style={{ width: '100%' }}
           />
+          <Form.InputNumber
+            field='input_price_per_million'
+            label='输入价格（积分 / 百万 tokens）'
+            min={0}
+            style={{ width: '100%' }}
+          />
+          <Form.InputNumber
+            field='output_price_per_million'
+            label='输出价格（积分 / 百万 tokens）'
+            min={0}
+            style={{ width: '100%' }}
+          />
+          <Form.InputNumber
+            field='cached_price_per_million'
+            label='缓存输入价格（积分 / 百万 tokens，0 表示按输入价格）'
+            min={0}
+            style={{ width: '100%' }}
+          />
+          <Form.InputNumber
+            field='price_per_image'
+            label='图片价格（积分 / 张）'
+            min={0}
+            style={{ width: '100%' }}
+          />
+          <Form.InputNumber
+            field='price_per_audio_second'
+            label='音频价格（积分 / 秒）'
+            min={0}
+            style={{ width: '100%' }}
+          />
           <div style={{ textAlign: 'right', marginTop: 16 }}>
             <Space>
               <Button onClick={() => setVisible(false)}>取消</Button>
@@ -1,5 +1,5 @@
 import React, { useCallback, useEffect, useMemo, useState } from 'react';
-import { Card, Tabs, Table, Toast, Typography } from '@douyinfe/semi-ui';
+import { Card, Input, Tabs, Table, Toast, Typography } from '@douyinfe/semi-ui';
 import axios from 'axios';
 import { useAuth } from '../auth/AuthContext.jsx';
 
@@ -12,6 +12,7 @@ export function AdminLogsPage() {
   const [apiTotal, setApiTotal] = useState(0);
   const [apiPage, setApiPage] = useState(1);
   const [apiLoading, setApiLoading] = useState(false);
+  const [apiRequestID, setApiRequestID] = useState('');
 
   const [loginLogs, setLoginLogs] = useState([]);
   const [loginTotal, setLoginTotal] = useState(0);
@@ -34,7 +35,7 @@ export function AdminLogsPage() {
     try {
       const res = await axios.get('/admin/api_logs', {
         headers,
-        params: { page: apiPage, page_size: PAGE_SIZE },
+        params: { page: apiPage, page_size: PAGE_SIZE, request_id: apiRequestID || undefined },
       });
       setApiLogs(res.data?.items || []);
       setApiTotal(res.data?.total || 0);
@@ -44,7 +45,7 @@ export function AdminLogsPage() {
     } finally {
       setApiLoading(false);
     }
-  }, [apiPage, headers, isAdmin, token]);
+  }, [apiPage, apiRequestID, headers, isAdmin, token]);
 
   const fetchLoginLogs = useCallback(async () => {
     if (!token || !isAdmin) return;
@@ -110,6 +111,19 @@ export function AdminLogsPage() {
       <Card>
         <Tabs type='line'>
           <Tabs.TabPane tab='API 调用日志' itemKey='api'>
+            <Input
+              showClear
+              placeholder='按请求 ID 搜索'
+              style={{ width: 320, marginBottom: 12 }}
+              onEnterPress={(e) => {
+                setApiPage(1);
+                setApiRequestID(e.target.value.trim());
+              }}
+              onClear={() => {
+                setApiPage(1);
+                setApiRequestID('');
+              }}
+            />
             <Table
               rowKey='id'
               loading={apiLoading}
@@ -127,6 +141,12 @@ export function AdminLogsPage() {
                 { title: '状态', dataIndex: 'status', width: 100 },
                 { title: '状态码', dataIndex: 'status_code', width: 100 },
                 { title: 'IP', dataIndex: 'ip_address', width: 140 },
+                {
+                  title: '请求 ID',
+                  dataIndex: 'request_id',
+                  width: 140,
+                  render: (v) => (v ? <Text copyable={{ content: v }}>{v.slice(0, 8)}</Text> : '-'),
+                },
                 {
                   title: '时间',
                   dataIndex: 'created_at',
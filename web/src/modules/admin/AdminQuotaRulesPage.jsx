@@ -5,6 +5,7 @@ import {
   Form,
   Modal,
   Popconfirm,
+  Select,
   Space,
   Table,
   Toast,
@@ -12,6 +13,7 @@ import {
 } from '@douyinfe/semi-ui';
 import axios from 'axios';
 import { useAuth } from '../auth/AuthContext.jsx';
+import { RELAY_ENDPOINTS } from './relayEndpoints.js';
 
 const { Title, Text } = Typography;
 
@@ -121,6 +123,12 @@ export function AdminQuotaRulesPage() {
             { title: 'ID', dataIndex: 'id', width: 80 },
             { title: '用户等级', dataIndex: 'level', width: 120 },
             { title: '模型前缀', dataIndex: 'model_pattern' },
+            {
+              title: '端点',
+              dataIndex: 'endpoint',
+              width: 180,
+              render: (v) => v || '全部',
+            },
             { title: '最大请求数', dataIndex: 'max_requests', width: 160 },
             { title: '时间窗口(秒)', dataIndex: 'window_seconds', width: 180 },
             {
@@ -168,6 +176,7 @@ export function AdminQuotaRulesPage() {
             editing || {
               level: 1,
               model_pattern: '',
+              endpoint: '',
               max_requests: 20,
               window_seconds: 3600,
             }
@@ -187,6 +196,18 @@ export function AdminQuotaRulesPage() {
             placeholder='例如 gpt-4'
             required
           />
+          <Form.Select
+            field='endpoint'
+            label='端点（留空表示全部）'
+            style={{ width: '100%' }}
+          >
+            <Select.Option value=''>全部端点</Select.Option>
+            {RELAY_ENDPOINTS.map((e) => (
+              <Select.Option key={e} value={e}>
+                {e}
+              </Select.Option>
+            ))}
+          </Form.Select>
           <Form.InputNumber
             field='max_requests'
             label='最大请求次数'
@@ -168,6 +168,7 @@ export function AdminUsersPage() {
             role: editing?.role || 'user',
             level: editing?.level || 1,
             status: editing?.status || 'normal',
+            max_concurrent_requests: editing?.max_concurrent_requests || 0,
           }}
           onSubmit={handleSubmit}
         >
@@ -186,6 +187,13 @@ export function AdminUsersPage() {
             <Select.Option value='normal'>正常</Select.Option>
             <Select.Option value='disabled'>已禁用</Select.Option>
           </Form.Select>
+          <Form.InputNumber
+            field='max_concurrent_requests'
+            label='并发上限'
+            min={0}
+            style={{ width: '100%' }}
+            placeholder='同时进行中的请求数，0 表示使用等级默认值'
+          />
           <div style={{ textAlign: 'right', marginTop: 16 }}>
             <Space>
               <Button onClick={() => setVisible(false)}>取消</Button>
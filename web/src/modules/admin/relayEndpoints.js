@@ -0,0 +1,17 @@
+// Relay endpoints that quota and credit rules can be scoped to. An empty
+// value applies the rule to every endpoint.
+export const RELAY_ENDPOINTS = [
+  'chat.completions',
+  'responses',
+  'completions',
+  'embeddings',
+  'images.generations',
+  'audio.transcriptions',
+  'moderations',
+  'messages',
+  'generateContent',
+  'streamGenerateContent',
+  'countTokens',
+  'embedContent',
+  'batchEmbedContents',
+];
@@ -11,6 +11,7 @@ export function MePage() {
   const [apiKey, setApiKey] = useState('');
   const [loading, setLoading] = useState(false);
   const [quotaUsage, setQuotaUsage] = useState([]);
+  const [concurrency, setConcurrency] = useState(null);
   const [quotaLoading, setQuotaLoading] = useState(false);
   const [apiLogs, setApiLogs] = useState([]);
   const [apiLogsLoading, setApiLogsLoading] = useState(false);
@@ -49,6 +50,7 @@ export function MePage() {
     try {
       const res = await axios.get('/me/quota_usage', { headers: authHeaders });
       setQuotaUsage(res.data?.items || []);
+      setConcurrency(res.data?.concurrency || null);
     } catch (err) {
       console.error('fetch quota usage failed', err);
       Toast.error('获取配额使用情况失败');
@@ -244,6 +246,11 @@ export function MePage() {
             }
             style={{ marginBottom: 24, borderRadius: 10 }}
           >
+            {concurrency && (
+              <Text type='tertiary' size='small' style={{ display: 'block', marginBottom: 12 }}>
+                进行中的请求：{concurrency.in_flight} / {concurrency.limit > 0 ? concurrency.limit : '不限'}
+              </Text>
+            )}
             <Table
               rowKey={(row, idx) => `${row.model_pattern || 'all'}-${idx}`}
               loading={quotaLoading}
@@ -281,6 +288,11 @@ export function MePage() {
                   columns={[
                     { title: '模型', dataIndex: 'model' },
                     { title: '状态', dataIndex: 'status_code', render: (v) => <Tag color={v === 200 ? 'green' : 'red'}>{v}</Tag> },
+                    {
+                      title: '请求 ID',
+                      dataIndex: 'request_id',
+                      render: (v) => (v ? <Text copyable={{ content: v }} size='small'>{v.slice(0, 8)}</Text> : '-'),
+                    },
                     {
                       title: '时间',
                       dataIndex: 'created_at',